@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"quickstart/database"
+)
+
+// runMakeAdminCommand handles `make-admin <username>`, promoting an already
+// registered user. It's how the first admin gets created.
+func runMakeAdminCommand(ctx context.Context, users database.UserStore, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: make-admin <username>")
+	}
+
+	user, err := users.GetByUsername(ctx, args[0])
+	if err != nil {
+		if err == database.ErrNotFound {
+			return fmt.Errorf("user %q doesn't exist, register it first", args[0])
+		}
+		return err
+	}
+
+	if err := users.SetRole(ctx, user.Id, database.RoleAdmin); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now an admin\n", user.Username)
+	return nil
+}
@@ -0,0 +1,716 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Database struct {
+	Host        string
+	Port        string
+	User        string
+	Password    string
+	Name        string
+	SSLMode     string
+	AutoMigrate bool
+}
+
+// ConnectionString returns the lib/pq connection string for the database
+func (db Database) ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s "+
+		"password=%s dbname=%s sslmode=%s",
+		db.Host, db.Port, db.User, db.Password, db.Name, db.SSLMode)
+}
+
+// Mail selects how emails are sent: through an SMTP server, written to
+// files in Dir, or kept in memory
+type Mail struct {
+	Driver       string
+	From         string
+	Dir          string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// OIDC configures login through an OpenID Connect provider, disabled while
+// Issuer is empty
+type OIDC struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /auth/oidc/callback, as registered with
+	// the provider
+	RedirectURL string
+	Scopes      []string
+}
+
+func (o OIDC) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// Passwords configures how passwords are hashed and which ones users can
+// choose
+type Passwords struct {
+	// Hasher is bcrypt or argon2id. Hashes made with the other one, or with
+	// other parameters, are replaced when their user next logs in.
+	Hasher     string
+	BcryptCost int
+	// Argon2Memory is in KiB
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+	// MinLength is in characters
+	MinLength int
+	// BreachedFile lists passwords that are refused, empty for none
+	BreachedFile string
+}
+
+// WebAuthn configures passkeys. The relying party id and origins default to
+// the host and origin of AppURL.
+type WebAuthn struct {
+	// RPID is the domain passkeys are registered for, they work on it and
+	// its subdomains
+	RPID   string
+	RPName string
+	// Origins are the frontend origins allowed to use passkeys
+	Origins []string
+}
+
+type Config struct {
+	ListenAddr string
+	// ReadTimeout, WriteTimeout and IdleTimeout are applied to the HTTP server
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish on SIGTERM
+	ShutdownTimeout time.Duration
+	DB              Database
+	// StaticDir is served under /static/, uploaded images go to its images folder
+	StaticDir string
+	// MaxUploadBytes limits multipart bodies with files, e.g. a profile picture
+	MaxUploadBytes int64
+	// MaxFormBytes limits other multipart form bodies
+	MaxFormBytes int64
+	// SessionMaxAge is how long a session lasts without being used, or
+	// SessionRememberMaxAge for remember me logins. Neither ever outlives
+	// SessionAbsoluteMaxAge.
+	SessionMaxAge         time.Duration
+	SessionRememberMaxAge time.Duration
+	SessionAbsoluteMaxAge time.Duration
+	// SessionRenewAfter is how much a session's expiration must be pushed
+	// before the renewal is saved
+	SessionRenewAfter time.Duration
+	Passwords         Passwords
+	// Failed logins are counted per account and per IP. After
+	// LoginFreeAttempts failures each new attempt has to wait twice as long,
+	// starting at LoginBackoffBase, and at the lockout threshold the account
+	// or IP is locked for LoginLockoutDuration.
+	LoginFreeAttempts       int
+	LoginBackoffBase        time.Duration
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutDuration    time.Duration
+	// TrustedProxies are the addresses or CIDR ranges of the reverse proxies
+	// in front of the server. The client IP is taken from X-Forwarded-For
+	// only when a request comes from one of them.
+	TrustedProxies []string
+	// Attributes of the sid cookie. SameSite is lax, strict or none, none
+	// requires Secure.
+	CookieSecure   bool
+	CookieSameSite string
+	CookieDomain   string
+	// CORSAllowedOrigins are the origins allowed to make credentialed
+	// cross-origin requests, e.g. https://mytinerary.example. Empty means
+	// the origin of AppURL, see CORSOrigins
+	CORSAllowedOrigins []string
+	Mail               Mail
+	// AppURL is the frontend's address, links in emails point to it
+	AppURL string
+	// PasswordResetTTL is how long a password reset link works
+	PasswordResetTTL time.Duration
+	// EmailVerificationTTL is how long an email verification link works
+	EmailVerificationTTL time.Duration
+	// RequireVerifiedEmail stops users without a verified email from
+	// creating itineraries and comments
+	RequireVerifiedEmail bool
+	// MagicLinkTTL is how long an emailed login link works. At most
+	// MagicLinkLimit links are sent to an address until it has had none for
+	// MagicLinkWindow.
+	MagicLinkTTL    time.Duration
+	MagicLinkLimit  int
+	MagicLinkWindow time.Duration
+	// TOTPIssuer is the account name shown by authenticator apps
+	TOTPIssuer string
+	OIDC       OIDC
+	WebAuthn   WebAuthn
+	// AccountDeletionPolicy is anonymize to keep the itineraries and
+	// comments of deleted accounts without an author, or delete to remove
+	// them too
+	AccountDeletionPolicy string
+	// Background job intervals, 0 disables the job
+	SessionPurgeInterval time.Duration
+	ImageCleanupInterval time.Duration
+	// JobJitter is the maximum random delay added to every job interval
+	JobJitter time.Duration
+}
+
+// TrustedProxyNets returns TrustedProxies as networks, a bare address is a
+// network of its own. Invalid entries are left out, Validate reports them.
+func (c Config) TrustedProxyNets() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, proxy := range c.TrustedProxies {
+		if network, ok := parseNetwork(proxy); ok {
+			nets = append(nets, network)
+		}
+	}
+	return nets
+}
+
+func parseNetwork(s string) (*net.IPNet, bool) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// WebAuthnRPID returns the relying party id passkeys are scoped to
+func (c Config) WebAuthnRPID() string {
+	if c.WebAuthn.RPID != "" {
+		return c.WebAuthn.RPID
+	}
+	if parsed, err := url.Parse(c.AppURL); err == nil {
+		return parsed.Hostname()
+	}
+	return ""
+}
+
+// WebAuthnOrigins returns the origins allowed to use passkeys
+func (c Config) WebAuthnOrigins() []string {
+	if len(c.WebAuthn.Origins) > 0 {
+		return c.WebAuthn.Origins
+	}
+	if parsed, err := url.Parse(c.AppURL); err == nil {
+		return []string{parsed.Scheme + "://" + parsed.Host}
+	}
+	return nil
+}
+
+// CORSOrigins returns the origins allowed to make credentialed
+// cross-origin requests
+func (c Config) CORSOrigins() []string {
+	if len(c.CORSAllowedOrigins) > 0 {
+		return c.CORSAllowedOrigins
+	}
+	if parsed, err := url.Parse(c.AppURL); err == nil && parsed.Host != "" {
+		return []string{parsed.Scheme + "://" + parsed.Host}
+	}
+	return nil
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:      ":8001",
+		ReadTimeout:     time.Minute,
+		WriteTimeout:    time.Minute,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		DB: Database{
+			Host:        "localhost",
+			Port:        "5432",
+			SSLMode:     "disable",
+			AutoMigrate: true,
+		},
+		StaticDir:      "./static",
+		MaxUploadBytes: 25 * 1024 * 1024,
+		MaxFormBytes:   32 << 20,
+		SessionMaxAge:  time.Hour * 24,
+
+		SessionRememberMaxAge: time.Hour * 24 * 30,
+		SessionAbsoluteMaxAge: time.Hour * 24 * 90,
+		SessionRenewAfter:     time.Hour,
+		Passwords: Passwords{
+			Hasher:            "bcrypt",
+			BcryptCost:        12,
+			Argon2Memory:      19 * 1024,
+			Argon2Iterations:  2,
+			Argon2Parallelism: 1,
+			MinLength:         8,
+		},
+
+		LoginFreeAttempts:       3,
+		LoginBackoffBase:        time.Second,
+		LoginLockoutThreshold:   10,
+		LoginIPLockoutThreshold: 50,
+		LoginLockoutDuration:    15 * time.Minute,
+
+		CookieSecure:   true,
+		CookieSameSite: "lax",
+
+		Mail: Mail{
+			Driver:   "file",
+			From:     "Mytinerary <no-reply@localhost>",
+			Dir:      "./mail",
+			SMTPPort: "587",
+		},
+		AppURL:               "http://localhost:3000",
+		PasswordResetTTL:     time.Hour,
+		EmailVerificationTTL: 48 * time.Hour,
+		MagicLinkTTL:         15 * time.Minute,
+		MagicLinkLimit:       3,
+		MagicLinkWindow:      15 * time.Minute,
+		TOTPIssuer:           "Mytinerary",
+		OIDC: OIDC{
+			Scopes: []string{"openid", "email", "profile"},
+		},
+		WebAuthn: WebAuthn{
+			RPName: "Mytinerary",
+		},
+		AccountDeletionPolicy: "anonymize",
+
+		SessionPurgeInterval: time.Hour,
+		ImageCleanupInterval: time.Hour * 24,
+		JobJitter:            time.Minute,
+	}
+}
+
+// setting is a single configuration value. Name is both the environment
+// variable and the key used in the config file.
+type setting struct {
+	name  string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func stringSetting(name, flag, usage string, field func(c *Config) *string) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func boolSetting(name, flag, usage string, field func(c *Config) *bool) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}}
+}
+
+func intSetting(name, flag, usage string, field func(c *Config) *int) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}}
+}
+
+func bytesSetting(name, flag, usage string, field func(c *Config) *int64) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}}
+}
+
+// listSetting takes a comma separated list
+func listSetting(name, flag, usage string, field func(c *Config) *[]string) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}}
+}
+
+func durationSetting(name, flag, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{name, flag, usage, func(c *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("LISTEN_ADDR", "listen", "address the HTTP server listens on", func(c *Config) *string { return &c.ListenAddr }),
+	durationSetting("READ_TIMEOUT", "read-timeout", "maximum time to read a request, body included", func(c *Config) *time.Duration { return &c.ReadTimeout }),
+	durationSetting("WRITE_TIMEOUT", "write-timeout", "maximum time to write a response", func(c *Config) *time.Duration { return &c.WriteTimeout }),
+	durationSetting("IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections are kept", func(c *Config) *time.Duration { return &c.IdleTimeout }),
+	durationSetting("SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight requests get to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringSetting("DB_HOST", "db-host", "Postgres host", func(c *Config) *string { return &c.DB.Host }),
+	stringSetting("DB_PORT", "db-port", "Postgres port", func(c *Config) *string { return &c.DB.Port }),
+	stringSetting("DB_USER", "db-user", "Postgres user", func(c *Config) *string { return &c.DB.User }),
+	stringSetting("DB_PASSWORD", "db-password", "Postgres password", func(c *Config) *string { return &c.DB.Password }),
+	stringSetting("DB_DBNAME", "db-name", "Postgres database name", func(c *Config) *string { return &c.DB.Name }),
+	stringSetting("DB_SSLMODE", "db-sslmode", "Postgres sslmode (disable, require, verify-ca, verify-full)", func(c *Config) *string { return &c.DB.SSLMode }),
+	boolSetting("DB_AUTO_MIGRATE", "db-auto-migrate", "apply pending migrations on startup", func(c *Config) *bool { return &c.DB.AutoMigrate }),
+	stringSetting("STATIC_DIR", "static-dir", "directory served under /static/", func(c *Config) *string { return &c.StaticDir }),
+	bytesSetting("MAX_UPLOAD_BYTES", "max-upload-bytes", "maximum size of an upload, e.g. a profile picture", func(c *Config) *int64 { return &c.MaxUploadBytes }),
+	bytesSetting("MAX_FORM_BYTES", "max-form-bytes", "maximum size of a multipart form", func(c *Config) *int64 { return &c.MaxFormBytes }),
+	durationSetting("SESSION_MAX_AGE", "session-max-age", "how long an unused login session lasts", func(c *Config) *time.Duration { return &c.SessionMaxAge }),
+	durationSetting("SESSION_REMEMBER_MAX_AGE", "session-remember-max-age", "how long an unused remember me session lasts", func(c *Config) *time.Duration { return &c.SessionRememberMaxAge }),
+	durationSetting("SESSION_ABSOLUTE_MAX_AGE", "session-absolute-max-age", "how long a session lasts at most, however active", func(c *Config) *time.Duration { return &c.SessionAbsoluteMaxAge }),
+	durationSetting("SESSION_RENEW_AFTER", "session-renew-after", "how much a session's expiration must move before it's renewed", func(c *Config) *time.Duration { return &c.SessionRenewAfter }),
+	stringSetting("PASSWORD_HASHER", "password-hasher", "bcrypt or argon2id, other hashes are replaced on login", func(c *Config) *string { return &c.Passwords.Hasher }),
+	intSetting("BCRYPT_COST", "bcrypt-cost", "bcrypt cost used to hash passwords", func(c *Config) *int { return &c.Passwords.BcryptCost }),
+	intSetting("ARGON2_MEMORY", "argon2-memory", "argon2id memory in KiB", func(c *Config) *int { return &c.Passwords.Argon2Memory }),
+	intSetting("ARGON2_ITERATIONS", "argon2-iterations", "argon2id passes over the memory", func(c *Config) *int { return &c.Passwords.Argon2Iterations }),
+	intSetting("ARGON2_PARALLELISM", "argon2-parallelism", "argon2id threads", func(c *Config) *int { return &c.Passwords.Argon2Parallelism }),
+	intSetting("PASSWORD_MIN_LENGTH", "password-min-length", "minimum number of characters in a password", func(c *Config) *int { return &c.Passwords.MinLength }),
+	stringSetting("BREACHED_PASSWORDS_FILE", "breached-passwords-file", "file of refused passwords, one per line in plain text or as SHA-1", func(c *Config) *string { return &c.Passwords.BreachedFile }),
+	intSetting("LOGIN_FREE_ATTEMPTS", "login-free-attempts", "failed logins allowed before attempts are slowed down", func(c *Config) *int { return &c.LoginFreeAttempts }),
+	durationSetting("LOGIN_BACKOFF_BASE", "login-backoff-base", "first delay imposed after the free failed logins, doubled on each failure", func(c *Config) *time.Duration { return &c.LoginBackoffBase }),
+	intSetting("LOGIN_LOCKOUT_THRESHOLD", "login-lockout-threshold", "failed logins after which an account is locked", func(c *Config) *int { return &c.LoginLockoutThreshold }),
+	intSetting("LOGIN_IP_LOCKOUT_THRESHOLD", "login-ip-lockout-threshold", "failed logins after which an IP is locked", func(c *Config) *int { return &c.LoginIPLockoutThreshold }),
+	durationSetting("LOGIN_LOCKOUT_DURATION", "login-lockout-duration", "how long a lockout lasts, and how long failed logins are remembered", func(c *Config) *time.Duration { return &c.LoginLockoutDuration }),
+	listSetting("TRUSTED_PROXIES", "trusted-proxies", "comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted", func(c *Config) *[]string { return &c.TrustedProxies }),
+	boolSetting("COOKIE_SECURE", "cookie-secure", "only send the session cookie over https", func(c *Config) *bool { return &c.CookieSecure }),
+	stringSetting("COOKIE_SAMESITE", "cookie-samesite", "SameSite attribute of the session cookie (lax, strict or none)", func(c *Config) *string { return &c.CookieSameSite }),
+	stringSetting("COOKIE_DOMAIN", "cookie-domain", "Domain attribute of the session cookie, empty for the current host only", func(c *Config) *string { return &c.CookieDomain }),
+	listSetting("CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma separated origins allowed to call the API from a browser, defaults to the origin of APP_URL", func(c *Config) *[]string { return &c.CORSAllowedOrigins }),
+	stringSetting("MAIL_DRIVER", "mail-driver", "how emails are sent (smtp, file or memory)", func(c *Config) *string { return &c.Mail.Driver }),
+	stringSetting("MAIL_FROM", "mail-from", "sender of the emails", func(c *Config) *string { return &c.Mail.From }),
+	stringSetting("MAIL_DIR", "mail-dir", "directory the file mail driver writes to", func(c *Config) *string { return &c.Mail.Dir }),
+	stringSetting("SMTP_HOST", "smtp-host", "SMTP server host", func(c *Config) *string { return &c.Mail.SMTPHost }),
+	stringSetting("SMTP_PORT", "smtp-port", "SMTP server port", func(c *Config) *string { return &c.Mail.SMTPPort }),
+	stringSetting("SMTP_USERNAME", "smtp-username", "SMTP username, empty to skip authentication", func(c *Config) *string { return &c.Mail.SMTPUsername }),
+	stringSetting("SMTP_PASSWORD", "smtp-password", "SMTP password", func(c *Config) *string { return &c.Mail.SMTPPassword }),
+	stringSetting("APP_URL", "app-url", "frontend address used in the links sent by email", func(c *Config) *string { return &c.AppURL }),
+	durationSetting("PASSWORD_RESET_TTL", "password-reset-ttl", "how long a password reset link works", func(c *Config) *time.Duration { return &c.PasswordResetTTL }),
+	durationSetting("EMAIL_VERIFICATION_TTL", "email-verification-ttl", "how long an email verification link works", func(c *Config) *time.Duration { return &c.EmailVerificationTTL }),
+	durationSetting("MAGIC_LINK_TTL", "magic-link-ttl", "how long an emailed login link works", func(c *Config) *time.Duration { return &c.MagicLinkTTL }),
+	intSetting("MAGIC_LINK_LIMIT", "magic-link-limit", "login links sent to an address within MAGIC_LINK_WINDOW", func(c *Config) *int { return &c.MagicLinkLimit }),
+	durationSetting("MAGIC_LINK_WINDOW", "magic-link-window", "quiet time after which an address can get MAGIC_LINK_LIMIT links again", func(c *Config) *time.Duration { return &c.MagicLinkWindow }),
+	stringSetting("TOTP_ISSUER", "totp-issuer", "name authenticator apps show for two-factor codes", func(c *Config) *string { return &c.TOTPIssuer }),
+	stringSetting("OIDC_ISSUER", "oidc-issuer", "OpenID Connect provider to log in with, empty disables it", func(c *Config) *string { return &c.OIDC.Issuer }),
+	stringSetting("OIDC_CLIENT_ID", "oidc-client-id", "client id registered with the OpenID Connect provider", func(c *Config) *string { return &c.OIDC.ClientID }),
+	stringSetting("OIDC_CLIENT_SECRET", "oidc-client-secret", "client secret registered with the OpenID Connect provider", func(c *Config) *string { return &c.OIDC.ClientSecret }),
+	stringSetting("OIDC_REDIRECT_URL", "oidc-redirect-url", "this server's /auth/oidc/callback url as registered with the provider", func(c *Config) *string { return &c.OIDC.RedirectURL }),
+	listSetting("OIDC_SCOPES", "oidc-scopes", "comma separated scopes asked from the OpenID Connect provider", func(c *Config) *[]string { return &c.OIDC.Scopes }),
+	stringSetting("WEBAUTHN_RP_ID", "webauthn-rp-id", "domain passkeys are registered for, defaults to the host of APP_URL", func(c *Config) *string { return &c.WebAuthn.RPID }),
+	stringSetting("WEBAUTHN_RP_NAME", "webauthn-rp-name", "name shown when registering a passkey", func(c *Config) *string { return &c.WebAuthn.RPName }),
+	listSetting("WEBAUTHN_ORIGINS", "webauthn-origins", "comma separated frontend origins allowed to use passkeys, defaults to the origin of APP_URL", func(c *Config) *[]string { return &c.WebAuthn.Origins }),
+	boolSetting("REQUIRE_VERIFIED_EMAIL", "require-verified-email", "only let users with a verified email create itineraries and comments", func(c *Config) *bool { return &c.RequireVerifiedEmail }),
+	stringSetting("ACCOUNT_DELETION_POLICY", "account-deletion-policy", "anonymize or delete the itineraries and comments of deleted accounts", func(c *Config) *string { return &c.AccountDeletionPolicy }),
+	durationSetting("SESSION_PURGE_INTERVAL", "session-purge-interval", "how often expired sessions are deleted, 0 disables it", func(c *Config) *time.Duration { return &c.SessionPurgeInterval }),
+	durationSetting("IMAGE_CLEANUP_INTERVAL", "image-cleanup-interval", "how often unused uploaded images are deleted, 0 disables it", func(c *Config) *time.Duration { return &c.ImageCleanupInterval }),
+	durationSetting("JOB_JITTER", "job-jitter", "maximum random delay added to background job intervals", func(c *Config) *time.Duration { return &c.JobJitter }),
+}
+
+// Load builds the configuration from, in increasing order of precedence,
+// the defaults, the JSON config file given by -config or CONFIG_FILE, the
+// environment and the command line flags. It returns the arguments left
+// after the flags.
+func Load(args []string, stderr io.Writer) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("mytinerary", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+
+	// flags are applied last, so remember them until the file and the
+	// environment have been read
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, s := range settings {
+		s := s
+		fs.Func(s.flag, s.usage+" (env "+s.name+")", func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(&cfg, *configFile); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.name); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, nil, fmt.Errorf("%s: %w", s.name, err)
+			}
+		}
+	}
+
+	for _, f := range flagValues {
+		if err := f.setting.set(&cfg, f.value); err != nil {
+			return cfg, nil, fmt.Errorf("-%s: %w", f.setting.flag, err)
+		}
+	}
+
+	return cfg, fs.Args(), cfg.Validate()
+}
+
+// loadFile reads a JSON object whose keys are the setting names, e.g.
+// {"LISTEN_ADDR": ":8080", "BCRYPT_COST": 12}
+func loadFile(cfg *Config, path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(contents, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	known := map[string]setting{}
+	for _, s := range settings {
+		known[s.name] = s
+	}
+
+	for name, raw := range values {
+		s, ok := known[name]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %s", path, name)
+		}
+		var value string
+		switch v := raw.(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			value = strconv.FormatBool(v)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: %s must be a string, number, boolean or list", path, name)
+		}
+		if err := s.set(cfg, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	var problems []string
+	if c.ListenAddr == "" {
+		problems = append(problems, "LISTEN_ADDR can't be empty")
+	}
+	if c.ReadTimeout <= 0 {
+		problems = append(problems, "READ_TIMEOUT must be positive")
+	}
+	if c.WriteTimeout <= 0 {
+		problems = append(problems, "WRITE_TIMEOUT must be positive")
+	}
+	if c.IdleTimeout <= 0 {
+		problems = append(problems, "IDLE_TIMEOUT must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT must be positive")
+	}
+	switch c.DB.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, "DB_SSLMODE must be one of disable, allow, prefer, require, verify-ca or verify-full")
+	}
+	if c.StaticDir == "" {
+		problems = append(problems, "STATIC_DIR can't be empty")
+	}
+	if c.MaxUploadBytes <= 0 {
+		problems = append(problems, "MAX_UPLOAD_BYTES must be positive")
+	}
+	if c.MaxFormBytes <= 0 {
+		problems = append(problems, "MAX_FORM_BYTES must be positive")
+	}
+	if c.SessionMaxAge <= 0 {
+		problems = append(problems, "SESSION_MAX_AGE must be positive")
+	}
+	if c.SessionRememberMaxAge < c.SessionMaxAge {
+		problems = append(problems, "SESSION_REMEMBER_MAX_AGE can't be shorter than SESSION_MAX_AGE")
+	}
+	if c.SessionAbsoluteMaxAge < c.SessionRememberMaxAge {
+		problems = append(problems, "SESSION_ABSOLUTE_MAX_AGE can't be shorter than SESSION_REMEMBER_MAX_AGE")
+	}
+	if c.SessionRenewAfter <= 0 || c.SessionRenewAfter >= c.SessionMaxAge {
+		problems = append(problems, "SESSION_RENEW_AFTER must be positive and shorter than SESSION_MAX_AGE")
+	}
+	if c.Passwords.Hasher != "bcrypt" && c.Passwords.Hasher != "argon2id" {
+		problems = append(problems, "PASSWORD_HASHER must be bcrypt or argon2id")
+	}
+	if c.Passwords.BcryptCost < bcrypt.MinCost || c.Passwords.BcryptCost > bcrypt.MaxCost {
+		problems = append(problems, fmt.Sprintf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	if c.Passwords.Argon2Parallelism < 1 || c.Passwords.Argon2Parallelism > 255 {
+		problems = append(problems, "ARGON2_PARALLELISM must be between 1 and 255")
+	}
+	// argon2 needs at least 8 KiB per thread
+	if c.Passwords.Argon2Memory < 8*c.Passwords.Argon2Parallelism || c.Passwords.Argon2Memory > 4*1024*1024 {
+		problems = append(problems, "ARGON2_MEMORY must be between 8 KiB per thread and 4 GiB")
+	}
+	if c.Passwords.Argon2Iterations < 1 {
+		problems = append(problems, "ARGON2_ITERATIONS must be at least 1")
+	}
+	if c.Passwords.MinLength < 1 {
+		problems = append(problems, "PASSWORD_MIN_LENGTH must be at least 1")
+	}
+	if c.LoginFreeAttempts < 0 {
+		problems = append(problems, "LOGIN_FREE_ATTEMPTS can't be negative")
+	}
+	if c.LoginBackoffBase < 0 {
+		problems = append(problems, "LOGIN_BACKOFF_BASE can't be negative")
+	}
+	if c.LoginLockoutThreshold <= c.LoginFreeAttempts || c.LoginIPLockoutThreshold <= c.LoginFreeAttempts {
+		problems = append(problems, "LOGIN_LOCKOUT_THRESHOLD and LOGIN_IP_LOCKOUT_THRESHOLD must be greater than LOGIN_FREE_ATTEMPTS")
+	}
+	if c.LoginLockoutDuration <= 0 {
+		problems = append(problems, "LOGIN_LOCKOUT_DURATION must be positive")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, ok := parseNetwork(proxy); !ok {
+			problems = append(problems, fmt.Sprintf("TRUSTED_PROXIES: %q is not an address or CIDR range", proxy))
+		}
+	}
+	switch c.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.CookieSecure {
+			problems = append(problems, "COOKIE_SAMESITE none requires COOKIE_SECURE")
+		}
+	default:
+		problems = append(problems, "COOKIE_SAMESITE must be one of lax, strict or none")
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/") {
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: %q is not an origin like https://example.com", origin))
+		}
+	}
+	switch c.Mail.Driver {
+	case "smtp":
+		if c.Mail.SMTPHost == "" {
+			problems = append(problems, "SMTP_HOST is required with MAIL_DRIVER smtp")
+		}
+	case "file":
+		if c.Mail.Dir == "" {
+			problems = append(problems, "MAIL_DIR is required with MAIL_DRIVER file")
+		}
+	case "memory":
+	default:
+		problems = append(problems, "MAIL_DRIVER must be one of smtp, file or memory")
+	}
+	if c.Mail.From == "" {
+		problems = append(problems, "MAIL_FROM can't be empty")
+	}
+	if parsed, err := url.Parse(c.AppURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		problems = append(problems, "APP_URL must be an http or https url")
+	}
+	if c.PasswordResetTTL <= 0 {
+		problems = append(problems, "PASSWORD_RESET_TTL must be positive")
+	}
+	if c.EmailVerificationTTL <= 0 {
+		problems = append(problems, "EMAIL_VERIFICATION_TTL must be positive")
+	}
+	if c.MagicLinkTTL <= 0 {
+		problems = append(problems, "MAGIC_LINK_TTL must be positive")
+	}
+	if c.MagicLinkLimit < 1 {
+		problems = append(problems, "MAGIC_LINK_LIMIT must be at least 1")
+	}
+	if c.MagicLinkWindow <= 0 {
+		problems = append(problems, "MAGIC_LINK_WINDOW must be positive")
+	}
+	if c.TOTPIssuer == "" || strings.Contains(c.TOTPIssuer, ":") {
+		problems = append(problems, "TOTP_ISSUER must be set and can't contain a colon")
+	}
+	if c.OIDC.Enabled() {
+		if parsed, err := url.Parse(c.OIDC.Issuer); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, "OIDC_ISSUER must be an http or https url")
+		}
+		if c.OIDC.ClientID == "" {
+			problems = append(problems, "OIDC_CLIENT_ID is required with OIDC_ISSUER")
+		}
+		if parsed, err := url.Parse(c.OIDC.RedirectURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, "OIDC_REDIRECT_URL must be an http or https url")
+		}
+		hasOpenID := false
+		for _, scope := range c.OIDC.Scopes {
+			hasOpenID = hasOpenID || scope == "openid"
+		}
+		if !hasOpenID {
+			problems = append(problems, "OIDC_SCOPES must include openid")
+		}
+	}
+	if c.WebAuthn.RPName == "" {
+		problems = append(problems, "WEBAUTHN_RP_NAME can't be empty")
+	}
+	for _, origin := range c.WebAuthn.Origins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+			problems = append(problems, fmt.Sprintf("WEBAUTHN_ORIGINS: %q is not an origin like https://example.com", origin))
+			continue
+		}
+		if rpID := c.WebAuthnRPID(); parsed.Hostname() != rpID && !strings.HasSuffix(parsed.Hostname(), "."+rpID) {
+			problems = append(problems, fmt.Sprintf("WEBAUTHN_ORIGINS: %q is not on WEBAUTHN_RP_ID %q", origin, rpID))
+		}
+	}
+	if c.AccountDeletionPolicy != "anonymize" && c.AccountDeletionPolicy != "delete" {
+		problems = append(problems, "ACCOUNT_DELETION_POLICY must be anonymize or delete")
+	}
+	if c.SessionPurgeInterval < 0 {
+		problems = append(problems, "SESSION_PURGE_INTERVAL can't be negative")
+	}
+	if c.ImageCleanupInterval < 0 {
+		problems = append(problems, "IMAGE_CLEANUP_INTERVAL can't be negative")
+	}
+	if c.JobJitter < 0 {
+		problems = append(problems, "JOB_JITTER can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every setting's environment variable for the test, so
+// that the developer's own environment doesn't leak in
+func clearEnv(t *testing.T) {
+	t.Helper()
+	names := []string{"CONFIG_FILE"}
+	for _, s := range settings {
+		names = append(names, s.name)
+	}
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	clearEnv(t)
+	file := writeConfigFile(t, `{
+		"LISTEN_ADDR": ":9000",
+		"BCRYPT_COST": 10,
+		"DB_HOST": "file-host",
+		"COOKIE_SECURE": false,
+		"TRUSTED_PROXIES": ["10.0.0.0/8", "192.168.1.1"],
+		"LOGIN_BACKOFF_BASE": "2s"
+	}`)
+	t.Setenv("BCRYPT_COST", "11")
+	t.Setenv("DB_HOST", "env-host")
+	t.Setenv("DB_USER", "env-user")
+
+	var stderr bytes.Buffer
+	cfg, args, err := Load([]string{"-config", file, "-bcrypt-cost", "13", "-cors-allowed-origins", "https://a.example, https://b.example", "migrate", "up"}, &stderr)
+	if err != nil {
+		t.Fatalf("Load: %v\n%s", err, stderr.String())
+	}
+
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", cfg.ReadTimeout, time.Minute},
+		{"file", cfg.ListenAddr, ":9000"},
+		{"file bool", cfg.CookieSecure, false},
+		{"file list", cfg.TrustedProxies, []string{"10.0.0.0/8", "192.168.1.1"}},
+		{"file duration", cfg.LoginBackoffBase, 2 * time.Second},
+		{"env over file", cfg.DB.Host, "env-host"},
+		{"env over default", cfg.DB.User, "env-user"},
+		{"flag over env and file", cfg.Passwords.BcryptCost, 13},
+		{"flag list", cfg.CORSAllowedOrigins, []string{"https://a.example", "https://b.example"}},
+		{"arguments after the flags", args, []string{"migrate", "up"}},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, `{"LISTEN_ADDR": ":9000"}`))
+
+	cfg, _, err := Load(nil, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":9000" {
+		t.Errorf("ListenAddr %q, want the file's :9000", cfg.ListenAddr)
+	}
+
+	// -config wins over CONFIG_FILE
+	cfg, _, err = Load([]string{"-config", writeConfigFile(t, `{"LISTEN_ADDR": ":9001"}`)}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":9001" {
+		t.Errorf("ListenAddr %q, want the flag's file :9001", cfg.ListenAddr)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		file string
+		args []string
+		want string
+	}{
+		{name: "unknown flag", args: []string{"-no-such-flag"}, want: "no-such-flag"},
+		{name: "bad flag value", args: []string{"-bcrypt-cost", "twelve"}, want: "bcrypt-cost"},
+		{name: "bad env value", env: map[string]string{"READ_TIMEOUT": "soon"}, want: "READ_TIMEOUT"},
+		{name: "unknown file setting", file: `{"LISTEN": ":9000"}`, want: "unknown setting LISTEN"},
+		{name: "bad file value", file: `{"COOKIE_SECURE": "maybe"}`, want: "COOKIE_SECURE"},
+		{name: "object in the file", file: `{"DB_HOST": {"name": "db"}}`, want: "DB_HOST must be"},
+		{name: "not JSON", file: `LISTEN_ADDR=:9000`, want: "config.json"},
+		{name: "missing file", args: []string{"-config", "/no/such/config.json"}, want: "no such file"},
+		{name: "invalid result", env: map[string]string{"BCRYPT_COST": "99"}, want: "BCRYPT_COST must be between"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+			args := c.args
+			if c.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, c.file)}, args...)
+			}
+			var stderr bytes.Buffer
+			_, _, err := Load(args, &stderr)
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			if !strings.Contains(err.Error()+stderr.String(), c.want) {
+				t.Errorf("got %v, stderr %q, want it to mention %q", err, stderr.String(), c.want)
+			}
+		})
+	}
+}
+
+func TestLoadUsage(t *testing.T) {
+	clearEnv(t)
+	var stderr bytes.Buffer
+	if _, _, err := Load([]string{"-h"}, &stderr); err == nil {
+		t.Fatal("Load -h succeeded")
+	}
+	for _, want := range []string{"-listen", "env LISTEN_ADDR", "-trusted-proxies", "-config"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("usage doesn't mention %q", want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		change func(c *Config)
+		want   string
+	}{
+		{"empty listen address", func(c *Config) { c.ListenAddr = "" }, "LISTEN_ADDR"},
+		{"zero timeout", func(c *Config) { c.WriteTimeout = 0 }, "WRITE_TIMEOUT"},
+		{"sslmode", func(c *Config) { c.DB.SSLMode = "on" }, "DB_SSLMODE"},
+		{"remember shorter than a session", func(c *Config) { c.SessionRememberMaxAge = time.Minute }, "SESSION_REMEMBER_MAX_AGE"},
+		{"renewal longer than a session", func(c *Config) { c.SessionRenewAfter = 48 * time.Hour }, "SESSION_RENEW_AFTER"},
+		{"hasher", func(c *Config) { c.Passwords.Hasher = "md5" }, "PASSWORD_HASHER"},
+		{"bcrypt cost", func(c *Config) { c.Passwords.BcryptCost = 3 }, "BCRYPT_COST"},
+		{"argon2 memory", func(c *Config) { c.Passwords.Argon2Memory = 4 }, "ARGON2_MEMORY"},
+		{"lockout before the free attempts", func(c *Config) { c.LoginIPLockoutThreshold = c.LoginFreeAttempts }, "LOGIN_LOCKOUT_THRESHOLD"},
+		{"trusted proxy", func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/33"} }, "TRUSTED_PROXIES"},
+		{"trusted proxy hostname", func(c *Config) { c.TrustedProxies = []string{"proxy.internal"} }, "TRUSTED_PROXIES"},
+		{"samesite", func(c *Config) { c.CookieSameSite = "loose" }, "COOKIE_SAMESITE"},
+		{"samesite none without secure", func(c *Config) { c.CookieSameSite, c.CookieSecure = "none", false }, "COOKIE_SECURE"},
+		{"CORS origin with a path", func(c *Config) { c.CORSAllowedOrigins = []string{"https://example.com/app"} }, "CORS_ALLOWED_ORIGINS"},
+		{"CORS wildcard", func(c *Config) { c.CORSAllowedOrigins = []string{"*"} }, "CORS_ALLOWED_ORIGINS"},
+		{"smtp without a host", func(c *Config) { c.Mail.Driver = "smtp" }, "SMTP_HOST"},
+		{"mail driver", func(c *Config) { c.Mail.Driver = "pigeon" }, "MAIL_DRIVER"},
+		{"app url", func(c *Config) { c.AppURL = "localhost:3000" }, "APP_URL"},
+		{"magic link limit", func(c *Config) { c.MagicLinkLimit = 0 }, "MAGIC_LINK_LIMIT"},
+		{"totp issuer", func(c *Config) { c.TOTPIssuer = "My:tinerary" }, "TOTP_ISSUER"},
+		{"oidc without a client", func(c *Config) { c.OIDC.Issuer = "https://id.example.com" }, "OIDC_CLIENT_ID"},
+		{"passkey origin off the rp id", func(c *Config) { c.WebAuthn.Origins = []string{"https://evil.example"} }, "WEBAUTHN_ORIGINS"},
+		{"deletion policy", func(c *Config) { c.AccountDeletionPolicy = "keep" }, "ACCOUNT_DELETION_POLICY"},
+		{"negative jitter", func(c *Config) { c.JobJitter = -time.Second }, "JOB_JITTER"},
+	}
+	for _, c := range cases {
+		cfg := Default()
+		c.change(&cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want a problem with %s", c.name, err, c.want)
+		}
+	}
+
+	// every problem is reported at once
+	cfg := Default()
+	cfg.ListenAddr, cfg.Passwords.Hasher = "", "md5"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "LISTEN_ADDR") || !strings.Contains(err.Error(), "PASSWORD_HASHER") {
+		t.Errorf("two problems: got %v", err)
+	}
+}
+
+func TestSettingsHaveUniqueNames(t *testing.T) {
+	names, flags := map[string]bool{}, map[string]bool{}
+	for _, s := range settings {
+		if names[s.name] || flags[s.flag] {
+			t.Errorf("setting %s / -%s declared twice", s.name, s.flag)
+		}
+		names[s.name], flags[s.flag] = true, true
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	cases := []struct {
+		name    string
+		appURL  string
+		allowed []string
+		want    []string
+	}{
+		{"origin of the app url", "https://mytinerary.example/app/", nil, []string{"https://mytinerary.example"}},
+		{"port kept", "http://localhost:3000", nil, []string{"http://localhost:3000"}},
+		{"configured", "http://localhost:3000", []string{"https://a.example", "https://b.example"}, []string{"https://a.example", "https://b.example"}},
+		{"no app url", "", nil, nil},
+	}
+	for _, c := range cases {
+		cfg := Default()
+		cfg.AppURL, cfg.CORSAllowedOrigins = c.appURL, c.allowed
+		if got := cfg.CORSOrigins(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
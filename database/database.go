@@ -1,60 +1,177 @@
 package database
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
-	"log"
 	"net/http"
+	"quickstart/logging"
+	"strings"
 	"time"
 )
 
-var Db *sql.DB
-
-type session struct {
-	Id         string
-	User_id    int
-	Session_id string
-	Expiration time.Time
-}
-
 var ErrNoCookie = http.ErrNoCookie
 var ErrInternalError = errors.New("internal error")
 var ErrUnauthorized = errors.New("unauthorized")
 
-func IsUserLoggedIn(r *http.Request) (session session, err error) {
+// lastSeenResolution is how stale a session's LastSeenAt, or a token's
+// LastUsedAt, may get, so that not every request costs a write
+const lastSeenResolution = time.Minute
+
+// SessionPolicy is how long sessions last. A session expires MaxAge (or
+// RememberMaxAge) after it was last renewed, and never lives longer than
+// AbsoluteMaxAge whatever the activity.
+type SessionPolicy struct {
+	MaxAge         time.Duration
+	RememberMaxAge time.Duration
+	AbsoluteMaxAge time.Duration
+	// RenewAfter is how far the expiration must move before a renewal is
+	// written, so that not every request extends the session
+	RenewAfter time.Duration
+}
+
+// Expiration returns when the session expires if renewed at now
+func (p SessionPolicy) Expiration(session Session, now time.Time) time.Time {
+	window := p.MaxAge
+	if session.RememberMe {
+		window = p.RememberMaxAge
+	}
+	expiration := now.Add(window)
+	if limit := session.CreatedAt.Add(p.AbsoluteMaxAge); expiration.After(limit) {
+		expiration = limit
+	}
+	return expiration
+}
+
+// Login is what authenticated a request: either a session cookie, or an
+// API token sent as "Authorization: Bearer <token>"
+type Login struct {
+	UserId  int
+	Session Session
+	Token   APIToken
+	// Renewed reports that the session's expiration moved, i.e. the cookie
+	// has to be sent again
+	Renewed bool
+}
+
+func (l Login) ViaToken() bool {
+	return l.Token.Id != 0
+}
+
+// HashToken returns how an API token is stored. Tokens are long random
+// strings, a plain sha256 is enough to keep a database dump from being
+// usable.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsUserLoggedIn resolves the request's API token or, without an
+// Authorization header, its sid cookie. Sessions are renewed as they are
+// used.
+func IsUserLoggedIn(stores Stores, policy SessionPolicy, r *http.Request) (login Login, err error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		login.Token, err = tokenLogin(stores.APITokens, header, r)
+		login.UserId = login.Token.UserId
+		return
+	}
+
+	login.Session, login.Renewed, err = sessionLogin(stores.Sessions, policy, r)
+	login.UserId = login.Session.User_id
+	return
+}
+
+func tokenLogin(tokens APITokenStore, header string, r *http.Request) (token APIToken, err error) {
+	logger := logging.FromContext(r.Context())
+
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		logger.Info("unsupported authorization header")
+		err = ErrUnauthorized
+		return
+	}
+
+	token, err = tokens.GetByHash(r.Context(), HashToken(strings.TrimSpace(header[len(prefix):])))
+	if err != nil {
+		if err == ErrNotFound {
+			logger.Info("unknown api token")
+			err = ErrUnauthorized
+			return
+		}
+		logger.Error("loading api token", "error", err)
+		return
+	}
+
+	now := time.Now()
+	if token.ExpiresAt.Valid && token.ExpiresAt.Time.Before(now) {
+		logger.Info("api token expired", "token_id", token.Id)
+		err = ErrUnauthorized
+		return
+	}
+
+	if !token.LastUsedAt.Valid || now.Sub(token.LastUsedAt.Time) >= lastSeenResolution {
+		if err := tokens.Touch(r.Context(), token.Id, now); err != nil {
+			logger.Error("updating api token last used", "error", err)
+		} else {
+			token.LastUsedAt.Time, token.LastUsedAt.Valid = now, true
+		}
+	}
+	return
+}
+
+func sessionLogin(sessions SessionStore, policy SessionPolicy, r *http.Request) (session Session, renewed bool, err error) {
+	logger := logging.FromContext(r.Context())
+
 	cookie, err := r.Cookie("sid")
 	if err != nil {
 		if err == http.ErrNoCookie {
-			log.Printf("no cookie")
 			err = http.ErrNoCookie
 			return
 		}
-		log.Println(err)
+		logger.Error("reading session cookie", "error", err)
 		err = ErrInternalError
 		return
 	}
 
 	sessionId := cookie.Value
-	err = Db.QueryRow("SELECT * FROM sessions WHERE session_id = $1", sessionId).Scan(&session.Id, &session.User_id, &session.Session_id, &session.Expiration)
+	session, err = sessions.Get(r.Context(), sessionId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("no session in db")
+		if err == ErrNotFound {
+			logger.Info("no session in db")
 			err = ErrUnauthorized
 			return
 		}
-		log.Println(err)
+		logger.Error("loading session", "error", err)
 		return
 	}
 
-	if session.Expiration.Before(time.Now()) {
-		log.Printf("session expired, deleting session from db")
+	now := time.Now()
+	if session.Expiration.Before(now) || now.After(session.CreatedAt.Add(policy.AbsoluteMaxAge)) {
+		logger.Info("session expired, deleting session from db")
 		err = ErrUnauthorized
 		//delete the session if it exists in the db
-		_, dbErr := Db.Exec("DELETE FROM sessions WHERE session_id = $1", sessionId)
+		dbErr := sessions.Delete(r.Context(), sessionId)
 		if dbErr != nil {
-			log.Println(err)
+			logger.Error("deleting expired session", "error", dbErr)
 		}
 		return
 	}
+
+	expiration := session.Expiration
+	if renewal := policy.Expiration(session, now); renewal.Sub(expiration) >= policy.RenewAfter {
+		expiration = renewal
+	}
+	if expiration.Equal(session.Expiration) && now.Sub(session.LastSeenAt) < lastSeenResolution {
+		return
+	}
+
+	if err := sessions.Touch(r.Context(), sessionId, now, expiration); err != nil {
+		// the session is still valid as it is
+		logger.Error("renewing session", "error", err)
+		return session, false, nil
+	}
+	renewed = !expiration.Equal(session.Expiration)
+	session.LastSeenAt = now
+	session.Expiration = expiration
 	return
 }
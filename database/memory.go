@@ -0,0 +1,1177 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memory holds every table of the in-memory stores so that joins
+// (e.g. an itinerary's creator profile picture) can be resolved
+type memory struct {
+	mu          sync.Mutex
+	lastIds     map[string]int
+	cities      map[int]City
+	itineraries map[int]Itinerary
+	comments    map[int]Comment
+	users       map[int]User
+	sessions    map[string]Session
+	apiTokens   map[int]APIToken
+	throttles   map[string]LoginThrottle
+	lockouts    []LockoutEvent
+	tokens      map[int]OneTimeToken
+	// totp and recoveryCodes are keyed by user id
+	totp          map[int]TOTPSecret
+	recoveryCodes map[int][]memRecoveryCode
+	identities    map[int]ExternalIdentity
+	passkeys      map[int]Passkey
+	// challenges are keyed by hash
+	challenges map[string]PasskeyChallenge
+}
+
+// NewMemoryStores returns stores that keep everything in memory, meant
+// for tests and local development without a Postgres instance
+func NewMemoryStores() Stores {
+	m := &memory{
+		lastIds:       map[string]int{},
+		cities:        map[int]City{},
+		itineraries:   map[int]Itinerary{},
+		comments:      map[int]Comment{},
+		users:         map[int]User{},
+		sessions:      map[string]Session{},
+		apiTokens:     map[int]APIToken{},
+		throttles:     map[string]LoginThrottle{},
+		tokens:        map[int]OneTimeToken{},
+		totp:          map[int]TOTPSecret{},
+		recoveryCodes: map[int][]memRecoveryCode{},
+		identities:    map[int]ExternalIdentity{},
+		passkeys:      map[int]Passkey{},
+		challenges:    map[string]PasskeyChallenge{},
+	}
+	return Stores{
+		Cities:      &memCities{m},
+		Itineraries: &memItineraries{m},
+		Comments:    &memComments{m},
+		Users:       &memUsers{m},
+		Sessions:    &memSessions{m},
+		APITokens:   &memAPITokens{m},
+		Throttles:   &memThrottles{m},
+		Tokens:      &memTokens{m},
+		TwoFactor:   &memTwoFactor{m},
+		Identities:  &memIdentities{m},
+		Passkeys:    &memPasskeys{m},
+	}
+}
+
+// nextId mimics a SERIAL column, must be called with mu held
+func (m *memory) nextId(table string) int {
+	m.lastIds[table]++
+	return m.lastIds[table]
+}
+
+// must be called with mu held
+func (m *memory) author(userId int) Author {
+	return Author{Id: userId, ProfilePic: m.users[userId].ProfilePic}
+}
+
+func sortedKeys(ids map[int]bool) []int {
+	keys := make([]int, 0, len(ids))
+	for id := range ids {
+		keys = append(keys, id)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Cities
+
+type memCities struct {
+	*memory
+}
+
+func (s *memCities) List(ctx context.Context) ([]City, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := map[int]bool{}
+	for id := range s.cities {
+		ids[id] = true
+	}
+	var cities []City
+	for _, id := range sortedKeys(ids) {
+		cities = append(cities, s.cities[id])
+	}
+	return cities, nil
+}
+
+func (s *memCities) Get(ctx context.Context, id int) (City, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	city, ok := s.cities[id]
+	if !ok {
+		return City{}, ErrNotFound
+	}
+	return city, nil
+}
+
+func (s *memCities) Create(ctx context.Context, city City) (City, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	city.Id = s.nextId("city")
+	s.cities[city.Id] = city
+	return city, nil
+}
+
+func (s *memCities) Update(ctx context.Context, city City) (City, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.cities[city.Id]; !ok {
+		return City{}, ErrNotFound
+	}
+	s.cities[city.Id] = city
+	return city, nil
+}
+
+func (s *memCities) Delete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.cities, id)
+	for itineraryId, itinerary := range s.itineraries {
+		if itinerary.CityId == id {
+			s.deleteItinerary(itineraryId)
+		}
+	}
+	return nil
+}
+
+// Itineraries
+
+type memItineraries struct {
+	*memory
+}
+
+func (s *memItineraries) ListByCity(ctx context.Context, cityId int) ([]Itinerary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := map[int]bool{}
+	for id, itinerary := range s.itineraries {
+		if itinerary.CityId == cityId {
+			ids[id] = true
+		}
+	}
+	var itineraries []Itinerary
+	for _, id := range sortedKeys(ids) {
+		itinerary := s.itineraries[id]
+		itinerary.Creator = s.author(itinerary.Creator.Id)
+		itineraries = append(itineraries, itinerary)
+	}
+	return itineraries, nil
+}
+
+func (s *memItineraries) ListByCreator(ctx context.Context, userId int) ([]Itinerary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := map[int]bool{}
+	for id, itinerary := range s.itineraries {
+		if itinerary.Creator.Id == userId {
+			ids[id] = true
+		}
+	}
+	var itineraries []Itinerary
+	for _, id := range sortedKeys(ids) {
+		itinerary := s.itineraries[id]
+		itinerary.Creator = s.author(itinerary.Creator.Id)
+		itineraries = append(itineraries, itinerary)
+	}
+	return itineraries, nil
+}
+
+func (s *memItineraries) Get(ctx context.Context, id int) (Itinerary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	itinerary, ok := s.itineraries[id]
+	if !ok {
+		return Itinerary{}, ErrNotFound
+	}
+	itinerary.Creator = s.author(itinerary.Creator.Id)
+	return itinerary, nil
+}
+
+func (s *memItineraries) Create(ctx context.Context, itinerary Itinerary) (Itinerary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	itinerary.Id = s.nextId("itinerary")
+	s.itineraries[itinerary.Id] = itinerary
+	return itinerary, nil
+}
+
+func (s *memItineraries) Update(ctx context.Context, itinerary Itinerary) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.itineraries[itinerary.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Title = itinerary.Title
+	stored.Duration = itinerary.Duration
+	stored.Price = itinerary.Price
+	stored.Activities = itinerary.Activities
+	stored.Hashtags = itinerary.Hashtags
+	s.itineraries[itinerary.Id] = stored
+	return nil
+}
+
+func (s *memItineraries) Delete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteItinerary(id)
+	return nil
+}
+
+// must be called with mu held
+func (m *memory) deleteItinerary(id int) {
+	delete(m.itineraries, id)
+	for commentId, comment := range m.comments {
+		if comment.ItineraryId == id {
+			delete(m.comments, commentId)
+		}
+	}
+}
+
+// Comments
+
+type memComments struct {
+	*memory
+}
+
+func (s *memComments) ListByItineraries(ctx context.Context, itineraryIds []int) ([]Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := map[int]bool{}
+	for _, id := range itineraryIds {
+		wanted[id] = true
+	}
+	ids := map[int]bool{}
+	for id, comment := range s.comments {
+		if wanted[comment.ItineraryId] {
+			ids[id] = true
+		}
+	}
+	var comments []Comment
+	for _, id := range sortedKeys(ids) {
+		comment := s.comments[id]
+		comment.Author = s.author(comment.Author.Id)
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+func (s *memComments) Create(ctx context.Context, itineraryId int, authorId int, content string) (Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comment := Comment{
+		Id:          s.nextId("itinerary_comment"),
+		ItineraryId: itineraryId,
+		Content:     content,
+		Author:      Author{Id: authorId},
+	}
+	s.comments[comment.Id] = comment
+	comment.Author = s.author(authorId)
+	return comment, nil
+}
+
+// Users
+
+type memUsers struct {
+	*memory
+}
+
+func (s *memUsers) Get(ctx context.Context, id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memUsers) GetByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Email.Valid && user.Email.String == email {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memUsers) Create(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return User{}, ErrConflict
+		}
+		if user.Email.Valid && existing.Email == user.Email {
+			return User{}, ErrEmailTaken
+		}
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	user.Id = s.nextId("users")
+	s.users[user.Id] = user
+	return user, nil
+}
+
+func (s *memUsers) SetRole(ctx context.Context, id int, role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Role = role
+	s.users[id] = user
+	return nil
+}
+
+func (s *memUsers) SetPassword(ctx context.Context, id int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = passwordHash
+	s.users[id] = user
+	return nil
+}
+
+func (s *memUsers) SetEmail(ctx context.Context, id int, email sql.NullString) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.users {
+		if email.Valid && existing.Id != id && existing.Email == email {
+			return ErrEmailTaken
+		}
+	}
+	user.Email = email
+	user.EmailVerifiedAt = sql.NullTime{}
+	s.users[id] = user
+	return nil
+}
+
+func (s *memUsers) VerifyEmail(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || !user.Email.Valid {
+		return ErrNotFound
+	}
+	user.EmailVerifiedAt = sql.NullTime{Time: at, Valid: true}
+	s.users[id] = user
+	return nil
+}
+
+func (s *memUsers) UpdateProfile(ctx context.Context, id int, username string, profilePic sql.NullString) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.users {
+		if existing.Id != id && existing.Username == username {
+			return ErrConflict
+		}
+	}
+	user.Username = username
+	user.ProfilePic = profilePic
+	s.users[id] = user
+	return nil
+}
+
+func (s *memUsers) Delete(ctx context.Context, id int, policy DeletionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return ErrNotFound
+	}
+	for itineraryId, itinerary := range s.itineraries {
+		if itinerary.Creator.Id != id {
+			continue
+		}
+		if policy == DeleteContent {
+			s.deleteItinerary(itineraryId)
+		} else {
+			itinerary.Creator = Author{}
+			s.itineraries[itineraryId] = itinerary
+		}
+	}
+	for commentId, comment := range s.comments {
+		if comment.Author.Id != id {
+			continue
+		}
+		if policy == DeleteContent {
+			delete(s.comments, commentId)
+		} else {
+			comment.Author = Author{}
+			s.comments[commentId] = comment
+		}
+	}
+
+	// what Postgres removes with ON DELETE CASCADE
+	for sessionId, session := range s.sessions {
+		if session.User_id == id {
+			delete(s.sessions, sessionId)
+		}
+	}
+	for tokenId, token := range s.apiTokens {
+		if token.UserId == id {
+			delete(s.apiTokens, tokenId)
+		}
+	}
+	for tokenId, token := range s.tokens {
+		if token.UserId == id {
+			delete(s.tokens, tokenId)
+		}
+	}
+	for identityId, identity := range s.identities {
+		if identity.UserId == id {
+			delete(s.identities, identityId)
+		}
+	}
+	for passkeyId, passkey := range s.passkeys {
+		if passkey.UserId == id {
+			delete(s.passkeys, passkeyId)
+		}
+	}
+	for hash, challenge := range s.challenges {
+		if challenge.UserId == id {
+			delete(s.challenges, hash)
+		}
+	}
+	delete(s.totp, id)
+	delete(s.recoveryCodes, id)
+	delete(s.users, id)
+	return nil
+}
+
+func (s *memUsers) ListProfilePics(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pics []string
+	for _, user := range s.users {
+		if user.ProfilePic.Valid {
+			pics = append(pics, user.ProfilePic.String)
+		}
+	}
+	return pics, nil
+}
+
+// Sessions
+
+type memSessions struct {
+	*memory
+}
+
+func (s *memSessions) Get(ctx context.Context, sessionId string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *memSessions) Create(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+	}
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	session.Id = s.nextId("sessions")
+	s.sessions[session.Session_id] = session
+	return nil
+}
+
+func (s *memSessions) Delete(ctx context.Context, sessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sessionId)
+	return nil
+}
+
+func (s *memSessions) ListByUser(ctx context.Context, userId int) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.User_id == userId && !session.Expiration.Before(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (s *memSessions) Touch(ctx context.Context, sessionId string, lastSeen time.Time, expiration time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[sessionId]; ok {
+		session.LastSeenAt = lastSeen
+		session.Expiration = expiration
+		s.sessions[sessionId] = session
+	}
+	return nil
+}
+
+func (s *memSessions) SetCsrfToken(ctx context.Context, sessionId string, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[sessionId]; ok {
+		session.CsrfToken = token
+		s.sessions[sessionId] = session
+	}
+	return nil
+}
+
+func (s *memSessions) DeleteForUser(ctx context.Context, userId int, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionId, session := range s.sessions {
+		if session.Id == id && session.User_id == userId {
+			delete(s.sessions, sessionId)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memSessions) DeleteAllForUser(ctx context.Context, userId int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for sessionId, session := range s.sessions {
+		if session.User_id == userId {
+			delete(s.sessions, sessionId)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memSessions) DeleteOthersForUser(ctx context.Context, userId int, keepSessionId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for sessionId, session := range s.sessions {
+		if session.User_id == userId && sessionId != keepSessionId {
+			delete(s.sessions, sessionId)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memSessions) DeleteExpired(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for sessionId, session := range s.sessions {
+		if session.Expiration.Before(now) {
+			delete(s.sessions, sessionId)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// API tokens
+
+type memAPITokens struct {
+	*memory
+}
+
+func (s *memAPITokens) Create(ctx context.Context, token APIToken) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.apiTokens {
+		if existing.TokenHash == token.TokenHash {
+			return APIToken{}, ErrConflict
+		}
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	token.Id = s.nextId("api_tokens")
+	s.apiTokens[token.Id] = token
+	return token, nil
+}
+
+func (s *memAPITokens) GetByHash(ctx context.Context, tokenHash string) (APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.apiTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return APIToken{}, ErrNotFound
+}
+
+func (s *memAPITokens) ListByUser(ctx context.Context, userId int) ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tokens []APIToken
+	for _, token := range s.apiTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (s *memAPITokens) Touch(ctx context.Context, id int, lastUsed time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token, ok := s.apiTokens[id]; ok {
+		token.LastUsedAt = sql.NullTime{Time: lastUsed, Valid: true}
+		s.apiTokens[id] = token
+	}
+	return nil
+}
+
+func (s *memAPITokens) DeleteForUser(ctx context.Context, userId int, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.apiTokens[id]
+	if !ok || token.UserId != userId {
+		return ErrNotFound
+	}
+	delete(s.apiTokens, id)
+	return nil
+}
+
+func (s *memAPITokens) DeleteAllForUser(ctx context.Context, userId int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, token := range s.apiTokens {
+		if token.UserId == userId {
+			delete(s.apiTokens, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Login throttles
+
+type memThrottles struct {
+	*memory
+}
+
+func (s *memThrottles) Get(ctx context.Context, key string) (LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok {
+		return LoginThrottle{}, ErrNotFound
+	}
+	return throttle, nil
+}
+
+func (s *memThrottles) RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok || throttle.LastFailureAt.Before(resetBefore) {
+		throttle.Key = key
+		throttle.Failures = 0
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = at
+	s.throttles[key] = throttle
+	return throttle, nil
+}
+
+func (s *memThrottles) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if throttle, ok := s.throttles[key]; ok {
+		throttle.LockedUntil = sql.NullTime{Time: until, Valid: true}
+		s.throttles[key] = throttle
+	}
+	return nil
+}
+
+func (s *memThrottles) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.throttles, key)
+	return nil
+}
+
+func (s *memThrottles) DeleteStale(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for key, throttle := range s.throttles {
+		if throttle.LastFailureAt.Before(before) && (!throttle.LockedUntil.Valid || throttle.LockedUntil.Time.Before(now)) {
+			delete(s.throttles, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memThrottles) RecordLockout(ctx context.Context, event LockoutEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.Id = s.nextId("lockout_events")
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	s.lockouts = append(s.lockouts, event)
+	return nil
+}
+
+func (s *memThrottles) ListLockouts(ctx context.Context, limit int) ([]LockoutEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []LockoutEvent
+	for i := len(s.lockouts) - 1; i >= 0 && len(events) < limit; i-- {
+		events = append(events, s.lockouts[i])
+	}
+	return events, nil
+}
+
+// One time tokens
+
+type memTokens struct {
+	*memory
+}
+
+func (s *memTokens) Create(ctx context.Context, token OneTimeToken) (OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, existing := range s.tokens {
+		if existing.UserId == token.UserId && existing.Purpose == token.Purpose && !existing.UsedAt.Valid {
+			delete(s.tokens, id)
+		}
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	token.Id = s.nextId("user_tokens")
+	s.tokens[token.Id] = token
+	return token, nil
+}
+
+func (s *memTokens) Consume(ctx context.Context, purpose string, tokenHash string, now time.Time) (OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.Purpose == purpose && token.TokenHash == tokenHash && !token.UsedAt.Valid && token.ExpiresAt.After(now) {
+			token.UsedAt = sql.NullTime{Time: now, Valid: true}
+			s.tokens[id] = token
+			return token, nil
+		}
+	}
+	return OneTimeToken{}, ErrNotFound
+}
+
+func (s *memTokens) DeleteUnused(ctx context.Context, userId int, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.UserId == userId && token.Purpose == purpose && !token.UsedAt.Valid {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (s *memTokens) Get(ctx context.Context, purpose string, tokenHash string, now time.Time) (OneTimeToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.Purpose == purpose && token.TokenHash == tokenHash && !token.UsedAt.Valid && token.ExpiresAt.After(now) {
+			return token, nil
+		}
+	}
+	return OneTimeToken{}, ErrNotFound
+}
+
+// Two factor authentication
+
+type memTwoFactor struct {
+	*memory
+}
+
+type memRecoveryCode struct {
+	hash string
+	used bool
+}
+
+func (s *memTwoFactor) Get(ctx context.Context, userId int) (TOTPSecret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.totp[userId]
+	if !ok {
+		return TOTPSecret{}, ErrNotFound
+	}
+	return secret, nil
+}
+
+func (s *memTwoFactor) Enroll(ctx context.Context, userId int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.totp[userId]; ok && existing.Enabled() {
+		return ErrConflict
+	}
+	s.totp[userId] = TOTPSecret{UserId: userId, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (s *memTwoFactor) Confirm(ctx context.Context, userId int, step int64, at time.Time, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.totp[userId]
+	if !ok || secret.Enabled() {
+		return ErrNotFound
+	}
+	secret.ConfirmedAt = sql.NullTime{Time: at, Valid: true}
+	secret.LastUsedStep = step
+	s.totp[userId] = secret
+	s.replaceRecoveryCodes(userId, recoveryCodeHashes)
+	return nil
+}
+
+func (s *memTwoFactor) UseStep(ctx context.Context, userId int, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.totp[userId]
+	if !ok || secret.LastUsedStep >= step {
+		return ErrNotFound
+	}
+	secret.LastUsedStep = step
+	s.totp[userId] = secret
+	return nil
+}
+
+func (s *memTwoFactor) Delete(ctx context.Context, userId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.totp, userId)
+	delete(s.recoveryCodes, userId)
+	return nil
+}
+
+func (s *memTwoFactor) ReplaceRecoveryCodes(ctx context.Context, userId int, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replaceRecoveryCodes(userId, hashes)
+	return nil
+}
+
+// replaceRecoveryCodes must be called with mu held
+func (m *memory) replaceRecoveryCodes(userId int, hashes []string) {
+	codes := make([]memRecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, memRecoveryCode{hash: hash})
+	}
+	m.recoveryCodes[userId] = codes
+}
+
+func (s *memTwoFactor) UseRecoveryCode(ctx context.Context, userId int, hash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, code := range s.recoveryCodes[userId] {
+		if code.hash == hash && !code.used {
+			s.recoveryCodes[userId][i].used = true
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memTwoFactor) CountRecoveryCodes(ctx context.Context, userId int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, code := range s.recoveryCodes[userId] {
+		if !code.used {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// External identities
+
+type memIdentities struct {
+	*memory
+}
+
+func (s *memIdentities) Get(ctx context.Context, issuer string, subject string) (ExternalIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, identity := range s.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return ExternalIdentity{}, ErrNotFound
+}
+
+func (s *memIdentities) Create(ctx context.Context, identity ExternalIdentity) (ExternalIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.identities {
+		if existing.Issuer == identity.Issuer && existing.Subject == identity.Subject {
+			return ExternalIdentity{}, ErrConflict
+		}
+	}
+	if identity.CreatedAt.IsZero() {
+		identity.CreatedAt = time.Now()
+	}
+	identity.Id = s.nextId("external_identities")
+	s.identities[identity.Id] = identity
+	return identity, nil
+}
+
+func (s *memIdentities) ListByUser(ctx context.Context, userId int) ([]ExternalIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var identities []ExternalIdentity
+	for _, identity := range s.identities {
+		if identity.UserId == userId {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Id < identities[j].Id
+	})
+	return identities, nil
+}
+
+func (s *memIdentities) DeleteForUser(ctx context.Context, userId int, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identity, ok := s.identities[id]
+	if !ok || identity.UserId != userId {
+		return ErrNotFound
+	}
+	delete(s.identities, id)
+	return nil
+}
+
+// Passkeys
+
+type memPasskeys struct {
+	*memory
+}
+
+func (s *memPasskeys) CreateChallenge(ctx context.Context, challenge PasskeyChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.challenges[challenge.Hash]; ok {
+		return ErrConflict
+	}
+	s.challenges[challenge.Hash] = challenge
+	return nil
+}
+
+func (s *memPasskeys) ConsumeChallenge(ctx context.Context, purpose string, hash string, now time.Time) (PasskeyChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge, ok := s.challenges[hash]
+	if !ok || challenge.Purpose != purpose || !challenge.ExpiresAt.After(now) {
+		return PasskeyChallenge{}, ErrNotFound
+	}
+	delete(s.challenges, hash)
+	return challenge, nil
+}
+
+func (s *memPasskeys) DeleteExpiredChallenges(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for hash, challenge := range s.challenges {
+		if !challenge.ExpiresAt.After(now) {
+			delete(s.challenges, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memPasskeys) Create(ctx context.Context, passkey Passkey) (Passkey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.passkeys {
+		if bytes.Equal(existing.CredentialId, passkey.CredentialId) {
+			return Passkey{}, ErrConflict
+		}
+	}
+	if passkey.CreatedAt.IsZero() {
+		passkey.CreatedAt = time.Now()
+	}
+	passkey.Id = s.nextId("passkeys")
+	s.passkeys[passkey.Id] = passkey
+	return passkey, nil
+}
+
+func (s *memPasskeys) GetByCredentialId(ctx context.Context, credentialId []byte) (Passkey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, passkey := range s.passkeys {
+		if bytes.Equal(passkey.CredentialId, credentialId) {
+			return passkey, nil
+		}
+	}
+	return Passkey{}, ErrNotFound
+}
+
+func (s *memPasskeys) ListByUser(ctx context.Context, userId int) ([]Passkey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var passkeys []Passkey
+	for _, passkey := range s.passkeys {
+		if passkey.UserId == userId {
+			passkeys = append(passkeys, passkey)
+		}
+	}
+	sort.Slice(passkeys, func(i, j int) bool {
+		return passkeys[i].Id < passkeys[j].Id
+	})
+	return passkeys, nil
+}
+
+func (s *memPasskeys) Use(ctx context.Context, id int, signCount int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if passkey, ok := s.passkeys[id]; ok {
+		passkey.SignCount = signCount
+		passkey.LastUsedAt = sql.NullTime{Time: at, Valid: true}
+		s.passkeys[id] = passkey
+	}
+	return nil
+}
+
+func (s *memPasskeys) DeleteForUser(ctx context.Context, userId int, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	passkey, ok := s.passkeys[id]
+	if !ok || passkey.UserId != userId {
+		return ErrNotFound
+	}
+	delete(s.passkeys, id)
+	return nil
+}
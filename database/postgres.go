@@ -0,0 +1,1127 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// NewPostgresStores returns stores backed by the given Postgres connection
+func NewPostgresStores(db *sql.DB) Stores {
+	return Stores{
+		Cities:      &pgCities{db},
+		Itineraries: &pgItineraries{db},
+		Comments:    &pgComments{db},
+		Users:       &pgUsers{db},
+		Sessions:    &pgSessions{db},
+		APITokens:   &pgAPITokens{db},
+		Throttles:   &pgThrottles{db},
+		Tokens:      &pgTokens{db},
+		TwoFactor:   &pgTwoFactor{db},
+		Identities:  &pgIdentities{db},
+		Passkeys:    &pgPasskeys{db},
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// Cities
+
+type pgCities struct {
+	db *sql.DB
+}
+
+func (s *pgCities) List(ctx context.Context) ([]City, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, country FROM city")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cities []City
+	for rows.Next() {
+		var city City
+		if err := rows.Scan(&city.Id, &city.Name, &city.Country); err != nil {
+			return nil, err
+		}
+		cities = append(cities, city)
+	}
+	return cities, rows.Err()
+}
+
+func (s *pgCities) Get(ctx context.Context, id int) (city City, err error) {
+	err = s.db.QueryRowContext(ctx, "SELECT id, name, country FROM city WHERE id = $1", id).Scan(&city.Id, &city.Name, &city.Country)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgCities) Create(ctx context.Context, city City) (City, error) {
+	err := s.db.QueryRowContext(ctx, "INSERT INTO city (name, country) VALUES ($1, $2) RETURNING id, name, country", city.Name, city.Country).Scan(&city.Id, &city.Name, &city.Country)
+	return city, err
+}
+
+func (s *pgCities) Update(ctx context.Context, city City) (City, error) {
+	err := s.db.QueryRowContext(ctx, `
+	UPDATE city
+	SET name = $1, country = $2
+	WHERE id = $3
+	RETURNING id, name, country
+	`, city.Name, city.Country, city.Id).Scan(&city.Id, &city.Name, &city.Country)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return city, err
+}
+
+func (s *pgCities) Delete(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the itineraries go with ON DELETE CASCADE, but ITINERARY_COMMENTS has
+	// none so their comments are deleted first
+	_, err = tx.ExecContext(ctx, `
+	WITH links AS (
+		DELETE FROM itinerary_comments
+		WHERE itinerary_id IN (SELECT id FROM itinerary WHERE city_id = $1)
+		RETURNING comment_id
+	)
+	DELETE FROM itinerary_comment
+	WHERE id IN (SELECT comment_id FROM links)`, id)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM city WHERE id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Itineraries
+
+type pgItineraries struct {
+	db *sql.DB
+}
+
+const selectItinerary = `
+	SELECT id,
+		title,
+		duration,
+		price_amount,
+		price_currency,
+		activities,
+		hashtags,
+		user_id,
+		profile_pic,
+		city_id
+	FROM itinerary
+		LEFT JOIN (
+			SELECT id as user_id,
+				profile_pic
+			FROM users
+		) AS users ON itinerary.creator = users.user_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanItinerary(row scanner) (itinerary Itinerary, err error) {
+	var activities, hashtags pq.StringArray
+	// NULL once the creator deleted their account
+	var creatorId sql.NullInt64
+	err = row.Scan(&itinerary.Id, &itinerary.Title,
+		&itinerary.Duration, &itinerary.Price.Amount, &itinerary.Price.Currency,
+		&activities, &hashtags,
+		&creatorId, &itinerary.Creator.ProfilePic, &itinerary.CityId)
+	itinerary.Activities = activities
+	itinerary.Hashtags = hashtags
+	itinerary.Creator.Id = int(creatorId.Int64)
+	return
+}
+
+func (s *pgItineraries) ListByCity(ctx context.Context, cityId int) ([]Itinerary, error) {
+	rows, err := s.db.QueryContext(ctx, selectItinerary+`
+	WHERE itinerary.city_id = $1`, cityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var itineraries []Itinerary
+	for rows.Next() {
+		itinerary, err := scanItinerary(rows)
+		if err != nil {
+			return nil, err
+		}
+		itineraries = append(itineraries, itinerary)
+	}
+	return itineraries, rows.Err()
+}
+
+func (s *pgItineraries) ListByCreator(ctx context.Context, userId int) ([]Itinerary, error) {
+	rows, err := s.db.QueryContext(ctx, selectItinerary+`
+	WHERE itinerary.creator = $1
+	ORDER BY itinerary.id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var itineraries []Itinerary
+	for rows.Next() {
+		itinerary, err := scanItinerary(rows)
+		if err != nil {
+			return nil, err
+		}
+		itineraries = append(itineraries, itinerary)
+	}
+	return itineraries, rows.Err()
+}
+
+func (s *pgItineraries) Get(ctx context.Context, id int) (Itinerary, error) {
+	itinerary, err := scanItinerary(s.db.QueryRowContext(ctx, selectItinerary+`
+	WHERE itinerary.id = $1`, id))
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return itinerary, err
+}
+
+func (s *pgItineraries) Create(ctx context.Context, itinerary Itinerary) (Itinerary, error) {
+	err := s.db.QueryRowContext(ctx, `
+	INSERT INTO itinerary (title, duration, price_amount, price_currency, activities, hashtags, creator, city_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id
+	`, itinerary.Title, itinerary.Duration, itinerary.Price.Amount, itinerary.Price.Currency,
+		pq.Array(itinerary.Activities), pq.Array(itinerary.Hashtags),
+		itinerary.Creator.Id, itinerary.CityId).Scan(&itinerary.Id)
+	return itinerary, err
+}
+
+func (s *pgItineraries) Update(ctx context.Context, itinerary Itinerary) error {
+	result, err := s.db.ExecContext(ctx, `
+	UPDATE itinerary
+	SET title = $1,
+		duration = $2,
+		price_amount = $3,
+		price_currency = $4,
+		activities = $5,
+		hashtags = $6
+	WHERE id = $7
+	`,
+		itinerary.Title,
+		itinerary.Duration,
+		itinerary.Price.Amount,
+		itinerary.Price.Currency,
+		pq.Array(itinerary.Activities),
+		pq.Array(itinerary.Hashtags),
+		itinerary.Id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgItineraries) Delete(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// ITINERARY_COMMENTS has no ON DELETE CASCADE
+	_, err = tx.ExecContext(ctx, `
+	WITH links AS (
+		DELETE FROM itinerary_comments
+		WHERE itinerary_id = $1
+		RETURNING comment_id
+	)
+	DELETE FROM itinerary_comment
+	WHERE id IN (SELECT comment_id FROM links)`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	DELETE FROM itinerary
+	WHERE id = $1
+	`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Comments
+
+type pgComments struct {
+	db *sql.DB
+}
+
+func (s *pgComments) ListByItineraries(ctx context.Context, itineraryIds []int) ([]Comment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id,
+		comment,
+		itinerary_id,
+		user_id,
+		profile_pic
+	FROM itinerary_comments
+		INNER JOIN (
+			SELECT id as ic_id,
+				author_id,
+				comment
+			FROM itinerary_comment
+		) AS ic ON ic.ic_id = itinerary_comments.comment_id
+		LEFT JOIN (
+			SELECT id as user_id,
+				profile_pic
+			FROM users
+		) AS users ON users.user_id = ic.author_id
+	WHERE itinerary_comments.itinerary_id = ANY($1::int[])
+	`, pq.Array(itineraryIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		var authorId sql.NullInt64
+		err := rows.Scan(&comment.Id, &comment.Content, &comment.ItineraryId,
+			&authorId, &comment.Author.ProfilePic)
+		if err != nil {
+			return nil, err
+		}
+		comment.Author.Id = int(authorId.Int64)
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+func (s *pgComments) Create(ctx context.Context, itineraryId int, authorId int, content string) (comment Comment, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	err = tx.QueryRowContext(ctx, `
+	INSERT INTO itinerary_comment (author_id, comment)
+	VALUES ($1, $2)
+	RETURNING id
+	`, authorId, content).Scan(&comment.Id)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO itinerary_comments (itinerary_id, comment_id)
+	VALUES ($1, $2)
+	`, itineraryId, comment.Id)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	comment.ItineraryId = itineraryId
+	err = s.db.QueryRowContext(ctx, `
+	SELECT comment,
+		user_id,
+		profile_pic
+	FROM itinerary_comment
+		INNER JOIN (
+			SELECT id AS user_id,
+				profile_pic
+			FROM users
+		) AS users ON users.user_id = itinerary_comment.author_id
+	WHERE itinerary_comment.id = $1
+	`, comment.Id).Scan(&comment.Content, &comment.Author.Id, &comment.Author.ProfilePic)
+	return
+}
+
+// Users
+
+type pgUsers struct {
+	db *sql.DB
+}
+
+const selectUser = "SELECT id, username, password, profile_pic, role, email, email_verified_at FROM users"
+
+func scanUser(row scanner) (user User, err error) {
+	err = row.Scan(&user.Id, &user.Username, &user.Password, &user.ProfilePic, &user.Role, &user.Email, &user.EmailVerifiedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgUsers) Get(ctx context.Context, id int) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, selectUser+" WHERE id = $1", id))
+}
+
+func (s *pgUsers) GetByUsername(ctx context.Context, username string) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, selectUser+" WHERE username = $1", username))
+}
+
+func (s *pgUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, selectUser+" WHERE email = $1", email))
+}
+
+func (s *pgUsers) Create(ctx context.Context, user User) (User, error) {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	err := s.db.QueryRowContext(ctx, "INSERT INTO users (username, password, profile_pic, role, email) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		user.Username, user.Password, user.ProfilePic, user.Role, user.Email).Scan(&user.Id)
+	if isUniqueViolation(err) {
+		if err.(*pq.Error).Constraint == "users_email_key" {
+			return user, ErrEmailTaken
+		}
+		err = ErrConflict
+	}
+	return user, err
+}
+
+func (s *pgUsers) SetRole(ctx context.Context, id int, role Role) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET role = $1 WHERE id = $2", role, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgUsers) ListProfilePics(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT profile_pic FROM users WHERE profile_pic IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pics []string
+	for rows.Next() {
+		var pic string
+		if err := rows.Scan(&pic); err != nil {
+			return nil, err
+		}
+		pics = append(pics, pic)
+	}
+	return pics, rows.Err()
+}
+
+func (s *pgUsers) SetPassword(ctx context.Context, id int, passwordHash string) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2", passwordHash, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgUsers) SetEmail(ctx context.Context, id int, email sql.NullString) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET email = $1, email_verified_at = NULL WHERE id = $2", email, id)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgUsers) UpdateProfile(ctx context.Context, id int, username string, profilePic sql.NullString) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET username = $1, profile_pic = $2 WHERE id = $3", username, profilePic, id)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgUsers) Delete(ctx context.Context, id int, policy DeletionPolicy) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if policy == DeleteContent {
+		// the user's comments and every comment on their itineraries, then
+		// the itineraries
+		_, err = tx.ExecContext(ctx, `
+		WITH links AS (
+			DELETE FROM itinerary_comments
+			WHERE itinerary_id IN (SELECT id FROM itinerary WHERE creator = $1)
+				OR comment_id IN (SELECT id FROM itinerary_comment WHERE author_id = $1)
+			RETURNING comment_id
+		)
+		DELETE FROM itinerary_comment
+		WHERE id IN (SELECT comment_id FROM links) OR author_id = $1`, id)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM itinerary WHERE creator = $1", id); err != nil {
+			return err
+		}
+	}
+
+	// everything else of the user goes with ON DELETE CASCADE, and kept
+	// content loses its author with ON DELETE SET NULL
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *pgUsers) VerifyEmail(ctx context.Context, id int, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE users SET email_verified_at = $1 WHERE id = $2 AND email IS NOT NULL", at, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Sessions
+
+type pgSessions struct {
+	db *sql.DB
+}
+
+const selectSession = `
+	SELECT id, user_id, session_id, expiration, created_at, last_seen_at, user_agent, ip_address, remember_me, csrf_token
+	FROM sessions`
+
+func scanSession(row scanner) (session Session, err error) {
+	err = row.Scan(&session.Id, &session.User_id, &session.Session_id, &session.Expiration,
+		&session.CreatedAt, &session.LastSeenAt, &session.UserAgent, &session.IP, &session.RememberMe, &session.CsrfToken)
+	return
+}
+
+func (s *pgSessions) Get(ctx context.Context, sessionId string) (Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx, selectSession+" WHERE session_id = $1", sessionId))
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return session, err
+}
+
+func (s *pgSessions) Create(ctx context.Context, session Session) error {
+	now := time.Now()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
+	}
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	_, err := s.db.ExecContext(ctx, `
+	INSERT INTO sessions (user_id, session_id, expiration, created_at, last_seen_at, user_agent, ip_address, remember_me, csrf_token)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		session.User_id, session.Session_id, session.Expiration, session.CreatedAt, session.LastSeenAt, session.UserAgent, session.IP, session.RememberMe, session.CsrfToken)
+	return err
+}
+
+func (s *pgSessions) Delete(ctx context.Context, sessionId string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE session_id = $1", sessionId)
+	return err
+}
+
+func (s *pgSessions) ListByUser(ctx context.Context, userId int) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, selectSession+" WHERE user_id = $1 AND expiration >= NOW() ORDER BY last_seen_at DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *pgSessions) Touch(ctx context.Context, sessionId string, lastSeen time.Time, expiration time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET last_seen_at = $1, expiration = $2 WHERE session_id = $3", lastSeen, expiration, sessionId)
+	return err
+}
+
+func (s *pgSessions) SetCsrfToken(ctx context.Context, sessionId string, token string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET csrf_token = $1 WHERE session_id = $2", token, sessionId)
+	return err
+}
+
+func (s *pgSessions) DeleteForUser(ctx context.Context, userId int, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgSessions) DeleteAllForUser(ctx context.Context, userId int) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = $1", userId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *pgSessions) DeleteOthersForUser(ctx context.Context, userId int, keepSessionId string) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = $1 AND session_id <> $2", userId, keepSessionId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *pgSessions) DeleteExpired(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiration < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// API tokens
+
+type pgAPITokens struct {
+	db *sql.DB
+}
+
+const selectAPIToken = `
+	SELECT id, user_id, name, token_hash, scopes, created_at, expires_at, last_used_at
+	FROM api_tokens`
+
+func scanAPIToken(row scanner) (token APIToken, err error) {
+	var scopes pq.StringArray
+	err = row.Scan(&token.Id, &token.UserId, &token.Name, &token.TokenHash, &scopes,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt)
+	token.Scopes = scopes
+	return
+}
+
+func (s *pgAPITokens) Create(ctx context.Context, token APIToken) (APIToken, error) {
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	err := s.db.QueryRowContext(ctx, `
+	INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		token.UserId, token.Name, token.TokenHash, pq.StringArray(token.Scopes), token.CreatedAt, token.ExpiresAt).Scan(&token.Id)
+	if isUniqueViolation(err) {
+		err = ErrConflict
+	}
+	return token, err
+}
+
+func (s *pgAPITokens) GetByHash(ctx context.Context, tokenHash string) (APIToken, error) {
+	token, err := scanAPIToken(s.db.QueryRowContext(ctx, selectAPIToken+" WHERE token_hash = $1", tokenHash))
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return token, err
+}
+
+func (s *pgAPITokens) ListByUser(ctx context.Context, userId int) ([]APIToken, error) {
+	rows, err := s.db.QueryContext(ctx, selectAPIToken+" WHERE user_id = $1 ORDER BY created_at DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *pgAPITokens) Touch(ctx context.Context, id int, lastUsed time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = $1 WHERE id = $2", lastUsed, id)
+	return err
+}
+
+func (s *pgAPITokens) DeleteForUser(ctx context.Context, userId int, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgAPITokens) DeleteAllForUser(ctx context.Context, userId int) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM api_tokens WHERE user_id = $1", userId)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Login throttles
+
+type pgThrottles struct {
+	db *sql.DB
+}
+
+func (s *pgThrottles) Get(ctx context.Context, key string) (throttle LoginThrottle, err error) {
+	err = s.db.QueryRowContext(ctx, "SELECT key, failures, last_failure_at, locked_until FROM login_throttles WHERE key = $1", key).
+		Scan(&throttle.Key, &throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgThrottles) RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (throttle LoginThrottle, err error) {
+	err = s.db.QueryRowContext(ctx, `
+	INSERT INTO login_throttles (key, failures, last_failure_at) VALUES ($1, 1, $2)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE WHEN login_throttles.last_failure_at < $3 THEN 1 ELSE login_throttles.failures + 1 END,
+		last_failure_at = $2
+	RETURNING key, failures, last_failure_at, locked_until`, key, at, resetBefore).
+		Scan(&throttle.Key, &throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+	return
+}
+
+func (s *pgThrottles) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE login_throttles SET locked_until = $1 WHERE key = $2", until, key)
+	return err
+}
+
+func (s *pgThrottles) Reset(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_throttles WHERE key = $1", key)
+	return err
+}
+
+func (s *pgThrottles) DeleteStale(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+	DELETE FROM login_throttles
+	WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < NOW())`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *pgThrottles) RecordLockout(ctx context.Context, event LockoutEvent) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO lockout_events (key, ip_address, failures, locked_until) VALUES ($1, $2, $3, $4)",
+		event.Key, event.IP, event.Failures, event.LockedUntil)
+	return err
+}
+
+func (s *pgThrottles) ListLockouts(ctx context.Context, limit int) ([]LockoutEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, key, ip_address, failures, locked_until, created_at
+	FROM lockout_events ORDER BY created_at DESC, id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []LockoutEvent
+	for rows.Next() {
+		var event LockoutEvent
+		if err := rows.Scan(&event.Id, &event.Key, &event.IP, &event.Failures, &event.LockedUntil, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// One time tokens
+
+type pgTokens struct {
+	db *sql.DB
+}
+
+func (s *pgTokens) Create(ctx context.Context, token OneTimeToken) (OneTimeToken, error) {
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return token, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL", token.UserId, token.Purpose)
+	if err != nil {
+		return token, err
+	}
+	err = tx.QueryRowContext(ctx, `
+	INSERT INTO user_tokens (user_id, purpose, token_hash, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		token.UserId, token.Purpose, token.TokenHash, token.CreatedAt, token.ExpiresAt).Scan(&token.Id)
+	if err != nil {
+		return token, err
+	}
+	return token, tx.Commit()
+}
+
+func (s *pgTokens) Consume(ctx context.Context, purpose string, tokenHash string, now time.Time) (token OneTimeToken, err error) {
+	// a single statement so that a token can't be used twice concurrently
+	err = s.db.QueryRowContext(ctx, `
+	UPDATE user_tokens SET used_at = $3
+	WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL AND expires_at > $3
+	RETURNING id, user_id, purpose, token_hash, created_at, expires_at, used_at`, purpose, tokenHash, now).
+		Scan(&token.Id, &token.UserId, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgTokens) DeleteUnused(ctx context.Context, userId int, purpose string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL", userId, purpose)
+	return err
+}
+
+func (s *pgTokens) Get(ctx context.Context, purpose string, tokenHash string, now time.Time) (token OneTimeToken, err error) {
+	err = s.db.QueryRowContext(ctx, `
+	SELECT id, user_id, purpose, token_hash, created_at, expires_at, used_at FROM user_tokens
+	WHERE purpose = $1 AND token_hash = $2 AND used_at IS NULL AND expires_at > $3`, purpose, tokenHash, now).
+		Scan(&token.Id, &token.UserId, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Two factor authentication
+
+type pgTwoFactor struct {
+	db *sql.DB
+}
+
+func (s *pgTwoFactor) Get(ctx context.Context, userId int) (secret TOTPSecret, err error) {
+	err = s.db.QueryRowContext(ctx, "SELECT user_id, secret, created_at, confirmed_at, last_used_step FROM user_totp WHERE user_id = $1", userId).
+		Scan(&secret.UserId, &secret.Secret, &secret.CreatedAt, &secret.ConfirmedAt, &secret.LastUsedStep)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgTwoFactor) Enroll(ctx context.Context, userId int, secret string) error {
+	result, err := s.db.ExecContext(ctx, `
+	INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW()
+	WHERE user_totp.confirmed_at IS NULL`, userId, secret)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *pgTwoFactor) Confirm(ctx context.Context, userId int, step int64, at time.Time, recoveryCodeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE user_totp SET confirmed_at = $2, last_used_step = $3 WHERE user_id = $1 AND confirmed_at IS NULL", userId, at, step)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userId, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgTwoFactor) UseStep(ctx context.Context, userId int, step int64) error {
+	// the comparison makes concurrent uses of one code fail but one
+	result, err := s.db.ExecContext(ctx, "UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2", userId, step)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgTwoFactor) Delete(ctx context.Context, userId int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgTwoFactor) ReplaceRecoveryCodes(ctx context.Context, userId int, hashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userId, hashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userId int, hashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userId, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *pgTwoFactor) UseRecoveryCode(ctx context.Context, userId int, hash string, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userId, hash, at)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *pgTwoFactor) CountRecoveryCodes(ctx context.Context, userId int) (count int, err error) {
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL", userId).Scan(&count)
+	return
+}
+
+// External identities
+
+type pgIdentities struct {
+	db *sql.DB
+}
+
+const selectIdentity = "SELECT id, user_id, issuer, subject, email, created_at FROM external_identities"
+
+func scanIdentity(row scanner) (identity ExternalIdentity, err error) {
+	err = row.Scan(&identity.Id, &identity.UserId, &identity.Issuer, &identity.Subject, &identity.Email, &identity.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgIdentities) Get(ctx context.Context, issuer string, subject string) (ExternalIdentity, error) {
+	return scanIdentity(s.db.QueryRowContext(ctx, selectIdentity+" WHERE issuer = $1 AND subject = $2", issuer, subject))
+}
+
+func (s *pgIdentities) Create(ctx context.Context, identity ExternalIdentity) (ExternalIdentity, error) {
+	if identity.CreatedAt.IsZero() {
+		identity.CreatedAt = time.Now()
+	}
+	err := s.db.QueryRowContext(ctx, `
+	INSERT INTO external_identities (user_id, issuer, subject, email, created_at)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		identity.UserId, identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt).Scan(&identity.Id)
+	if isUniqueViolation(err) {
+		err = ErrConflict
+	}
+	return identity, err
+}
+
+func (s *pgIdentities) ListByUser(ctx context.Context, userId int) ([]ExternalIdentity, error) {
+	rows, err := s.db.QueryContext(ctx, selectIdentity+" WHERE user_id = $1 ORDER BY created_at", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []ExternalIdentity
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (s *pgIdentities) DeleteForUser(ctx context.Context, userId int, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM external_identities WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Passkeys
+
+type pgPasskeys struct {
+	db *sql.DB
+}
+
+func (s *pgPasskeys) CreateChallenge(ctx context.Context, challenge PasskeyChallenge) error {
+	userId := sql.NullInt64{Int64: int64(challenge.UserId), Valid: challenge.UserId != 0}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO passkey_challenges (challenge_hash, user_id, purpose, expires_at) VALUES ($1, $2, $3, $4)",
+		challenge.Hash, userId, challenge.Purpose, challenge.ExpiresAt)
+	return err
+}
+
+func (s *pgPasskeys) ConsumeChallenge(ctx context.Context, purpose string, hash string, now time.Time) (PasskeyChallenge, error) {
+	var challenge PasskeyChallenge
+	var userId sql.NullInt64
+	// deleting returns the row to a single caller, a challenge can't be
+	// answered twice
+	err := s.db.QueryRowContext(ctx, `
+	DELETE FROM passkey_challenges
+	WHERE challenge_hash = $1 AND purpose = $2 AND expires_at > $3
+	RETURNING challenge_hash, user_id, purpose, expires_at`, hash, purpose, now).
+		Scan(&challenge.Hash, &userId, &challenge.Purpose, &challenge.ExpiresAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	challenge.UserId = int(userId.Int64)
+	return challenge, err
+}
+
+func (s *pgPasskeys) DeleteExpiredChallenges(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM passkey_challenges WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const selectPasskey = "SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at FROM passkeys"
+
+func scanPasskey(row scanner) (passkey Passkey, err error) {
+	err = row.Scan(&passkey.Id, &passkey.UserId, &passkey.CredentialId, &passkey.PublicKey, &passkey.SignCount, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+func (s *pgPasskeys) Create(ctx context.Context, passkey Passkey) (Passkey, error) {
+	if passkey.CreatedAt.IsZero() {
+		passkey.CreatedAt = time.Now()
+	}
+	err := s.db.QueryRowContext(ctx, `
+	INSERT INTO passkeys (user_id, credential_id, public_key, sign_count, name, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		passkey.UserId, passkey.CredentialId, passkey.PublicKey, passkey.SignCount, passkey.Name, passkey.CreatedAt).Scan(&passkey.Id)
+	if isUniqueViolation(err) {
+		err = ErrConflict
+	}
+	return passkey, err
+}
+
+func (s *pgPasskeys) GetByCredentialId(ctx context.Context, credentialId []byte) (Passkey, error) {
+	return scanPasskey(s.db.QueryRowContext(ctx, selectPasskey+" WHERE credential_id = $1", credentialId))
+}
+
+func (s *pgPasskeys) ListByUser(ctx context.Context, userId int) ([]Passkey, error) {
+	rows, err := s.db.QueryContext(ctx, selectPasskey+" WHERE user_id = $1 ORDER BY created_at", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s *pgPasskeys) Use(ctx context.Context, id int, signCount int64, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE passkeys SET sign_count = $2, last_used_at = $3 WHERE id = $1", id, signCount, at)
+	return err
+}
+
+func (s *pgPasskeys) DeleteForUser(ctx context.Context, userId int, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM passkeys WHERE id = $1 AND user_id = $2", id, userId)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
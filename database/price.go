@@ -0,0 +1,138 @@
+package database
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const DefaultCurrency = "USD"
+
+// MaxAmount is the largest amount the NUMERIC(12,2) price column holds
+const MaxAmount Amount = 999999999999
+
+var errInvalidAmount = errors.New("invalid amount")
+
+// Amount is a decimal amount of money stored as hundredths (cents) so it
+// never goes through floating point. It is a number in JSON and a NUMERIC
+// in Postgres.
+type Amount int64
+
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if whole == "" || len(fraction) > 2 || strings.Trim(whole+fraction, "0123456789") != "" {
+		return 0, errInvalidAmount
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+
+	cents, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return 0, errInvalidAmount
+	}
+	if negative {
+		cents = -cents
+	}
+	return Amount(cents), nil
+}
+
+func (a Amount) String() string {
+	cents := int64(a)
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	amount, err := ParseAmount(string(data))
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+func (a *Amount) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*a = Amount(v * 100)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Amount", src)
+	}
+	amount, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+type Price struct {
+	Amount   Amount `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// UnmarshalJSON accepts either {"amount": 12.5, "currency": "EUR"} or, as
+// older clients send, a bare number in the default currency
+func (p *Price) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		p.Currency = DefaultCurrency
+		return p.Amount.UnmarshalJSON(data)
+	}
+
+	var price struct {
+		Amount   Amount `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &price); err != nil {
+		return err
+	}
+	*p = Price(price)
+	if p.Currency == "" {
+		p.Currency = DefaultCurrency
+	}
+	return nil
+}
+
+// IsValidCurrency reports whether code looks like an ISO 4217 code
+func IsValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package database_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"quickstart/database"
+)
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		in   string
+		want database.Amount
+		ok   bool
+	}{
+		{"12", 1200, true},
+		{"12.5", 1250, true},
+		{"12.05", 1205, true},
+		{"12.", 1200, true},
+		{"0.99", 99, true},
+		{" 7.5 ", 750, true},
+		{"-3.10", -310, true},
+		{"9999999999.99", database.MaxAmount, true},
+		// too many decimals are refused rather than rounded
+		{"1.005", 0, false},
+		{"1.999", 0, false},
+		{".5", 0, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{"--1", 0, false},
+		{"+1", 0, false},
+		{"1e3", 0, false},
+		{"1,5", 0, false},
+		{"twelve", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+	for _, c := range cases {
+		got, err := database.ParseAmount(c.in)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d ok %v", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	for amount, want := range map[database.Amount]string{0: "0.00", 5: "0.05", 1250: "12.50", -310: "-3.10", database.MaxAmount: "9999999999.99"} {
+		if got := amount.String(); got != want {
+			t.Errorf("Amount(%d).String() = %q, want %q", amount, got, want)
+		}
+	}
+}
+
+func TestPriceJSON(t *testing.T) {
+	cases := []struct {
+		in   string
+		want database.Price
+		ok   bool
+	}{
+		{`12.5`, database.Price{Amount: 1250, Currency: "USD"}, true},
+		{` 3 `, database.Price{Amount: 300, Currency: "USD"}, true},
+		{`-1`, database.Price{Amount: -100, Currency: "USD"}, true},
+		{`{"amount": 12.5, "currency": "EUR"}`, database.Price{Amount: 1250, Currency: "EUR"}, true},
+		{`{"amount": 3}`, database.Price{Amount: 300, Currency: "USD"}, true},
+		{`{"amount": -0.5, "currency": "EUR"}`, database.Price{Amount: -50, Currency: "EUR"}, true},
+		{`1.005`, database.Price{}, false},
+		{`{"amount": 1.005, "currency": "EUR"}`, database.Price{}, false},
+		{`{"amount": 1e3, "currency": "EUR"}`, database.Price{}, false},
+		{`"12.5"`, database.Price{}, false},
+		{`{"amount": "12.5"}`, database.Price{}, false},
+		{`[12.5]`, database.Price{}, false},
+	}
+	for _, c := range cases {
+		var got database.Price
+		err := json.Unmarshal([]byte(c.in), &got)
+		if (err == nil) != c.ok || (c.ok && got != c.want) {
+			t.Errorf("%s: got %+v, %v, want %+v ok %v", c.in, got, err, c.want, c.ok)
+		}
+	}
+
+	encoded, err := json.Marshal(database.Price{Amount: 1250, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"amount":12.50,"currency":"EUR"}` {
+		t.Errorf("Marshal = %s", encoded)
+	}
+	var decoded database.Price
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != (database.Price{Amount: 1250, Currency: "EUR"}) {
+		t.Errorf("round trip: %+v, %v", decoded, err)
+	}
+}
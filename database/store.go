@@ -0,0 +1,401 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+var ErrConflict = errors.New("conflict")
+
+// ErrEmailTaken is returned instead of ErrConflict when it's the email
+// address that's already in use
+var ErrEmailTaken = errors.New("email already in use")
+
+type City struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+}
+
+// Author is the public part of a user that is shown next to the
+// itineraries and comments they created. Id is 0 when the user deleted
+// their account and the content was kept.
+type Author struct {
+	Id         int            `json:"id"`
+	ProfilePic sql.NullString `json:"profilePic"`
+}
+
+type Itinerary struct {
+	Id         int
+	Title      string
+	Creator    Author
+	Duration   int // in minutes
+	Price      Price
+	Activities []string
+	Hashtags   []string
+	CityId     int
+}
+
+type Comment struct {
+	Id          int
+	ItineraryId int
+	Content     string
+	Author      Author
+}
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+func (role Role) IsValid() bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
+type User struct {
+	Id         int
+	Username   string
+	Password   string
+	ProfilePic sql.NullString
+	Role       Role
+	// Email is optional, stored lowercased
+	Email sql.NullString
+	// EmailVerifiedAt is when the user proved they own Email
+	EmailVerifiedAt sql.NullTime
+}
+
+// DeletionPolicy tells what happens to the itineraries and comments of a
+// user who deletes their account
+type DeletionPolicy string
+
+const (
+	// AnonymizeContent keeps them without an author
+	AnonymizeContent DeletionPolicy = "anonymize"
+	// DeleteContent deletes them, along with the comments others left on
+	// the itineraries
+	DeleteContent DeletionPolicy = "delete"
+)
+
+func (u User) EmailVerified() bool {
+	return u.Email.Valid && u.EmailVerifiedAt.Valid
+}
+
+type Session struct {
+	Id         int
+	User_id    int
+	Session_id string
+	Expiration time.Time
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// UserAgent and IP are those of the login request
+	UserAgent string
+	IP        string
+	// RememberMe sessions slide over SessionPolicy.RememberMaxAge
+	RememberMe bool
+	// CsrfToken must accompany every state changing request made with the
+	// session cookie
+	CsrfToken string
+}
+
+// APIToken is a personal access token, only its hash is stored
+type APIToken struct {
+	Id         int
+	UserId     int
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  sql.NullTime
+	LastUsedAt sql.NullTime
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Purposes of one time tokens
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+	TokenMagicLink         = "magic_link"
+	// TokenLoginSecondFactor is handed out by a password login that still
+	// needs a 2FA code, it isn't mailed
+	TokenLoginSecondFactor = "login_2fa"
+)
+
+// OneTimeToken is a single use token mailed to a user, e.g. to reset a
+// password. Only its hash is stored.
+type OneTimeToken struct {
+	Id        int
+	UserId    int
+	Purpose   string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+// LoginThrottle counts the recent failed logins for an account or an IP
+type LoginThrottle struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   sql.NullTime
+}
+
+// TOTPSecret is a user's authenticator app enrollment
+type TOTPSecret struct {
+	UserId    int
+	Secret    string
+	CreatedAt time.Time
+	// ConfirmedAt is NULL until the user has typed a first code, 2FA is
+	// only enabled from then on
+	ConfirmedAt  sql.NullTime
+	LastUsedStep int64
+}
+
+func (t TOTPSecret) Enabled() bool {
+	return t.ConfirmedAt.Valid
+}
+
+// ExternalIdentity links a user to their account at an OpenID Connect
+// provider
+type ExternalIdentity struct {
+	Id      int
+	UserId  int
+	Issuer  string
+	Subject string
+	// Email is the one the provider gave at link time, for display
+	Email     sql.NullString
+	CreatedAt time.Time
+}
+
+// Passkey is a WebAuthn credential a user logs in with
+type Passkey struct {
+	Id           int
+	UserId       int
+	CredentialId []byte
+	// PublicKey is COSE encoded
+	PublicKey  []byte
+	SignCount  int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+// Purposes of passkey challenges
+const (
+	ChallengePasskeyRegistration = "passkey_registration"
+	ChallengePasskeyLogin        = "passkey_login"
+)
+
+// PasskeyChallenge is handed out to start registering or logging in with a
+// passkey. Only its hash is stored.
+type PasskeyChallenge struct {
+	Hash string
+	// UserId is 0 for logins, the passkey tells who is logging in
+	UserId    int
+	Purpose   string
+	ExpiresAt time.Time
+}
+
+// LockoutEvent is recorded every time an account or IP gets locked out
+type LockoutEvent struct {
+	Id          int
+	Key         string
+	IP          string
+	Failures    int
+	LockedUntil time.Time
+	CreatedAt   time.Time
+}
+
+type CityStore interface {
+	List(ctx context.Context) ([]City, error)
+	Get(ctx context.Context, id int) (City, error)
+	Create(ctx context.Context, city City) (City, error)
+	Update(ctx context.Context, city City) (City, error)
+	// Delete removes the city along with all of its itineraries
+	Delete(ctx context.Context, id int) error
+}
+
+type ItineraryStore interface {
+	ListByCity(ctx context.Context, cityId int) ([]Itinerary, error)
+	ListByCreator(ctx context.Context, userId int) ([]Itinerary, error)
+	Get(ctx context.Context, id int) (Itinerary, error)
+	Create(ctx context.Context, itinerary Itinerary) (Itinerary, error)
+	// Update returns ErrNotFound if there is no itinerary with that id
+	Update(ctx context.Context, itinerary Itinerary) error
+	Delete(ctx context.Context, id int) error
+}
+
+type CommentStore interface {
+	ListByItineraries(ctx context.Context, itineraryIds []int) ([]Comment, error)
+	Create(ctx context.Context, itineraryId int, authorId int, content string) (Comment, error)
+}
+
+type UserStore interface {
+	Get(ctx context.Context, id int) (User, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// Create returns ErrConflict if the username is already taken and
+	// ErrEmailTaken if the email is, users without a role are created as
+	// RoleUser
+	Create(ctx context.Context, user User) (User, error)
+	SetRole(ctx context.Context, id int, role Role) error
+	SetPassword(ctx context.Context, id int, passwordHash string) error
+	// SetEmail changes or, when not valid, removes the email, which becomes
+	// unverified. ErrEmailTaken if another user has it.
+	SetEmail(ctx context.Context, id int, email sql.NullString) error
+	VerifyEmail(ctx context.Context, id int, at time.Time) error
+	// UpdateProfile returns ErrConflict if another user has the username
+	UpdateProfile(ctx context.Context, id int, username string, profilePic sql.NullString) error
+	// Delete removes the user along with their sessions, tokens and login
+	// methods. Their itineraries and comments are handled per policy.
+	Delete(ctx context.Context, id int, policy DeletionPolicy) error
+	// ListProfilePics returns every profile picture url in use
+	ListProfilePics(ctx context.Context) ([]string, error)
+}
+
+type SessionStore interface {
+	Get(ctx context.Context, sessionId string) (Session, error)
+	// Create fills in CreatedAt and LastSeenAt with the current time if unset
+	Create(ctx context.Context, session Session) error
+	Delete(ctx context.Context, sessionId string) error
+	// ListByUser returns the user's unexpired sessions, most recently seen first
+	ListByUser(ctx context.Context, userId int) ([]Session, error)
+	// Touch records activity on the session, pushing its expiration
+	Touch(ctx context.Context, sessionId string, lastSeen time.Time, expiration time.Time) error
+	SetCsrfToken(ctx context.Context, sessionId string, token string) error
+	// DeleteForUser deletes the session with the given id, ErrNotFound if it
+	// doesn't belong to the user
+	DeleteForUser(ctx context.Context, userId int, id int) error
+	// DeleteAllForUser deletes every session of the user and returns how many
+	DeleteAllForUser(ctx context.Context, userId int) (int64, error)
+	// DeleteOthersForUser deletes every session of the user but the given
+	// one and returns how many
+	DeleteOthersForUser(ctx context.Context, userId int, keepSessionId string) (int64, error)
+	// DeleteExpired removes every expired session and returns how many
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type APITokenStore interface {
+	Create(ctx context.Context, token APIToken) (APIToken, error)
+	GetByHash(ctx context.Context, tokenHash string) (APIToken, error)
+	ListByUser(ctx context.Context, userId int) ([]APIToken, error)
+	Touch(ctx context.Context, id int, lastUsed time.Time) error
+	// DeleteForUser deletes the token with the given id, ErrNotFound if it
+	// doesn't belong to the user
+	DeleteForUser(ctx context.Context, userId int, id int) error
+	// DeleteAllForUser deletes every token of the user and returns how many
+	DeleteAllForUser(ctx context.Context, userId int) (int64, error)
+}
+
+type OneTimeTokenStore interface {
+	// Create also deletes the user's unused tokens for the same purpose, so
+	// only the latest one mailed works
+	Create(ctx context.Context, token OneTimeToken) (OneTimeToken, error)
+	// Consume marks the token as used and returns it, ErrNotFound if it's
+	// unknown, already used or expired
+	Consume(ctx context.Context, purpose string, tokenHash string, now time.Time) (OneTimeToken, error)
+	// DeleteUnused deletes the user's unused tokens for the purpose
+	DeleteUnused(ctx context.Context, userId int, purpose string) error
+	// Get returns the token if it can still be consumed, ErrNotFound
+	// otherwise
+	Get(ctx context.Context, purpose string, tokenHash string, now time.Time) (OneTimeToken, error)
+}
+
+type ExternalIdentityStore interface {
+	// Get returns ErrNotFound when no user linked that account
+	Get(ctx context.Context, issuer string, subject string) (ExternalIdentity, error)
+	// Create returns ErrConflict if the account is already linked
+	Create(ctx context.Context, identity ExternalIdentity) (ExternalIdentity, error)
+	// ListByUser returns the oldest links first
+	ListByUser(ctx context.Context, userId int) ([]ExternalIdentity, error)
+	// DeleteForUser unlinks the identity, ErrNotFound if it doesn't belong
+	// to the user
+	DeleteForUser(ctx context.Context, userId int, id int) error
+}
+
+type PasskeyStore interface {
+	CreateChallenge(ctx context.Context, challenge PasskeyChallenge) error
+	// ConsumeChallenge deletes the challenge and returns it, ErrNotFound if
+	// it's unknown or expired
+	ConsumeChallenge(ctx context.Context, purpose string, hash string, now time.Time) (PasskeyChallenge, error)
+	// DeleteExpiredChallenges removes the challenges of abandoned ceremonies
+	// and returns how many
+	DeleteExpiredChallenges(ctx context.Context, now time.Time) (int64, error)
+	// Create returns ErrConflict if the credential is already registered
+	Create(ctx context.Context, passkey Passkey) (Passkey, error)
+	GetByCredentialId(ctx context.Context, credentialId []byte) (Passkey, error)
+	// ListByUser returns the oldest passkeys first
+	ListByUser(ctx context.Context, userId int) ([]Passkey, error)
+	// Use records a login with the passkey along with its new signature
+	// counter
+	Use(ctx context.Context, id int, signCount int64, at time.Time) error
+	// DeleteForUser deletes the passkey, ErrNotFound if it doesn't belong to
+	// the user
+	DeleteForUser(ctx context.Context, userId int, id int) error
+}
+
+type TwoFactorStore interface {
+	// Get returns ErrNotFound when the user never started enrolling
+	Get(ctx context.Context, userId int) (TOTPSecret, error)
+	// Enroll stores a new unconfirmed secret, replacing the previous one
+	// unless it is confirmed, in which case it returns ErrConflict
+	Enroll(ctx context.Context, userId int, secret string) error
+	// Confirm enables 2FA and replaces the recovery codes, step is the one
+	// of the code the user confirmed with
+	Confirm(ctx context.Context, userId int, step int64, at time.Time, recoveryCodeHashes []string) error
+	// UseStep records that the code of the step was accepted, ErrNotFound
+	// if a code of that step or a later one already was
+	UseStep(ctx context.Context, userId int, step int64) error
+	// Delete disables 2FA, recovery codes included
+	Delete(ctx context.Context, userId int) error
+	ReplaceRecoveryCodes(ctx context.Context, userId int, hashes []string) error
+	// UseRecoveryCode marks the code as used, ErrNotFound if it's unknown
+	// or already used
+	UseRecoveryCode(ctx context.Context, userId int, hash string, at time.Time) error
+	// CountRecoveryCodes returns how many unused codes are left
+	CountRecoveryCodes(ctx context.Context, userId int) (int, error)
+}
+
+type LoginThrottleStore interface {
+	Get(ctx context.Context, key string) (LoginThrottle, error)
+	// RecordFailure counts a failed login and returns the updated throttle.
+	// Failures older than resetBefore are forgotten first.
+	RecordFailure(ctx context.Context, key string, at time.Time, resetBefore time.Time) (LoginThrottle, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+	// DeleteStale removes the throttles whose last failure is older than
+	// before and that aren't locked anymore
+	DeleteStale(ctx context.Context, before time.Time) (int64, error)
+	RecordLockout(ctx context.Context, event LockoutEvent) error
+	// ListLockouts returns the most recent lockouts first
+	ListLockouts(ctx context.Context, limit int) ([]LockoutEvent, error)
+}
+
+// Stores groups every store the endpoints depend on
+type Stores struct {
+	Cities      CityStore
+	Itineraries ItineraryStore
+	Comments    CommentStore
+	Users       UserStore
+	Sessions    SessionStore
+	APITokens   APITokenStore
+	Throttles   LoginThrottleStore
+	Tokens      OneTimeTokenStore
+	TwoFactor   TwoFactorStore
+	Identities  ExternalIdentityStore
+	Passkeys    PasskeyStore
+}
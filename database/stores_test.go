@@ -0,0 +1,296 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"quickstart/database"
+	"quickstart/migrations"
+
+	_ "github.com/lib/pq"
+)
+
+// eachStore runs test against the memory stores and, when
+// TEST_DATABASE_URL is set, against Postgres. That database is wiped
+// before every test, only point it at a throwaway one.
+func eachStore(t *testing.T, test func(t *testing.T, stores database.Stores)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, database.NewMemoryStores())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("TEST_DATABASE_URL")
+		if url == "" {
+			t.Skip("TEST_DATABASE_URL is not set")
+		}
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		ctx := context.Background()
+		if _, err := db.ExecContext(ctx, "DROP SCHEMA public CASCADE; CREATE SCHEMA public"); err != nil {
+			t.Fatal(err)
+		}
+		migrator, err := migrations.New(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrator.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		test(t, database.NewPostgresStores(db))
+	})
+}
+
+// fixture is a city with an itinerary by author, commented on by commenter
+type fixture struct {
+	city      database.City
+	itinerary database.Itinerary
+	author    database.User
+	commenter database.User
+	comment   database.Comment
+}
+
+func newFixture(t *testing.T, stores database.Stores) fixture {
+	ctx := context.Background()
+	var f fixture
+	var err error
+	if f.city, err = stores.Cities.Create(ctx, database.City{Name: "Lisbon", Country: "Portugal"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.author, err = stores.Users.Create(ctx, database.User{Username: "author", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.commenter, err = stores.Users.Create(ctx, database.User{Username: "commenter", Password: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	f.itinerary, err = stores.Itineraries.Create(ctx, database.Itinerary{
+		Title:      "Trams and pastéis",
+		Creator:    database.Author{Id: f.author.Id},
+		Duration:   240,
+		Price:      database.Price{Amount: 2500, Currency: "EUR"},
+		Activities: []string{"Tram 28"},
+		Hashtags:   []string{"food"},
+		CityId:     f.city.Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.comment, err = stores.Comments.Create(ctx, f.itinerary.Id, f.commenter.Id, "Go early"); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestItineraryDeleteRemovesComments(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		if err := stores.Itineraries.Delete(ctx, f.itinerary.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := stores.Itineraries.Get(ctx, f.itinerary.Id); err != database.ErrNotFound {
+			t.Errorf("Get after Delete: got %v, want ErrNotFound", err)
+		}
+		comments, err := stores.Comments.ListByItineraries(ctx, []int{f.itinerary.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 0 {
+			t.Errorf("comments left after Delete: %v", comments)
+		}
+	})
+}
+
+func TestCityDeleteRemovesItineraries(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		if err := stores.Cities.Delete(ctx, f.city.Id); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := stores.Cities.Get(ctx, f.city.Id); err != database.ErrNotFound {
+			t.Errorf("Get after Delete: got %v, want ErrNotFound", err)
+		}
+		if _, err := stores.Itineraries.Get(ctx, f.itinerary.Id); err != database.ErrNotFound {
+			t.Errorf("itinerary Get after city Delete: got %v, want ErrNotFound", err)
+		}
+		itineraries, err := stores.Itineraries.ListByCreator(ctx, f.author.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(itineraries) != 0 {
+			t.Errorf("itineraries left after city Delete: %v", itineraries)
+		}
+	})
+}
+
+func TestItineraryRoundTrip(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		got, err := stores.Itineraries.Get(ctx, f.itinerary.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != f.itinerary.Title || got.Creator.Id != f.author.Id || got.Price != f.itinerary.Price || got.CityId != f.city.Id {
+			t.Errorf("Get = %+v, want %+v", got, f.itinerary)
+		}
+		byCity, err := stores.Itineraries.ListByCity(ctx, f.city.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(byCity) != 1 || byCity[0].Id != f.itinerary.Id {
+			t.Errorf("ListByCity = %v", byCity)
+		}
+		comments, err := stores.Comments.ListByItineraries(ctx, []int{f.itinerary.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 1 || comments[0].Content != "Go early" || comments[0].Author.Id != f.commenter.Id {
+			t.Errorf("ListByItineraries = %+v", comments)
+		}
+	})
+}
+
+func TestUserConflicts(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		if _, err := stores.Users.Create(ctx, database.User{Username: "author", Password: "hash"}); err != database.ErrConflict {
+			t.Errorf("Create with a taken username: got %v, want ErrConflict", err)
+		}
+		if err := stores.Users.UpdateProfile(ctx, f.commenter.Id, "author", sql.NullString{}); err != database.ErrConflict {
+			t.Errorf("UpdateProfile with a taken username: got %v, want ErrConflict", err)
+		}
+		if _, err := stores.Users.Get(ctx, 12345); err != database.ErrNotFound {
+			t.Errorf("Get of an unknown user: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestUserDeleteAnonymizesContent(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		if err := stores.Users.Delete(ctx, f.author.Id, database.AnonymizeContent); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := stores.Users.Delete(ctx, f.commenter.Id, database.AnonymizeContent); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		itinerary, err := stores.Itineraries.Get(ctx, f.itinerary.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if itinerary.Creator.Id != 0 {
+			t.Errorf("creator of a kept itinerary = %d, want 0", itinerary.Creator.Id)
+		}
+		comments, err := stores.Comments.ListByItineraries(ctx, []int{f.itinerary.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 1 || comments[0].Author.Id != 0 {
+			t.Errorf("comments = %+v, want one without an author", comments)
+		}
+	})
+}
+
+func TestUserDeleteRemovesContent(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		if err := stores.Users.Delete(ctx, f.author.Id, database.DeleteContent); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := stores.Itineraries.Get(ctx, f.itinerary.Id); err != database.ErrNotFound {
+			t.Errorf("itinerary Get: got %v, want ErrNotFound", err)
+		}
+		comments, err := stores.Comments.ListByItineraries(ctx, []int{f.itinerary.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) != 0 {
+			t.Errorf("comments left: %+v", comments)
+		}
+		if _, err := stores.Users.Get(ctx, f.commenter.Id); err != nil {
+			t.Errorf("commenter: %v", err)
+		}
+		if err := stores.Users.Delete(ctx, f.author.Id, database.DeleteContent); err != database.ErrNotFound {
+			t.Errorf("second Delete: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestSessionsDeleteOthersForUser(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		expiration := time.Now().Add(time.Hour)
+		for _, session := range []database.Session{
+			{User_id: f.author.Id, Session_id: "kept", Expiration: expiration},
+			{User_id: f.author.Id, Session_id: "other", Expiration: expiration},
+			{User_id: f.commenter.Id, Session_id: "someone else", Expiration: expiration},
+		} {
+			if err := stores.Sessions.Create(ctx, session); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		deleted, err := stores.Sessions.DeleteOthersForUser(ctx, f.author.Id, "kept")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 1 {
+			t.Errorf("deleted %d sessions, want 1", deleted)
+		}
+		for sessionId, want := range map[string]error{"kept": nil, "other": database.ErrNotFound, "someone else": nil} {
+			if _, err := stores.Sessions.Get(ctx, sessionId); err != want {
+				t.Errorf("Get(%q): got %v, want %v", sessionId, err, want)
+			}
+		}
+	})
+}
+
+func TestAPITokensDeleteAllForUser(t *testing.T) {
+	eachStore(t, func(t *testing.T, stores database.Stores) {
+		ctx := context.Background()
+		f := newFixture(t, stores)
+
+		for i, userId := range []int{f.author.Id, f.author.Id, f.commenter.Id} {
+			token := database.APIToken{UserId: userId, Name: "script", TokenHash: database.HashToken(fmt.Sprint("token ", i)), Scopes: []string{"read"}, CreatedAt: time.Now()}
+			if _, err := stores.APITokens.Create(ctx, token); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		deleted, err := stores.APITokens.DeleteAllForUser(ctx, f.author.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 2 {
+			t.Errorf("deleted %d tokens, want 2", deleted)
+		}
+		for userId, want := range map[int]int{f.author.Id: 0, f.commenter.Id: 1} {
+			tokens, err := stores.APITokens.ListByUser(ctx, userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != want {
+				t.Errorf("user %d has %d tokens, want %d", userId, len(tokens), want)
+			}
+		}
+	})
+}
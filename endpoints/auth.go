@@ -4,8 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"io"
-	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -14,296 +14,404 @@ import (
 	"quickstart/database"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthCreds struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// RememberMe asks for a long lived session on login
+	RememberMe bool `json:"rememberMe"`
+	// Email is optional on registration
+	Email string `json:"email,omitempty"`
 }
 
-const cookieMaxAge = time.Hour * 24
+var errUsernameTaken = errConflict("username_taken", "That username is already taken")
+var errEmailTaken = errConflict("email_taken", "That email address is already in use")
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
+func (h *Handler) hashPassword(password string) (string, error) {
+	return h.Passwords.Hash(password)
 }
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+func (h *Handler) checkPassword(password, hash string) bool {
+	ok, _ := h.Passwords.Verify(password, hash)
+	return ok
 }
 
-func Login(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+// rehashPassword replaces a hash made with an outdated algorithm or cost
+// now that the password is known. The login goes on if it fails.
+func (h *Handler) rehashPassword(r *http.Request, user database.User, password string) {
+	hash, err := h.hashPassword(password)
+	if err == nil {
+		err = h.Store.Users.SetPassword(r.Context(), user.Id, hash)
+	}
+	if err != nil {
+		logger(r).Error("rehashing password", "user_id", user.Id, "error", err)
+		return
+	}
+	logger(r).Info("password rehashed", "user_id", user.Id)
+}
+
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 
 	var creds AuthCreds
 	err := json.NewDecoder(r.Body).Decode(&creds)
 	if err != nil {
-		panic(err)
+		writeError(w, errInvalidJSON)
+		return
 	}
 
-	var dbUser struct {
-		id          int
-		password    string
-		profile_pic sql.NullString
-	}
-	err = database.Db.QueryRow("SELECT id, password, profile_pic FROM users WHERE username = $1", creds.Username).Scan(&dbUser.id, &dbUser.password, &dbUser.profile_pic)
+	keys := h.loginKeys(r, creds.Username)
+	blockedUntil, err := h.loginBlockedUntil(r.Context(), keys)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		panic(err)
+		writeInternalError(w, r, err)
+		return
+	}
+	if !blockedUntil.IsZero() {
+		h.writeTooManyAttempts(w, blockedUntil)
+		return
+	}
+
+	dbUser, err := h.Store.Users.GetByUsername(r.Context(), creds.Username)
+	if err != nil && err != database.ErrNotFound {
+		writeInternalError(w, r, err)
+		return
+	}
+	hash := dbUser.Password
+	if hash == "" {
+		// compare anyway so that unknown usernames, and accounts created
+		// through OIDC without a password, take as long as wrong passwords
+		hash = h.dummyHash
 	}
 
-	var expirationTime = time.Now().Add(cookieMaxAge)
+	ok, outdated := h.Passwords.Verify(creds.Password, hash)
+	if ok && dbUser.Password != "" {
+		if outdated {
+			h.rehashPassword(r, dbUser, creds.Password)
+		}
 
-	if checkPasswordHash(creds.Password, dbUser.password) {
-		cookie := http.Cookie{
-			Name:    "sid",
-			Value:   uuid.New().String(),
-			Path:    "/",
-			Expires: expirationTime,
-			MaxAge:  int(cookieMaxAge.Seconds()),
+		enrollment, err := h.Store.TwoFactor.Get(r.Context(), dbUser.Id)
+		if err != nil && err != database.ErrNotFound {
+			writeInternalError(w, r, err)
+			return
 		}
-		http.SetCookie(w, &cookie)
-		_, err := database.Db.Exec("INSERT INTO sessions (user_id, session_id, expiration) VALUES ($1, $2, $3)", dbUser.id, cookie.Value, expirationTime)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if enrollment.Enabled() {
+			// the throttle is only reset once the code is right too
+			h.requireSecondFactor(w, r, dbUser)
 			return
 		}
 
-		var userDTO struct {
-			Id          int    `json:"id"`
-			Username    string `json:"username"`
-			Profile_pic string `json:"profilePic,omitempty"`
-		}
-		userDTO.Id = dbUser.id
-		userDTO.Username = creds.Username
-		if dbUser.profile_pic.Valid {
-			userDTO.Profile_pic = dbUser.profile_pic.String
+		h.completeLogin(w, r, dbUser, keys[0].key, creds.RememberMe)
+
+	} else {
+		if err := h.recordLoginFailure(r, keys); err != nil {
+			writeInternalError(w, r, err)
+			return
 		}
+		writeError(w, errInvalidCredentials)
+	}
+}
 
-		json.NewEncoder(w).Encode(userDTO)
+// completeLogin clears the account's failed login counter, starts a
+// session and answers with the logged in user
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, user database.User, accountKey string, rememberMe bool) {
+	// only the account is cleared, one valid login mustn't let an IP carry
+	// on guessing other accounts
+	if err := h.Store.Throttles.Reset(r.Context(), accountKey); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
 
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+	session, err := h.startSession(w, r, user.Id, rememberMe)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	var userDTO struct {
+		Id          int    `json:"id"`
+		Username    string `json:"username"`
+		Profile_pic string `json:"profilePic,omitempty"`
+		Role        string `json:"role"`
+		// CsrfToken has to be sent back in X-CSRF-Token
+		CsrfToken string `json:"csrfToken"`
+	}
+	userDTO.Id = user.Id
+	userDTO.Username = user.Username
+	userDTO.Role = string(user.Role)
+	userDTO.CsrfToken = session.CsrfToken
+	if user.ProfilePic.Valid {
+		userDTO.Profile_pic = user.ProfilePic.String
 	}
+
+	json.NewEncoder(w).Encode(userDTO)
 }
 
-func Register(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-	// TODO: validation / error handling
+// startSession creates a session for the user and sets its sid cookie
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, userId int, rememberMe bool) (database.Session, error) {
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return database.Session{}, err
+	}
 
+	now := time.Now()
+	session := database.Session{
+		User_id:    userId,
+		Session_id: uuid.New().String(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		UserAgent:  truncate(r.UserAgent(), maxUserAgentLength),
+		IP:         h.clientIP(r),
+		RememberMe: rememberMe,
+		CsrfToken:  csrfToken,
+	}
+	session.Expiration = h.sessionPolicy().Expiration(session, now)
+	if err := h.Store.Sessions.Create(r.Context(), session); err != nil {
+		return database.Session{}, err
+	}
+
+	h.setSessionCookie(w, session)
+	return session, nil
+}
+
+func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errContentType)
+		return
 	}
 
 	if mediaType == "multipart/form-data" {
 		w.Header().Set("Content-Type", "application/json")
 
-		// max size 25MB
-		r.ParseMultipartForm(25 * 1024 * 1024)
+		if err := r.ParseMultipartForm(h.Config.MaxUploadBytes); err != nil {
+			writeError(w, errInvalidForm)
+			return
+		}
 
 		username := r.FormValue("username")
+		if username == "" {
+			writeError(w, errValidation(map[string]string{"username": "Missing username"}))
+			return
+		}
+		email, ok := parseOptionalEmail(r.FormValue("email"))
+		if !ok {
+			writeError(w, errValidation(map[string]string{"email": "Invalid email address"}))
+			return
+		}
+		if problem := h.PasswordPolicy.Check(r.FormValue("password"), username); problem != "" {
+			writeError(w, errValidation(map[string]string{"password": problem}))
+			return
+		}
 
 		// check if username is already taken
-		var dbUser struct {
-			id string
-		}
-		err = database.Db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&dbUser.id)
+		_, err = h.Store.Users.GetByUsername(r.Context(), username)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if err == database.ErrNotFound {
 
 				password := r.FormValue("password")
 
+				// the profile picture is optional
+				var profilePic sql.NullString
+				var storedImagePath string
 				pfpFile, header, err := r.FormFile("profilePic")
-				if err != nil {
-					log.Fatalln(err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				defer pfpFile.Close()
-
-				cwd, err := os.Getwd()
-				if err != nil {
-					log.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-
-				imagesDir := filepath.Join(cwd, "static", "images")
-
-				// create folder if it doesn't exist
-				if _, err := os.Stat(imagesDir); os.IsNotExist(err) {
-					err = os.MkdirAll(imagesDir, 0755)
+				switch err {
+				case nil:
+					defer pfpFile.Close()
+					profilePic.String, storedImagePath, err = h.saveProfilePic(r, pfpFile, header)
 					if err != nil {
-						log.Println(err)
-						w.WriteHeader(http.StatusInternalServerError)
+						writeInternalError(w, r, err)
+						return
 					}
-				}
+					profilePic.Valid = true
 
-				var imageFileName = uuid.New().String() + filepath.Ext(header.Filename)
+				case http.ErrMissingFile:
 
-				storedImagePath := filepath.Join(imagesDir, imageFileName)
-
-				f, err := os.Create(storedImagePath)
-				if err != nil {
-					log.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				defer f.Close()
-
-				_, err = io.Copy(f, pfpFile)
-
-				if err != nil {
-					// delete file
-					os.Remove(storedImagePath)
-					log.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
+				default:
+					writeError(w, errInvalidForm)
 					return
 				}
 
 				// begin storing in DB
-				hash, err := hashPassword(password)
+				hash, err := h.hashPassword(password)
 				if err != nil {
 					// delete file
-					os.Remove(storedImagePath)
-					w.WriteHeader(http.StatusInternalServerError)
+					removeProfilePic(r, storedImagePath)
+					writeInternalError(w, r, err)
 					return
 				}
 
-				var scheme string
-				if r.TLS != nil { // https://github.com/golang/go/issues/28940#issuecomment-441749380
-					scheme = "https"
-				} else {
-					scheme = "http"
-				}
-
-				var imageUrl = scheme + "://" + r.Host + "/static/images/" + imageFileName
-
-				_, err = database.Db.Exec("INSERT INTO users (username, password, profile_pic) VALUES ($1, $2, $3)", username, hash, imageUrl)
+				user, err := h.Store.Users.Create(r.Context(), database.User{
+					Username:   username,
+					Password:   hash,
+					ProfilePic: profilePic,
+					Email:      email,
+				})
 
 				if err != nil {
 					// delete file
-					os.Remove(storedImagePath)
-					w.WriteHeader(http.StatusInternalServerError)
+					removeProfilePic(r, storedImagePath)
+					if err == database.ErrConflict {
+						writeError(w, errUsernameTaken)
+						return
+					}
+					if err == database.ErrEmailTaken {
+						writeError(w, errEmailTaken)
+						return
+					}
+					writeInternalError(w, r, err)
 					return
 				}
+				h.verifyNewEmail(r, user)
 
 				json.NewEncoder(w).Encode(struct {
 					Username   string `json:"username"`
-					ProfilePic string `json:"profilePic"`
+					ProfilePic string `json:"profilePic,omitempty"`
 				}{
 					Username:   username,
-					ProfilePic: storedImagePath,
+					ProfilePic: profilePic.String,
 				})
 
 			} else {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeInternalError(w, r, err)
 			}
 		} else {
-			w.WriteHeader(http.StatusConflict)
+			writeError(w, errUsernameTaken)
 		}
 	} else {
 
 		var creds AuthCreds
 		err = json.NewDecoder(r.Body).Decode(&creds)
 		if err != nil {
-			panic(err)
+			writeError(w, errInvalidJSON)
+			return
+		}
+		if creds.Username == "" {
+			writeError(w, errValidation(map[string]string{"username": "Missing username"}))
+			return
+		}
+		email, ok := parseOptionalEmail(creds.Email)
+		if !ok {
+			writeError(w, errValidation(map[string]string{"email": "Invalid email address"}))
+			return
+		}
+		if problem := h.PasswordPolicy.Check(creds.Password, creds.Username); problem != "" {
+			writeError(w, errValidation(map[string]string{"password": problem}))
+			return
 		}
 
-		err = database.Db.QueryRow("SELECT id FROM users WHERE username = $1", creds.Username).Scan(&AuthCreds{})
+		_, err = h.Store.Users.GetByUsername(r.Context(), creds.Username)
 		if err != nil {
-			if err == sql.ErrNoRows { // user doesn't exist so we can create it
-				hash, err := hashPassword(creds.Password)
+			if err == database.ErrNotFound { // user doesn't exist so we can create it
+				hash, err := h.hashPassword(creds.Password)
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					writeInternalError(w, r, err)
 					return
 				}
-				_, err = database.Db.Exec("INSERT INTO users (username, password) VALUES ($1, $2)", creds.Username, hash)
+				user, err := h.Store.Users.Create(r.Context(), database.User{
+					Username: creds.Username,
+					Password: hash,
+					Email:    email,
+				})
 
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					if err == database.ErrConflict {
+						writeError(w, errUsernameTaken)
+						return
+					}
+					if err == database.ErrEmailTaken {
+						writeError(w, errEmailTaken)
+						return
+					}
+					writeInternalError(w, r, err)
 					return
 				}
-			} else { // user exists
-				w.WriteHeader(http.StatusForbidden) // https://stackoverflow.com/a/34458500
+				h.verifyNewEmail(r, user)
+			} else {
+				writeInternalError(w, r, err)
 			}
+		} else { // user exists
+			writeError(w, errUsernameTaken)
 		}
 	}
 }
 
-func IsLoggedIn(w http.ResponseWriter, r *http.Request) {
+// IsLoggedIn is declared as Authenticated, so reaching it means the
+// request carries a valid session
+func (h *Handler) IsLoggedIn(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("sid")
 	if err != nil {
 		if err == http.ErrNoCookie {
-			log.Printf("no cookie")
-			w.WriteHeader(http.StatusUnauthorized)
+			logger(r).Info("logout without a session cookie")
+			w.WriteHeader(http.StatusOK)
 			return
 		}
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
 
 	sessionId := cookie.Value
-	var session struct {
-		Id         string
-		user_id    string
-		session_id string
-		expiration time.Time
-	}
-	err = database.Db.QueryRow("SELECT * FROM sessions WHERE session_id = $1", sessionId).Scan(&session.Id, &session.user_id, &session.session_id, &session.expiration)
+	err = h.Store.Sessions.Delete(r.Context(), sessionId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("no session in db")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		log.Println(err)
+		writeInternalError(w, r, err)
 		return
 	}
 
-	if session.expiration.Before(time.Now()) {
-		log.Printf("session expired, deleting session from db")
-		w.WriteHeader(http.StatusUnauthorized)
-		//delete the session if it exists in the db
-		_, err := database.Db.Exec("DELETE FROM sessions WHERE session_id = $1", sessionId)
+	h.expireSessionCookie(w)
+}
+
+// saveProfilePic stores the uploaded image in the images folder of the
+// static directory and returns the url it is served at along with where it
+// was written
+func (h *Handler) saveProfilePic(r *http.Request, pfpFile multipart.File, header *multipart.FileHeader) (imageUrl string, storedImagePath string, err error) {
+	imagesDir := filepath.Join(h.Config.StaticDir, "images")
+
+	// create folder if it doesn't exist
+	if _, err := os.Stat(imagesDir); os.IsNotExist(err) {
+		err = os.MkdirAll(imagesDir, 0755)
 		if err != nil {
-			log.Println(err)
+			return "", "", err
 		}
-		return
-	} else {
-		w.WriteHeader(http.StatusOK)
 	}
-}
 
-func Logout(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("sid")
+	var imageFileName = uuid.New().String() + filepath.Ext(header.Filename)
+
+	storedImagePath = filepath.Join(imagesDir, imageFileName)
+
+	f, err := os.Create(storedImagePath)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			log.Printf("no cookie")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", "", err
 	}
+	defer f.Close()
+
+	_, err = io.Copy(f, pfpFile)
 
-	sessionId := cookie.Value
-	_, err = database.Db.Exec("DELETE FROM sessions WHERE session_id = $1", sessionId)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		// delete file
+		os.Remove(storedImagePath)
+		return "", "", err
+	}
+
+	var scheme string
+	if r.TLS != nil { // https://github.com/golang/go/issues/28940#issuecomment-441749380
+		scheme = "https"
+	} else {
+		scheme = "http"
 	}
 
-	cookie.MaxAge = -1
-	http.SetCookie(w, cookie)
+	imageUrl = scheme + "://" + r.Host + "/static/images/" + imageFileName
+	return
+}
+
+// removeProfilePic deletes an image stored by saveProfilePic, if any
+func removeProfilePic(r *http.Request, storedImagePath string) {
+	if storedImagePath == "" {
+		return
+	}
+	if err := os.Remove(storedImagePath); err != nil {
+		logger(r).Error("removing profile picture", "path", storedImagePath, "error", err)
+	}
 }
@@ -0,0 +1,50 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"quickstart/passwords"
+)
+
+func TestLoginRehashesOutdatedPasswords(t *testing.T) {
+	h, _ := newTestHandler(t)
+	ctx := context.Background()
+	user := createUser(t, h, "alice", "correct horse", "")
+	bcryptHash := user.Password
+
+	// the server moved to argon2id since alice signed up
+	h.Config.Passwords.Hasher = passwords.Argon2id
+	h.Config.Passwords.Argon2Memory = 64
+	h.Config.Passwords.Argon2Iterations = 1
+	h.Config.Passwords.Argon2Parallelism = 1
+	h.Passwords = passwords.NewHasher(h.Config.Passwords)
+
+	if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d %s", w.Code, w.Body)
+	}
+	if stored, _ := h.Store.Users.Get(ctx, user.Id); stored.Password != bcryptHash {
+		t.Fatal("a wrong password replaced the hash")
+	}
+
+	if w := login(t, h, "203.0.113.7", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	stored, err := h.Store.Users.Get(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Fatalf("hash after login %q, want argon2id", stored.Password)
+	}
+
+	// the new hash is current, and logging in again keeps it
+	if w := login(t, h, "203.0.113.7", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("login with the new hash: %d %s", w.Code, w.Body)
+	}
+	if again, _ := h.Store.Users.Get(ctx, user.Id); again.Password != stored.Password {
+		t.Error("a current hash was replaced")
+	}
+}
@@ -2,35 +2,59 @@ package endpoints
 
 import (
 	"encoding/json"
-	"log"
 	"mime"
 	"net/http"
-	"quickstart/database"
 )
 
-func Cities(w http.ResponseWriter, r *http.Request) {
+// decodeCity reads a city from a JSON, urlencoded or multipart body
+func (h *Handler) decodeCity(r *http.Request) (city CityJSON, e *Error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 
-	log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+	if err != nil {
+		return city, errContentType
+	}
+
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&city); err != nil {
+			return city, errInvalidJSON
+		}
+
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return city, errInvalidForm
+		}
+		city.Name = r.Form.Get("name")
+		city.Country = r.Form.Get("country")
+
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(h.Config.MaxFormBytes); err != nil {
+			return city, errInvalidForm
+		}
+		city.Name = r.Form.Get("name")
+		city.Country = r.Form.Get("country")
+
+	default:
+		return city, errContentType
+	}
+
+	details := map[string]string{}
+	if city.Name == "" {
+		details["name"] = "Missing name"
+	}
+	if city.Country == "" {
+		details["country"] = "Missing country"
+	}
+	return city, errValidation(details)
+}
+
+func (h *Handler) Cities(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		rows, err := database.Db.Query("SELECT * FROM city")
+		cities, err := h.Store.Cities.List(r.Context())
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var cities []CityJSON
-		for rows.Next() {
-			var city CityJSON
-			if err := rows.Scan(&city.Id, &city.Name, &city.Country); err != nil {
-				panic(err)
-			}
-			cities = append(cities, city)
-		}
-		if err := rows.Err(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, r, err)
 			return
 		}
 
@@ -43,67 +67,18 @@ func Cities(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 
-		_, err := database.IsUserLoggedIn(r)
-		if err != nil {
-			switch err {
-			case database.ErrNoCookie:
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-
-			case database.ErrUnauthorized:
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-
-			default:
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
-
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		city, e := h.decodeCity(r)
+		if e != nil {
+			writeError(w, e)
 			return
 		}
 
-		var city CityJSON
-
-		switch mediaType {
-		case "application/json":
-			if err := json.NewDecoder(r.Body).Decode(&city); err != nil {
-				http.Error(w, "Invalid JSON", http.StatusBadRequest)
-				return
-			}
-
-		case "application/x-www-form-urlencoded":
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form", http.StatusBadRequest)
-				return
-			}
-			city.Name = r.Form.Get("name")
-			city.Country = r.Form.Get("country")
-
-		case "multipart/form-data":
-			if err := r.ParseMultipartForm(32 << 20); err != nil {
-				http.Error(w, "Invalid form", http.StatusBadRequest)
-				return
-			}
-			city.Name = r.Form.Get("name")
-			city.Country = r.Form.Get("country")
-		}
+		logger(r).Info("creating city", "name", city.Name, "country", city.Country)
 
-		if city.Name == "" || city.Country == "" {
-			http.Error(w, "Missing name or country", http.StatusBadRequest)
-			return
-		}
-
-		log.Printf("%+v\n", city)
-
-		err = database.Db.QueryRow("INSERT INTO city (name, country) VALUES ($1, $2) RETURNING *", city.Name, city.Country).Scan(&city.Id, &city.Name, &city.Country)
+		city, err := h.Store.Cities.Create(r.Context(), city)
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalError(w, r, err)
+			return
 		}
 
 		json.NewEncoder(w).Encode(city)
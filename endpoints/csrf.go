@@ -0,0 +1,81 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// csrfHeader carries the session's CSRF token on state changing requests
+const csrfHeader = "X-CSRF-Token"
+
+var errCSRF = &Error{Status: http.StatusForbidden, Code: "csrf_token_invalid", Message: "Missing or invalid CSRF token"}
+
+// randomToken returns size random bytes, base64url encoded
+func randomToken(size int) (string, error) {
+	bytes := make([]byte, size)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// VerifyCSRF rejects state changing requests made with a session cookie
+// unless they carry the session's token in the X-CSRF-Token header, which
+// other sites can neither read nor set. Anonymous requests have nothing to
+// forge and go through, and so do API tokens which browsers never send on
+// their own.
+func (h *Handler) VerifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, ok := IdentityFromContext(r.Context())
+		if !ok || identity.ViaToken() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := identity.Session.CsrfToken
+		token := r.Header.Get(csrfHeader)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			logger(r).Warn("rejected request without a valid CSRF token")
+			writeError(w, errCSRF)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CsrfToken returns the current session's CSRF token, issuing one for
+// sessions created before tokens existed
+func (h *Handler) CsrfToken(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	if identity.ViaToken() {
+		writeError(w, &Error{Status: http.StatusBadRequest, Code: "no_session", Message: "Requests made with an API token don't need a CSRF token"})
+		return
+	}
+
+	token := identity.Session.CsrfToken
+	if token == "" {
+		var err error
+		token, err = randomToken(32)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if err := h.Store.Sessions.SetCsrfToken(r.Context(), identity.Session.Session_id, token); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		CsrfToken string `json:"csrfToken"`
+	}{token})
+}
@@ -0,0 +1,52 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"quickstart/database"
+)
+
+func TestVerifyCSRF(t *testing.T) {
+	h, _ := newTestHandler(t)
+	user := database.User{Id: 1, Username: "alice"}
+	session := Identity{User: user, Session: database.Session{User_id: user.Id, Session_id: "test-session", CsrfToken: "the-token"}}
+	legacySession := Identity{User: user, Session: database.Session{User_id: user.Id, Session_id: "old-session"}}
+	token := Identity{User: user, Token: database.APIToken{Id: 1, UserId: user.Id}}
+
+	cases := []struct {
+		name     string
+		method   string
+		identity *Identity
+		header   string
+		want     int
+	}{
+		{"session without a token", "POST", &session, "", http.StatusForbidden},
+		{"session with a wrong token", "POST", &session, "not-the-token", http.StatusForbidden},
+		{"session with the token", "POST", &session, "the-token", http.StatusOK},
+		{"delete without a token", "DELETE", &session, "", http.StatusForbidden},
+		{"session created before tokens", "PUT", &legacySession, "", http.StatusForbidden},
+		{"get", "GET", &session, "", http.StatusOK},
+		{"head", "HEAD", &session, "", http.StatusOK},
+		{"options", "OPTIONS", &session, "", http.StatusOK},
+		{"anonymous", "POST", nil, "", http.StatusOK},
+		{"api token", "POST", &token, "", http.StatusOK},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/itinerary", nil)
+		if c.identity != nil {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, *c.identity))
+		}
+		if c.header != "" {
+			r.Header.Set(csrfHeader, c.header)
+		}
+		w := httptest.NewRecorder()
+		h.VerifyCSRF(next).ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
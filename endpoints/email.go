@@ -0,0 +1,224 @@
+package endpoints
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"quickstart/database"
+	"quickstart/mailer"
+)
+
+const maxEmailLength = 254
+
+var (
+	errInvalidVerificationToken = &Error{Status: http.StatusBadRequest, Code: "invalid_token", Message: "This verification link is invalid or has expired"}
+	errNoEmail                  = &Error{Status: http.StatusBadRequest, Code: "no_email", Message: "There is no email address on this account"}
+	errAlreadyVerified          = &Error{Status: http.StatusConflict, Code: "email_already_verified", Message: "This email address is already verified"}
+)
+
+// normalizeEmail returns the address lowercased, ok is false unless it's a
+// bare valid address
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email || len(email) > maxEmailLength {
+		return "", false
+	}
+	return strings.ToLower(email), true
+}
+
+// parseOptionalEmail accepts an empty address as no address
+func parseOptionalEmail(email string) (sql.NullString, bool) {
+	if strings.TrimSpace(email) == "" {
+		return sql.NullString{}, true
+	}
+	normalized, ok := normalizeEmail(email)
+	return sql.NullString{String: normalized, Valid: ok}, ok
+}
+
+// appLink returns a link to a page of the frontend
+func (h *Handler) appLink(path string, query url.Values) string {
+	return strings.TrimSuffix(h.Config.AppURL, "/") + path + "?" + query.Encode()
+}
+
+// issueToken stores a new one time token for the user and returns it, it's
+// the only time the plain token is known
+func (h *Handler) issueToken(r *http.Request, userId int, purpose string, ttl time.Duration) (string, error) {
+	plain, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = h.Store.Tokens.Create(r.Context(), database.OneTimeToken{
+		UserId:    userId,
+		Purpose:   purpose,
+		TokenHash: database.HashToken(plain),
+		ExpiresAt: h.now().Add(ttl),
+	})
+	return plain, err
+}
+
+func (h *Handler) sendEmailVerification(r *http.Request, user database.User) error {
+	plain, err := h.issueToken(r, user.Id, database.TokenEmailVerification, h.Config.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := h.appLink("/verify-email", url.Values{"token": {plain}})
+	return h.Mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email.String,
+		Subject: "Confirm your email address for Mytinerary",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening this link within %s:\n\n%s\n\n"+
+			"If you don't have a Mytinerary account you can ignore this email.\n",
+			user.Username, h.Config.EmailVerificationTTL, link),
+	})
+}
+
+// verifyNewEmail mails a verification link to a user who just set an email
+// address. The change is saved by now, so failing to send it is only
+// logged, the user can ask for another link.
+func (h *Handler) verifyNewEmail(r *http.Request, user database.User) {
+	if !user.Email.Valid {
+		return
+	}
+	if err := h.sendEmailVerification(r, user); err != nil {
+		logger(r).Error("sending email verification", "user_id", user.Id, "error", err)
+	}
+}
+
+type emailJSON struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// Email returns the current user's email address on GET, and changes it
+// on PUT after reauthenticating them, since password resets and magic
+// links go to that address. A new address gets a verification link and
+// the previous one, if verified, a notice. An empty address removes it.
+func (h *Handler) Email(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	user := identity.User
+
+	if r.Method == "PUT" {
+		var input struct {
+			reauthentication
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, errInvalidJSON)
+			return
+		}
+		email, ok := parseOptionalEmail(input.Email)
+		if !ok {
+			writeError(w, errValidation(map[string]string{"email": "Invalid email address"}))
+			return
+		}
+
+		if email != user.Email {
+			if !h.reauthenticate(w, r, identity, input.reauthentication) {
+				return
+			}
+			if err := h.Store.Users.SetEmail(r.Context(), user.Id, email); err != nil {
+				if err == database.ErrEmailTaken {
+					writeError(w, errEmailTaken)
+					return
+				}
+				writeInternalError(w, r, err)
+				return
+			}
+			previous := user
+			user.Email, user.EmailVerifiedAt = email, sql.NullTime{}
+
+			// links mailed to the previous address mustn't work anymore
+			for _, purpose := range []string{database.TokenEmailVerification, database.TokenPasswordReset, database.TokenMagicLink} {
+				if err := h.Store.Tokens.DeleteUnused(r.Context(), user.Id, purpose); err != nil {
+					writeInternalError(w, r, err)
+					return
+				}
+			}
+			logger(r).Info("email changed", "user_id", user.Id)
+			h.notifyEmailChanged(r, previous)
+			h.verifyNewEmail(r, user)
+		}
+	}
+
+	json.NewEncoder(w).Encode(emailJSON{Email: user.Email.String, Verified: user.EmailVerified()})
+}
+
+// notifyEmailChanged tells the previous verified address of a user that it
+// was replaced, so that a change they didn't make doesn't go unnoticed.
+// Like verifyNewEmail, failing to send it is only logged.
+func (h *Handler) notifyEmailChanged(r *http.Request, previous database.User) {
+	if !previous.EmailVerified() {
+		return
+	}
+	err := h.Mailer.Send(r.Context(), mailer.Message{
+		To:      previous.Email.String,
+		Subject: "Your Mytinerary email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address of your Mytinerary account was changed, this address won't be used anymore.\n\n"+
+			"If you didn't make this change, contact us right away.\n",
+			previous.Username),
+	})
+	if err != nil {
+		logger(r).Error("sending email change notice", "user_id", previous.Id, "error", err)
+	}
+}
+
+// ResendEmailVerification mails a new verification link to the current
+// user, invalidating the previous one
+func (h *Handler) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	switch {
+	case !identity.User.Email.Valid:
+		writeError(w, errNoEmail)
+		return
+	case identity.User.EmailVerified():
+		writeError(w, errAlreadyVerified)
+		return
+	}
+
+	if err := h.sendEmailVerification(r, identity.User); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail marks the email address a verification link was sent to as
+// verified. It doesn't need a session, the link may be opened anywhere.
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if input.Token == "" {
+		writeError(w, errValidation(map[string]string{"token": "Missing token"}))
+		return
+	}
+
+	now := h.now()
+	token, err := h.Store.Tokens.Consume(r.Context(), database.TokenEmailVerification, database.HashToken(input.Token), now)
+	if err == nil {
+		err = h.Store.Users.VerifyEmail(r.Context(), token.UserId, now)
+	}
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errInvalidVerificationToken)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	logger(r).Info("email verified", "user_id", token.UserId)
+	w.WriteHeader(http.StatusNoContent)
+}
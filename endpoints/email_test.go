@@ -0,0 +1,75 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"quickstart/mailer"
+)
+
+var mailedToken = regexp.MustCompile(`token=([\w-]+)`)
+
+// lastToken returns the token of the last link mailed to the address
+func lastToken(t *testing.T, mail *mailer.Memory, to string) string {
+	t.Helper()
+	messages := mail.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if match := mailedToken.FindStringSubmatch(messages[i].Body); messages[i].To == to && match != nil {
+			return match[1]
+		}
+	}
+	t.Fatalf("no link mailed to %s", to)
+	return ""
+}
+
+func TestChangeEmailNeedsReauthentication(t *testing.T) {
+	h, mail := newTestHandler(t)
+	ctx := context.Background()
+	user := createUser(t, h, "alice", "correct horse", "alice@example.com")
+	if err := h.Store.Users.VerifyEmail(ctx, user.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = h.Store.Users.Get(ctx, user.Id)
+
+	w := serve(h.Email, asUser(jsonRequest(t, "PUT", "/auth/email", map[string]string{"email": "mallory@example.com"}), user))
+	if w.Code != http.StatusForbidden || errorCode(t, w.Body.Bytes()) != "reauthentication_failed" {
+		t.Fatalf("session only: %d %s, want 403 reauthentication_failed", w.Code, w.Body)
+	}
+	if stored, _ := h.Store.Users.Get(ctx, user.Id); stored.Email.String != "alice@example.com" {
+		t.Fatalf("address changed to %q without reauthentication", stored.Email.String)
+	}
+
+	// a reset link mailed before the change
+	serve(h.RequestPasswordReset, jsonRequest(t, "POST", "/auth/password/reset", map[string]string{"email": "alice@example.com"}))
+	resetToken := lastToken(t, mail, "alice@example.com")
+
+	body := map[string]string{"email": "alice@example.org", "password": "correct horse"}
+	w = serve(h.Email, asUser(jsonRequest(t, "PUT", "/auth/email", body), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("with the password: %d %s", w.Code, w.Body)
+	}
+	stored, err := h.Store.Users.Get(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email.String != "alice@example.org" || stored.EmailVerified() {
+		t.Errorf("stored %q verified %v, want the new address unverified", stored.Email.String, stored.EmailVerified())
+	}
+
+	var notified, verification bool
+	for _, message := range mail.Messages() {
+		notified = notified || (message.To == "alice@example.com" && message.Subject == "Your Mytinerary email address was changed")
+		verification = verification || message.To == "alice@example.org"
+	}
+	if !notified || !verification {
+		t.Errorf("notice to the previous address %v, verification link to the new one %v", notified, verification)
+	}
+
+	w = serve(h.ResetPassword, jsonRequest(t, "POST", "/auth/password/reset/confirm", map[string]string{"token": resetToken, "password": "a long new password"}))
+	if w.Code == http.StatusNoContent {
+		t.Error("a reset link mailed to the previous address still works")
+	}
+}
@@ -0,0 +1,69 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error is the body of every error response, rendered as
+// application/problem+json (RFC 7807)
+type Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details maps each invalid field to what's wrong with it
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errInvalidJSON     = &Error{Status: http.StatusBadRequest, Code: "invalid_json", Message: "Request body is not valid JSON"}
+	errInvalidForm     = &Error{Status: http.StatusBadRequest, Code: "invalid_form", Message: "Request body is not a valid form"}
+	errContentType     = &Error{Status: http.StatusUnsupportedMediaType, Code: "unsupported_content_type", Message: "Unsupported Content-Type"}
+	errUnauthorized    = &Error{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "You need to be logged in"}
+	errForbidden       = &Error{Status: http.StatusForbidden, Code: "forbidden", Message: "You are not allowed to do this"}
+	errTokenScope      = &Error{Status: http.StatusForbidden, Code: "insufficient_scope", Message: "This API token's scopes don't allow this"}
+	errEmailUnverified = &Error{Status: http.StatusForbidden, Code: "email_unverified", Message: "You need to verify your email address first"}
+	errInternal        = &Error{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Something went wrong on our side"}
+)
+
+func errNotFound(what string) *Error {
+	return &Error{Status: http.StatusNotFound, Code: "not_found", Message: what + " not found"}
+}
+
+func errConflict(code string, message string) *Error {
+	return &Error{Status: http.StatusConflict, Code: code, Message: message}
+}
+
+// errValidation returns nil when there are no invalid fields
+func errValidation(details map[string]string) *Error {
+	if len(details) == 0 {
+		return nil
+	}
+	return &Error{Status: http.StatusBadRequest, Code: "validation_failed", Message: "Some fields are invalid", Details: details}
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// writeInternalError logs the underlying error, which is never sent to the client
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r).Error("internal error", "error", err)
+	writeError(w, errInternal)
+}
+
+// NotFound answers requests that don't match any route
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, &Error{Status: http.StatusNotFound, Code: "route_not_found", Message: "No such endpoint"})
+}
+
+// MethodNotAllowed answers requests to a route with a method it doesn't declare
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, &Error{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: r.Method + " is not allowed here"})
+}
@@ -0,0 +1,63 @@
+package endpoints
+
+import (
+	"fmt"
+	"quickstart/config"
+	"quickstart/database"
+	"quickstart/jobs"
+	"quickstart/mailer"
+	"quickstart/oidc"
+	"quickstart/passwords"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Handler holds the dependencies shared by every endpoint
+type Handler struct {
+	Config config.Config
+	Store  database.Stores
+	Jobs   *jobs.Scheduler
+	Mailer mailer.Mailer
+	// Passwords hashes with PASSWORD_HASHER, PasswordPolicy decides which
+	// new passwords are accepted
+	Passwords      passwords.Hasher
+	PasswordPolicy *passwords.Policy
+	// OIDC is nil unless OIDC_ISSUER is set
+	OIDC *oidc.Provider
+	// Clock is what two-factor codes, one time tokens and login throttles
+	// are checked against, time.Now when nil
+	Clock func() time.Time
+
+	// dummyHash is compared against when the user doesn't exist
+	dummyHash string
+}
+
+// New returns a Handler, it fails if the password hasher can't hash
+func New(cfg config.Config, store database.Stores, scheduler *jobs.Scheduler, mail mailer.Mailer, policy *passwords.Policy) (*Handler, error) {
+	h := &Handler{
+		Config:         cfg,
+		Store:          store,
+		Jobs:           scheduler,
+		Mailer:         mail,
+		Passwords:      passwords.NewHasher(cfg.Passwords),
+		PasswordPolicy: policy,
+	}
+	if cfg.OIDC.Enabled() {
+		h.OIDC = oidc.New(cfg.OIDC)
+	}
+
+	hash, err := h.hashPassword(uuid.New().String())
+	if err != nil {
+		return nil, fmt.Errorf("hashing the dummy password: %w", err)
+	}
+	h.dummyHash = hash
+	return h, nil
+}
+
+func (h *Handler) now() time.Time {
+	if h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,22 @@
+package endpoints
+
+import (
+	"testing"
+
+	"quickstart/config"
+	"quickstart/database"
+	"quickstart/mailer"
+	"quickstart/passwords"
+)
+
+func TestNewFailsWhenPasswordsCantBeHashed(t *testing.T) {
+	cfg := config.Default()
+	cfg.Passwords.BcryptCost = 32 // above bcrypt.MaxCost
+	policy, err := passwords.NewPolicy(cfg.Passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg, database.NewMemoryStores(), nil, mailer.NewMemory(), policy); err == nil {
+		t.Error("New succeeded with an unusable bcrypt cost")
+	}
+}
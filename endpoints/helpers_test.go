@@ -0,0 +1,80 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"quickstart/config"
+	"quickstart/database"
+	"quickstart/mailer"
+	"quickstart/passwords"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestHandler returns a Handler on memory stores that mails into the
+// returned mailer
+func newTestHandler(t *testing.T) (*Handler, *mailer.Memory) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Passwords.BcryptCost = bcrypt.MinCost
+	cfg.StaticDir = t.TempDir()
+	policy, err := passwords.NewPolicy(cfg.Passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := mailer.NewMemory()
+	h, err := New(cfg, database.NewMemoryStores(), nil, mail, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, mail
+}
+
+// createUser registers a user with the given password, and email address
+// when not empty
+func createUser(t *testing.T, h *Handler, username string, password string, email string) database.User {
+	t.Helper()
+	hash, err := h.hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := h.Store.Users.Create(context.Background(), database.User{
+		Username: username,
+		Password: hash,
+		Email:    sql.NullString{String: email, Valid: email != ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func jsonRequest(t *testing.T, method string, target string, body interface{}) *http.Request {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(encoded))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// asUser makes r look like it went through Authenticate with a session of user
+func asUser(r *http.Request, user database.User) *http.Request {
+	identity := Identity{User: user, Session: database.Session{User_id: user.Id, Session_id: "test-session"}}
+	return r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+}
+
+// serve calls fn and returns what it wrote
+func serve(fn func(http.ResponseWriter, *http.Request), r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	fn(w, r)
+	return w
+}
@@ -2,91 +2,205 @@ package endpoints
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 	"quickstart/database"
-
-	"github.com/lib/pq"
 )
 
+// itineraryFields are the editable fields of an itinerary, shared by
+// every endpoint that creates or updates one
+type itineraryFields struct {
+	Title      string          `json:"title"`
+	Duration   *int            `json:"duration"` // in minutes
+	Price      *database.Price `json:"price"`
+	Activities []string        `json:"activities"`
+	Hashtags   []string        `json:"hashtags"`
+}
+
+// validate returns what's wrong with each invalid field, empty if all are valid
+func (input itineraryFields) validate() map[string]string {
+	details := map[string]string{}
+	if input.Title == "" {
+		details["title"] = "Missing title"
+	}
+	if input.Duration == nil {
+		details["duration"] = "Missing duration"
+	} else if *input.Duration < 0 {
+		details["duration"] = "Duration can't be negative"
+	}
+	if input.Price == nil {
+		details["price"] = "Missing price"
+	} else if input.Price.Amount < 0 {
+		details["price"] = "Price can't be negative"
+	} else if input.Price.Amount > database.MaxAmount {
+		details["price"] = "Price can't be more than " + database.MaxAmount.String()
+	} else if !database.IsValidCurrency(input.Price.Currency) {
+		details["price"] = "Currency must be a 3 letter ISO 4217 code"
+	}
+	if len(input.Activities) == 0 {
+		details["activities"] = "Missing activities"
+	}
+	if len(input.Hashtags) > 3 {
+		details["hashtags"] = "Too many tags"
+	}
+	return details
+}
+
+// toItinerary must only be called after validate
+func (input itineraryFields) toItinerary() database.Itinerary {
+	return database.Itinerary{
+		Title:      input.Title,
+		Duration:   *input.Duration,
+		Price:      *input.Price,
+		Activities: input.Activities,
+		Hashtags:   input.Hashtags,
+	}
+}
+
+type authorJSON struct {
+	Id         int     `json:"id"`
+	ProfilePic *string `json:"profilePic"`
+}
+
+func newAuthorJSON(author database.Author) authorJSON {
+	res := authorJSON{Id: author.Id}
+	if author.ProfilePic.Valid {
+		res.ProfilePic = &author.ProfilePic.String
+	}
+	return res
+}
+
+// newContentAuthorJSON is null once the author deleted their account
+func newContentAuthorJSON(author database.Author) *authorJSON {
+	if author.Id == 0 {
+		return nil
+	}
+	res := newAuthorJSON(author)
+	return &res
+}
+
+type itineraryCommentJSON struct {
+	Id      int         `json:"id"`
+	Comment string      `json:"comment"`
+	Author  *authorJSON `json:"author"`
+}
+
+// itineraryJSON is the representation of an itinerary returned by every endpoint
+type itineraryJSON struct {
+	Id         int                    `json:"id"`
+	Title      string                 `json:"title"`
+	Duration   int                    `json:"duration"`
+	Price      database.Price         `json:"price"`
+	Activities []string               `json:"activities"`
+	Hashtags   []string               `json:"hashtags"`
+	CityId     int                    `json:"cityId"`
+	Creator    *authorJSON            `json:"creator"`
+	Comments   []itineraryCommentJSON `json:"comments"`
+}
+
+// newItineraryJSON picks the comments belonging to the itinerary out of comments
+func newItineraryJSON(itinerary database.Itinerary, comments []database.Comment) itineraryJSON {
+	res := itineraryJSON{
+		Id:         itinerary.Id,
+		Title:      itinerary.Title,
+		Duration:   itinerary.Duration,
+		Price:      itinerary.Price,
+		Activities: itinerary.Activities,
+		Hashtags:   itinerary.Hashtags,
+		CityId:     itinerary.CityId,
+		Creator:    newContentAuthorJSON(itinerary.Creator),
+		Comments:   []itineraryCommentJSON{},
+	}
+	if res.Activities == nil {
+		res.Activities = []string{}
+	}
+	if res.Hashtags == nil {
+		res.Hashtags = []string{}
+	}
+	for _, comment := range comments {
+		if comment.ItineraryId == itinerary.Id {
+			res.Comments = append(res.Comments, itineraryCommentJSON{
+				Id:      comment.Id,
+				Comment: comment.Content,
+				Author:  newContentAuthorJSON(comment.Author),
+			})
+		}
+	}
+	return res
+}
+
+// itineraryInput has no author, the creator is always the logged in user
 type itineraryInput struct {
-	CityId     *int     `json:"cityId"`
-	AuthorId   *int     `json:"authorId"`
-	Title      string   `json:"title"`
-	Duration   *int     `json:"duration"`
-	Price      *int     `json:"price"`
-	Tags       []string `json:"tags"`
-	Activities []string `json:"activities"`
+	CityId *int `json:"cityId"`
+	itineraryFields
+	Tags []string `json:"tags"`
 }
 
-func Itineraries(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+func (h *Handler) Itineraries(w http.ResponseWriter, r *http.Request) {
 	var input itineraryInput
 	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errInvalidJSON)
 		return
 	}
+	if input.Hashtags == nil {
+		input.Hashtags = input.Tags
+	}
 
 	// Validation
+	details := input.validate()
 	if input.CityId == nil {
-		http.Error(w, "Missing cityId", http.StatusBadRequest)
-		return
-	}
-	if input.AuthorId == nil {
-		http.Error(w, "Missing authorId", http.StatusBadRequest)
-		return
-	}
-	if input.Title == "" {
-		http.Error(w, "Missing title", http.StatusBadRequest)
-		return
+		details["cityId"] = "Missing cityId"
 	}
-	if input.Duration == nil {
-		http.Error(w, "Missing duration", http.StatusBadRequest)
-		return
+	if len(input.Hashtags) == 0 {
+		details["tags"] = "Missing tags"
 	}
-	if input.Price == nil {
-		http.Error(w, "Missing price", http.StatusBadRequest)
+	if e := errValidation(details); e != nil {
+		writeError(w, e)
 		return
 	}
-	if len(input.Tags) == 0 {
-		http.Error(w, "Missing tags", http.StatusBadRequest)
+
+	_, err = h.Store.Cities.Get(r.Context(), *input.CityId)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errValidation(map[string]string{"cityId": "Unknown cityId"}))
+			return
+		}
+		writeInternalError(w, r, err)
 		return
 	}
-	if len(input.Activities) == 0 {
-		http.Error(w, "Missing activities", http.StatusBadRequest)
+
+	itinerary := input.toItinerary()
+	itinerary.Creator.Id = currentUserId(r)
+	itinerary.CityId = *input.CityId
+	itinerary, err = h.Store.Itineraries.Create(r.Context(), itinerary)
+
+	if err != nil {
+		writeInternalError(w, r, err)
 		return
 	}
 
-	if len(input.Tags) > 3 {
-		http.Error(w, "Too many tags", http.StatusBadRequest)
+	h.writeItinerary(w, r, itinerary.Id, http.StatusCreated)
+}
+
+// writeItinerary responds with the stored itinerary and its comments
+func (h *Handler) writeItinerary(w http.ResponseWriter, r *http.Request, itineraryId int, status int) {
+	itinerary, err := h.Store.Itineraries.Get(r.Context(), itineraryId)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("Itinerary"))
+			return
+		}
+		writeInternalError(w, r, err)
 		return
 	}
 
-	_, err = database.Db.Exec(`
-	INSERT INTO itinerary (
-        title,
-        creator,
-        time,
-        price,
-        activities,
-        hashtags,
-        city_id
-    )
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
-`,
-		input.Title,
-		input.AuthorId,
-		input.Duration,
-		input.Price,
-		pq.Array(input.Activities),
-		pq.Array(input.Tags),
-		input.CityId)
-
+	comments, err := h.Store.Comments.ListByItineraries(r.Context(), []int{itineraryId})
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newItineraryJSON(itinerary, comments))
 }
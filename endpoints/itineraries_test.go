@@ -0,0 +1,33 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestItineraryPriceValidation(t *testing.T) {
+	cases := []struct {
+		price string
+		ok    bool
+	}{
+		{`12.5`, true},
+		{`0`, true},
+		{`{"amount": 9999999999.99, "currency": "EUR"}`, true},
+		{`{"amount": 10000000000, "currency": "EUR"}`, false},
+		{`{"amount": 99999999999999.99, "currency": "EUR"}`, false},
+		{`-0.01`, false},
+		{`{"amount": 5, "currency": "eur"}`, false},
+		{`{"amount": 5, "currency": "EURO"}`, false},
+	}
+	for _, c := range cases {
+		var input itineraryFields
+		body := `{"title": "Trams", "duration": 60, "activities": ["Tram 28"], "price": ` + c.price + `}`
+		if err := json.Unmarshal([]byte(body), &input); err != nil {
+			t.Fatalf("%s: %v", c.price, err)
+		}
+		problems := input.validate()
+		if _, invalid := problems["price"]; invalid == c.ok || len(problems) > 1 {
+			t.Errorf("%s: problems %v", c.price, problems)
+		}
+	}
+}
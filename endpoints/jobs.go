@@ -0,0 +1,42 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type jobStatsJSON struct {
+	Name           string     `json:"name"`
+	Interval       string     `json:"interval"`
+	Runs           int64      `json:"runs"`
+	Failures       int64      `json:"failures"`
+	Skipped        int64      `json:"skipped"`
+	LastRun        *time.Time `json:"lastRun,omitempty"`
+	LastDurationMs int64      `json:"lastDurationMs"`
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// JobStats lists the background jobs with their counters on this instance
+func (h *Handler) JobStats(w http.ResponseWriter, r *http.Request) {
+	stats := []jobStatsJSON{}
+	if h.Jobs != nil {
+		for _, stat := range h.Jobs.Stats() {
+			job := jobStatsJSON{
+				Name:           stat.Name,
+				Interval:       stat.Interval.String(),
+				Runs:           stat.Runs,
+				Failures:       stat.Failures,
+				Skipped:        stat.Skipped,
+				LastDurationMs: stat.LastDuration.Milliseconds(),
+				LastError:      stat.LastError,
+			}
+			if !stat.LastRun.IsZero() {
+				lastRun := stat.LastRun
+				job.LastRun = &lastRun
+			}
+			stats = append(stats, job)
+		}
+	}
+	json.NewEncoder(w).Encode(stats)
+}
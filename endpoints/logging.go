@@ -0,0 +1,127 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"quickstart/logging"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+// logger returns the logger scoped to the request, tagged with its request id
+func logger(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context())
+}
+
+// requestLog collects what the access log line needs while the request
+// goes through the router
+type requestLog struct {
+	route  string
+	userId int
+}
+
+type requestLogKey struct{}
+
+// statusRecorder remembers what was written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// validRequestId accepts ids set by a proxy as long as they can't be used
+// to inject anything into the logs
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestLogger assigns every request an id, propagated from X-Request-ID
+// when the client sent one, puts a logger tagged with it in the request
+// context and writes an access log line once the request is done
+func RequestLogger(base *logging.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			requestId := r.Header.Get(requestIdHeader)
+			if !validRequestId(requestId) {
+				requestId = uuid.New().String()
+			}
+			w.Header().Set(requestIdHeader, requestId)
+
+			info := &requestLog{}
+			requestLogger := base.With("request_id", requestId)
+			ctx := logging.NewContext(r.Context(), requestLogger)
+			ctx = context.WithValue(ctx, requestLogKey{}, info)
+
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			fields := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"route", info.route,
+				"status", recorder.status,
+				"bytes", recorder.bytes,
+				"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"remote_addr", r.RemoteAddr,
+			}
+			if info.userId != 0 {
+				fields = append(fields, "user_id", info.userId)
+			}
+			requestLogger.Info("request", fields...)
+		})
+	}
+}
+
+// TagRoute records the matched route template (e.g. /cities/{cityId}) for
+// the access log, it has to run inside the router
+func TagRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.route, _ = route.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tagUser adds the authenticated user to the access log and request logger
+func tagUser(r *http.Request, userId int) *http.Request {
+	if info, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		info.userId = userId
+	}
+	return r.WithContext(logging.NewContext(r.Context(), logger(r).With("user_id", userId)))
+}
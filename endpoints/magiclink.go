@@ -0,0 +1,124 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"quickstart/database"
+	"quickstart/mailer"
+)
+
+var errInvalidMagicLink = &Error{Status: http.StatusUnauthorized, Code: "invalid_token", Message: "This login link is invalid, expired or was already used"}
+
+// RequestMagicLink mails a login link to the account with the given
+// verified email address. Like RequestPasswordReset it answers 202 either
+// way, and it sends at most MagicLinkLimit links per MagicLinkWindow to an
+// address so that it can't be used to flood someone's inbox.
+func (h *Handler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	email, ok := normalizeEmail(input.Email)
+	if !ok {
+		writeError(w, errValidation(map[string]string{"email": "Invalid email address"}))
+		return
+	}
+
+	// counted whether the address has an account or not, so that the
+	// answer doesn't tell
+	now := h.now()
+	throttle, err := h.Store.Throttles.RecordFailure(r.Context(), "magic:"+email, now, now.Add(-h.Config.MagicLinkWindow))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if throttle.Failures > h.Config.MagicLinkLimit {
+		logger(r).Info("login link rate limited", "requests", throttle.Failures)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	user, err := h.Store.Users.GetByEmail(r.Context(), email)
+	switch {
+	case err == database.ErrNotFound:
+		logger(r).Info("login link for an unknown email")
+	case err != nil:
+		writeInternalError(w, r, err)
+		return
+	case !user.EmailVerified():
+		// whoever typed this address may not be the one reading it
+		logger(r).Info("login link for an unverified email", "user_id", user.Id)
+	default:
+		if err := h.sendMagicLink(r, user); err != nil {
+			logger(r).Error("sending login link", "user_id", user.Id, "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) sendMagicLink(r *http.Request, user database.User) error {
+	plain, err := h.issueToken(r, user.Id, database.TokenMagicLink, h.Config.MagicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	link := h.appLink("/magic-login", url.Values{"token": {plain}})
+	return h.Mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email.String,
+		Subject: "Your Mytinerary login link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within %s to log in to Mytinerary:\n\n%s\n\n"+
+			"The link works once. If you didn't ask for it you can ignore this email.\n",
+			user.Username, h.Config.MagicLinkTTL, link),
+	})
+}
+
+// MagicLinkLogin exchanges a login link's token for a session, as Login
+// does for a password. Users with 2FA still have to give a code.
+func (h *Handler) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token      string `json:"token"`
+		RememberMe bool   `json:"rememberMe"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if input.Token == "" {
+		writeError(w, errValidation(map[string]string{"token": "Missing token"}))
+		return
+	}
+
+	token, err := h.Store.Tokens.Consume(r.Context(), database.TokenMagicLink, database.HashToken(input.Token), h.now())
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errInvalidMagicLink)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	user, err := h.Store.Users.Get(r.Context(), token.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), user.Id)
+	if err != nil && err != database.ErrNotFound {
+		writeInternalError(w, r, err)
+		return
+	}
+	if enrollment.Enabled() {
+		h.requireSecondFactor(w, r, user)
+		return
+	}
+
+	logger(r).Info("login link used", "user_id", user.Id)
+	h.completeLogin(w, r, user, h.loginKeys(r, user.Username)[0].key, input.RememberMe)
+}
@@ -0,0 +1,135 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"quickstart/mailer"
+)
+
+func requestMagicLink(t *testing.T, h *Handler, email string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(h.RequestMagicLink, jsonRequest(t, "POST", "/auth/magic-link", map[string]string{"email": email}))
+}
+
+// mailedTo counts the messages sent to the address
+func mailedTo(mail *mailer.Memory, to string) int {
+	count := 0
+	for _, message := range mail.Messages() {
+		if message.To == to {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRequestMagicLinkAlwaysAccepts(t *testing.T) {
+	h, mail := newTestHandler(t)
+	createUser(t, h, "unverified", "correct horse", "unverified@example.com")
+	verified := createUser(t, h, "verified", "correct horse", "verified@example.com")
+	if err := h.Store.Users.VerifyEmail(context.Background(), verified.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"unknown@example.com", "unverified@example.com", "verified@example.com", "Verified@Example.com"} {
+		w := requestMagicLink(t, h, email)
+		if w.Code != http.StatusAccepted || w.Body.Len() != 0 {
+			t.Errorf("%s: %d %q, want an empty 202", email, w.Code, w.Body)
+		}
+	}
+
+	messages := mail.Messages()
+	if len(messages) != 2 || messages[0].To != "verified@example.com" || messages[1].To != "verified@example.com" {
+		t.Errorf("mailed %+v, want two links to the verified address", messages)
+	}
+
+	if w := requestMagicLink(t, h, "not an address"); w.Code != http.StatusBadRequest || errorCode(t, w.Body.Bytes()) != "validation_failed" {
+		t.Errorf("invalid address: %d %s, want a validation error", w.Code, w.Body)
+	}
+}
+
+func TestRequestMagicLinkLimit(t *testing.T) {
+	h, mail := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	for _, username := range []string{"alice", "bob"} {
+		user := createUser(t, h, username, "correct horse", username+"@example.com")
+		if err := h.Store.Users.VerifyEmail(context.Background(), user.Id, *now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(email string) {
+		t.Helper()
+		if w := requestMagicLink(t, h, email); w.Code != http.StatusAccepted {
+			t.Fatalf("%s: %d %s, want 202", email, w.Code, w.Body)
+		}
+	}
+
+	for i := 0; i < h.Config.MagicLinkLimit+2; i++ {
+		*now = now.Add(time.Minute)
+		request("alice@example.com")
+	}
+	if got := mailedTo(mail, "alice@example.com"); got != h.Config.MagicLinkLimit {
+		t.Fatalf("%d links mailed, want the limit of %d", got, h.Config.MagicLinkLimit)
+	}
+
+	// other addresses have their own count, however the limited one is spelled
+	request("bob@example.com")
+	request("ALICE@example.com")
+	if mailedTo(mail, "bob@example.com") != 1 || mailedTo(mail, "alice@example.com") != h.Config.MagicLinkLimit {
+		t.Errorf("mailed %+v, want one more link, to bob", mail.Messages())
+	}
+
+	// asking again within the window keeps the address limited
+	*now = now.Add(h.Config.MagicLinkWindow - time.Second)
+	request("alice@example.com")
+	*now = now.Add(h.Config.MagicLinkWindow - time.Second)
+	request("alice@example.com")
+	if got := mailedTo(mail, "alice@example.com"); got != h.Config.MagicLinkLimit {
+		t.Errorf("%d links mailed within the window, want %d", got, h.Config.MagicLinkLimit)
+	}
+
+	*now = now.Add(h.Config.MagicLinkWindow + time.Second)
+	request("alice@example.com")
+	if got := mailedTo(mail, "alice@example.com"); got != h.Config.MagicLinkLimit+1 {
+		t.Errorf("%d links mailed after a quiet window, want %d", got, h.Config.MagicLinkLimit+1)
+	}
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	h, mail := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	user := createUser(t, h, "alice", "correct horse", "alice@example.com")
+	if err := h.Store.Users.VerifyEmail(context.Background(), user.Id, *now); err != nil {
+		t.Fatal(err)
+	}
+	login := func(token string) *httptest.ResponseRecorder {
+		return serve(h.MagicLinkLogin, jsonRequest(t, "POST", "/auth/magic-link/login", map[string]string{"token": token}))
+	}
+
+	requestMagicLink(t, h, "alice@example.com")
+	token := lastToken(t, mail, "alice@example.com")
+	w := login(token)
+	if w.Code != http.StatusOK || sessionCookie(w) == nil {
+		t.Fatalf("login: %d %s, want 200 with a session", w.Code, w.Body)
+	}
+	if w := login(token); w.Code != http.StatusUnauthorized || errorCode(t, w.Body.Bytes()) != "invalid_token" {
+		t.Errorf("second use: %d %s, want invalid_token", w.Code, w.Body)
+	}
+
+	requestMagicLink(t, h, "alice@example.com")
+	*now = now.Add(h.Config.MagicLinkTTL + time.Second)
+	if w := login(lastToken(t, mail, "alice@example.com")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired link: %d %s, want 401", w.Code, w.Body)
+	}
+
+	sessions, err := h.Store.Sessions.ListByUser(context.Background(), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("%d sessions, want the one from the first link", len(sessions))
+	}
+}
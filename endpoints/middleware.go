@@ -0,0 +1,199 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"quickstart/database"
+	"runtime/debug"
+)
+
+// Identity is the authenticated user making the request, through either
+// a session or an API token
+type Identity struct {
+	User    database.User
+	Session database.Session
+	Token   database.APIToken
+}
+
+func (i Identity) ViaToken() bool {
+	return i.Token.Id != 0
+}
+
+type contextKey int
+
+const (
+	identityKey contextKey = iota
+	authErrorKey
+)
+
+// IdentityFromContext returns the identity placed in the context by
+// Authenticate, ok is false for anonymous requests
+func IdentityFromContext(ctx context.Context) (identity Identity, ok bool) {
+	identity, ok = ctx.Value(identityKey).(Identity)
+	return
+}
+
+// currentUserId must only be used by handlers behind Authenticated or an
+// owner-only access level
+func currentUserId(r *http.Request) int {
+	identity, _ := IdentityFromContext(r.Context())
+	return identity.User.Id
+}
+
+// Authenticate resolves the API token or sid cookie once per request and
+// places the logged in user in the request context. Requests without valid
+// credentials carry on anonymously, it's up to Protect to reject them.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		login, err := database.IsUserLoggedIn(h.Store, h.sessionPolicy(), r)
+		switch err {
+		case nil:
+			if login.Renewed {
+				h.setSessionCookie(w, login.Session)
+			}
+			user, err := h.Store.Users.Get(r.Context(), login.UserId)
+			if err != nil {
+				logger(r).Error("loading the session's user", "error", err)
+				r = r.WithContext(context.WithValue(r.Context(), authErrorKey, err))
+				break
+			}
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, Identity{User: user, Session: login.Session, Token: login.Token}))
+			r = tagUser(r, user.Id)
+
+		case database.ErrNoCookie, database.ErrUnauthorized:
+			// anonymous
+
+		default:
+			r = r.WithContext(context.WithValue(r.Context(), authErrorKey, err))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Access is who is allowed to call a route
+type Access struct {
+	authenticated  bool
+	itineraryOwner bool
+	permission     Permission
+	// scope lets API tokens make non-GET requests to the route
+	scope Scope
+	// verifiedEmail is only enforced with REQUIRE_VERIFIED_EMAIL
+	verifiedEmail bool
+}
+
+var (
+	// Public routes can be called by anyone, logged in or not
+	Public = Access{}
+	// Authenticated routes require a logged in user
+	Authenticated = Access{authenticated: true}
+	// ItineraryOwner routes require the logged in user to be the creator
+	// of the itinerary in the {itineraryId} route variable, or a moderator
+	ItineraryOwner = Access{authenticated: true, itineraryOwner: true}
+)
+
+// Requires returns an access level for logged in users whose role grants
+// the permission. API tokens also need the admin scope.
+func Requires(permission Permission) Access {
+	return Access{authenticated: true, permission: permission}
+}
+
+// Scoped returns a copy of the access level that API tokens with the scope
+// can use to change things. Without it only sessions can.
+func (a Access) Scoped(scope Scope) Access {
+	a.scope = scope
+	return a
+}
+
+// VerifiedEmail returns a copy of the access level that, when the config
+// requires it, is denied to users who haven't verified an email address
+func (a Access) VerifiedEmail() Access {
+	a.verifiedEmail = true
+	return a
+}
+
+// Protect wraps fn so that it only runs for requests allowed by access.
+// Every route in main.go is declared through it.
+func (h *Handler) Protect(access Access, fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !access.authenticated {
+			fn(w, r)
+			return
+		}
+
+		// 401 when we don't know who is calling, 403 when we do but they
+		// aren't allowed to
+		identity, ok := IdentityFromContext(r.Context())
+		if !ok {
+			if err, ok := r.Context().Value(authErrorKey).(error); ok {
+				writeInternalError(w, r, err)
+				return
+			}
+			writeError(w, errUnauthorized)
+			return
+		}
+
+		if access.permission != "" && !HasPermission(identity.User.Role, access.permission) {
+			writeError(w, errForbidden)
+			return
+		}
+
+		if access.verifiedEmail && h.Config.RequireVerifiedEmail && !identity.User.EmailVerified() {
+			writeError(w, errEmailUnverified)
+			return
+		}
+
+		if identity.ViaToken() {
+			if scope := access.tokenScope(r); scope == "" || !identity.Token.HasScope(string(scope)) {
+				writeError(w, errTokenScope)
+				return
+			}
+		}
+
+		if access.itineraryOwner {
+			itineraryId, ok := pathId(r, "itineraryId")
+			if !ok {
+				writeError(w, errNotFound("Itinerary"))
+				return
+			}
+
+			// Check if itinerary belongs to the user
+			itinerary, err := h.Store.Itineraries.Get(r.Context(), itineraryId)
+			if err != nil {
+				if err == database.ErrNotFound {
+					writeError(w, errNotFound("Itinerary"))
+					return
+				}
+				writeInternalError(w, r, err)
+				return
+			}
+
+			if itinerary.Creator.Id != identity.User.Id && !HasPermission(identity.User.Role, ModerateItineraries) {
+				writeError(w, errForbidden)
+				return
+			}
+		}
+
+		fn(w, r)
+	}
+}
+
+// Recover turns a panicking request into a 500 response instead of letting
+// it take the whole server down
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// the client went away, let net/http deal with it
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logger(r).Error("panic", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+			writeError(w, errInternal)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
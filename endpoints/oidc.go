@@ -0,0 +1,381 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"quickstart/database"
+	"quickstart/oidc"
+)
+
+const (
+	oidcCookie = "oidc_auth"
+	// oidcFlowTTL is how long the user has to log in at the provider
+	oidcFlowTTL = 10 * time.Minute
+	// maxUsernameLength matches USERS.username
+	maxUsernameLength = 40
+)
+
+// oidcFlow is kept in a cookie while the user is at the provider
+type oidcFlow struct {
+	oidc.AuthRequest
+	RememberMe bool `json:"rememberMe"`
+	// Link adds the provider account to the logged in user instead of
+	// logging in
+	Link bool `json:"link"`
+}
+
+func (h *Handler) oidcFlowCookie(value string, maxAge int) *http.Cookie {
+	// always lax, the provider sends the user back with a cross-site
+	// redirect
+	return &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   h.Config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// redirectToApp ends a browser flow on a page of the frontend
+func (h *Handler) redirectToApp(w http.ResponseWriter, r *http.Request, path string, query url.Values) {
+	http.Redirect(w, r, h.appLink(path, query), http.StatusFound)
+}
+
+// oidcFailed sends the user back to the login page with an error code the
+// frontend can show
+func (h *Handler) oidcFailed(w http.ResponseWriter, r *http.Request, code string, err error) {
+	if err != nil {
+		logger(r).Error("oidc login", "code", code, "error", err)
+	} else {
+		logger(r).Info("oidc login", "code", code)
+	}
+	h.redirectToApp(w, r, "/login", url.Values{"error": {code}})
+}
+
+// OIDCLogin sends the browser to the OpenID Connect provider. With
+// ?link=true a logged in user adds the provider account to theirs instead.
+func (h *Handler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	flow := oidcFlow{
+		AuthRequest: req,
+		RememberMe:  r.URL.Query().Get("rememberMe") == "true",
+		Link:        r.URL.Query().Get("link") == "true",
+	}
+
+	authURL, err := h.OIDC.AuthURL(r.Context(), req)
+	if err != nil {
+		h.oidcFailed(w, r, "oidc_unavailable", err)
+		return
+	}
+
+	value, err := json.Marshal(flow)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	http.SetCookie(w, h.oidcFlowCookie(base64.RawURLEncoding.EncodeToString(value), int(oidcFlowTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the provider sends the user back. The provider
+// account logs in the user it's linked to, gets linked to the account with
+// the same verified email, or gets a new account.
+func (h *Handler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcCookie)
+	if err == nil {
+		var value []byte
+		if value, err = base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			err = json.Unmarshal(value, &flow)
+		}
+	}
+	if err != nil {
+		h.oidcFailed(w, r, "oidc_failed", fmt.Errorf("flow cookie: %w", err))
+		return
+	}
+	// the flow is single use whatever happens next
+	http.SetCookie(w, h.oidcFlowCookie("", -1))
+
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		h.oidcFailed(w, r, "oidc_failed", fmt.Errorf("state mismatch"))
+		return
+	}
+	if query.Get("error") != "" {
+		h.oidcFailed(w, r, "oidc_denied", fmt.Errorf("provider error %s: %s", query.Get("error"), query.Get("error_description")))
+		return
+	}
+
+	claims, err := h.OIDC.Exchange(r.Context(), query.Get("code"), flow.AuthRequest, h.now())
+	if err != nil {
+		h.oidcFailed(w, r, "oidc_failed", err)
+		return
+	}
+
+	if flow.Link {
+		h.linkIdentity(w, r, claims)
+		return
+	}
+
+	user, err := h.oidcUser(r, claims)
+	if err != nil {
+		h.oidcFailed(w, r, "oidc_failed", err)
+		return
+	}
+
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), user.Id)
+	if err != nil && err != database.ErrNotFound {
+		h.oidcFailed(w, r, "oidc_failed", err)
+		return
+	}
+	if enrollment.Enabled() {
+		// the frontend finishes with /auth/login/2fa like a password login
+		token, err := h.issueToken(r, user.Id, database.TokenLoginSecondFactor, secondFactorTTL)
+		if err != nil {
+			h.oidcFailed(w, r, "oidc_failed", err)
+			return
+		}
+		h.redirectToApp(w, r, "/login", url.Values{"twoFactorToken": {token}, "rememberMe": {fmt.Sprint(flow.RememberMe)}})
+		return
+	}
+
+	if _, err := h.startSession(w, r, user.Id, flow.RememberMe); err != nil {
+		h.oidcFailed(w, r, "oidc_failed", err)
+		return
+	}
+	logger(r).Info("oidc login", "user_id", user.Id)
+	http.Redirect(w, r, h.Config.AppURL, http.StatusFound)
+}
+
+// linkIdentity adds the provider account to the logged in user
+func (h *Handler) linkIdentity(w http.ResponseWriter, r *http.Request, claims oidc.Claims) {
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok || identity.ViaToken() {
+		h.oidcFailed(w, r, "not_logged_in", nil)
+		return
+	}
+
+	_, err := h.Store.Identities.Create(r.Context(), database.ExternalIdentity{
+		UserId:  identity.User.Id,
+		Issuer:  h.OIDC.Issuer(),
+		Subject: claims.Subject,
+		Email:   sql.NullString{String: claims.Email, Valid: claims.Email != ""},
+	})
+	if err != nil {
+		if err == database.ErrConflict {
+			h.oidcFailed(w, r, "identity_already_linked", nil)
+			return
+		}
+		h.oidcFailed(w, r, "oidc_failed", err)
+		return
+	}
+	logger(r).Info("oidc identity linked", "subject", claims.Subject)
+	h.redirectToApp(w, r, "/account", url.Values{"linked": {"oidc"}})
+}
+
+// oidcUser returns the user the provider account logs in
+func (h *Handler) oidcUser(r *http.Request, claims oidc.Claims) (database.User, error) {
+	issuer := h.OIDC.Issuer()
+	identity, err := h.Store.Identities.Get(r.Context(), issuer, claims.Subject)
+	if err == nil {
+		return h.Store.Users.Get(r.Context(), identity.UserId)
+	}
+	if err != database.ErrNotFound {
+		return database.User{}, err
+	}
+
+	// only a verified address on both sides proves it's the same person
+	email, emailOk := normalizeEmail(claims.Email)
+	emailOk = emailOk && claims.EmailVerified
+
+	var user database.User
+	if emailOk {
+		user, err = h.Store.Users.GetByEmail(r.Context(), email)
+		if err != nil && err != database.ErrNotFound {
+			return database.User{}, err
+		}
+		if err == nil && !user.EmailVerified() {
+			user = database.User{}
+		}
+	}
+	if user.Id == 0 {
+		if user, err = h.createOIDCUser(r, claims, email, emailOk); err != nil {
+			return database.User{}, err
+		}
+	}
+
+	_, err = h.Store.Identities.Create(r.Context(), database.ExternalIdentity{
+		UserId:  user.Id,
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		Email:   sql.NullString{String: claims.Email, Valid: claims.Email != ""},
+	})
+	if err == database.ErrConflict {
+		// linked by a concurrent login, use that link
+		identity, err = h.Store.Identities.Get(r.Context(), issuer, claims.Subject)
+		if err != nil {
+			return database.User{}, err
+		}
+		return h.Store.Users.Get(r.Context(), identity.UserId)
+	}
+	return user, err
+}
+
+// createOIDCUser creates the account of a first login through the
+// provider. It has no password, the user can set one with a password
+// reset.
+func (h *Handler) createOIDCUser(r *http.Request, claims oidc.Claims, email string, emailVerified bool) (database.User, error) {
+	base := usernameFrom(claims)
+	user := database.User{Username: base}
+	if emailVerified {
+		user.Email = sql.NullString{String: email, Valid: true}
+	}
+
+	for attempt := 0; ; attempt++ {
+		created, err := h.Store.Users.Create(r.Context(), user)
+		switch {
+		case err == nil:
+			if created.Email.Valid {
+				// the provider verified it already
+				created.EmailVerifiedAt = sql.NullTime{Time: h.now(), Valid: true}
+				if err := h.Store.Users.VerifyEmail(r.Context(), created.Id, created.EmailVerifiedAt.Time); err != nil {
+					return created, err
+				}
+			}
+			logger(r).Info("account created through oidc", "user_id", created.Id)
+			return created, nil
+
+		case err == database.ErrEmailTaken:
+			// an unverified account has it, don't take it away from it
+			user.Email = sql.NullString{}
+
+		case err == database.ErrConflict && attempt < 5:
+			suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return database.User{}, err
+			}
+			user.Username = fmt.Sprintf("%s-%04d", truncate(base, maxUsernameLength-5), suffix)
+
+		default:
+			return database.User{}, err
+		}
+	}
+}
+
+// usernameFrom picks a username out of the provider's claims
+func usernameFrom(claims oidc.Claims) string {
+	candidates := []string{claims.PreferredUsername, strings.SplitN(claims.Email, "@", 2)[0], claims.Name}
+	for _, candidate := range candidates {
+		var b strings.Builder
+		for _, c := range candidate {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+				b.WriteRune(c)
+			case c == ' ':
+				b.WriteRune('_')
+			}
+		}
+		if username := truncate(b.String(), maxUsernameLength); username != "" {
+			return username
+		}
+	}
+	return "traveller"
+}
+
+type identityJSON struct {
+	Id        int       `json:"id"`
+	Issuer    string    `json:"issuer"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Identities lists the provider accounts linked to the current user
+func (h *Handler) Identities(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	identities, err := h.Store.Identities.ListByUser(r.Context(), identity.User.Id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	result := make([]identityJSON, 0, len(identities))
+	for _, linked := range identities {
+		result = append(result, identityJSON{
+			Id:        linked.Id,
+			Issuer:    linked.Issuer,
+			Email:     linked.Email.String,
+			CreatedAt: linked.CreatedAt,
+		})
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+var errLastLoginMethod = errConflict("last_login_method", "Set a password before removing your only way to log in")
+
+// loginMethods counts the password, linked provider accounts and passkeys
+// the user can log in with. Login links aren't counted, they need a
+// verified email the user may lose.
+func (h *Handler) loginMethods(r *http.Request, user database.User) (int, error) {
+	identities, err := h.Store.Identities.ListByUser(r.Context(), user.Id)
+	if err != nil {
+		return 0, err
+	}
+	passkeys, err := h.Store.Passkeys.ListByUser(r.Context(), user.Id)
+	if err != nil {
+		return 0, err
+	}
+	methods := len(identities) + len(passkeys)
+	if user.Password != "" {
+		methods++
+	}
+	return methods, nil
+}
+
+// ExternalIdentity unlinks a provider account from the current user, unless
+// it's the only way they can log in
+func (h *Handler) ExternalIdentity(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	id, ok := pathId(r, "identityId")
+	if !ok {
+		writeError(w, errNotFound("Identity"))
+		return
+	}
+
+	methods, err := h.loginMethods(r, identity.User)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if methods <= 1 {
+		writeError(w, errLastLoginMethod)
+		return
+	}
+
+	err = h.Store.Identities.DeleteForUser(r.Context(), identity.User.Id, id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("Identity"))
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"quickstart/database"
+	"quickstart/oidc"
+	"quickstart/oidc/oidctest"
+)
+
+func newOIDCTestHandler(t *testing.T) (*Handler, *oidctest.Issuer) {
+	t.Helper()
+	h, _ := newTestHandler(t)
+	issuer := oidctest.NewIssuer("mytinerary")
+	t.Cleanup(issuer.Close)
+	h.Config.OIDC.Issuer = issuer.URL
+	h.Config.OIDC.ClientID = issuer.ClientID
+	h.Config.OIDC.RedirectURL = "http://localhost:8001/auth/oidc/callback"
+	h.OIDC = oidc.New(h.Config.OIDC)
+	return h, issuer
+}
+
+// oidcLogin goes through OIDCLogin, the provider and OIDCCallback.
+// changeFlow, when not nil, alters the flow cookie the browser sends back.
+func oidcLogin(t *testing.T, h *Handler, issuer *oidctest.Issuer, subject string, claims oidctest.Claims, changeFlow func(*oidcFlow)) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serve(h.OIDCLogin, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var flowCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcCookie {
+			flowCookie = cookie
+		}
+	}
+	if flowCookie == nil {
+		t.Fatal("login set no flow cookie")
+	}
+	if changeFlow != nil {
+		var flow oidcFlow
+		value, _ := base64.RawURLEncoding.DecodeString(flowCookie.Value)
+		if err := json.Unmarshal(value, &flow); err != nil {
+			t.Fatal(err)
+		}
+		changeFlow(&flow)
+		value, _ = json.Marshal(flow)
+		flowCookie.Value = base64.RawURLEncoding.EncodeToString(value)
+	}
+
+	callback, err := issuer.Authorize(w.Header().Get("Location"), subject, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", callback, nil)
+	r.AddCookie(flowCookie)
+	return serve(h.OIDCCallback, r)
+}
+
+// loggedInUser returns the user the response started a session for, 0 if
+// none
+func loggedInUser(t *testing.T, h *Handler, w *httptest.ResponseRecorder) int {
+	t.Helper()
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		return 0
+	}
+	session, err := h.Store.Sessions.Get(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.User_id
+}
+
+func oidcError(w *httptest.ResponseRecorder) string {
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		return ""
+	}
+	return location.Query().Get("error")
+}
+
+func TestOIDCLoginCreatesAccount(t *testing.T) {
+	h, issuer := newOIDCTestHandler(t)
+	ctx := context.Background()
+	claims := oidctest.Claims{"email": "Alice@Example.com", "email_verified": true, "preferred_username": "alice"}
+
+	w := oidcLogin(t, h, issuer, "subject-1", claims, nil)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != h.Config.AppURL {
+		t.Fatalf("callback: %d to %q, want a redirect to the app", w.Code, w.Header().Get("Location"))
+	}
+	user, err := h.Store.Users.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatalf("no account created: %v", err)
+	}
+	if user.Password != "" || user.Email.String != "alice@example.com" || !user.EmailVerified() {
+		t.Errorf("created %+v, want no password and a verified email", user)
+	}
+	if id := loggedInUser(t, h, w); id != user.Id {
+		t.Errorf("session for user %d, want %d", id, user.Id)
+	}
+
+	// the next login finds the account through the linked identity
+	w = oidcLogin(t, h, issuer, "subject-1", claims, nil)
+	if id := loggedInUser(t, h, w); id != user.Id {
+		t.Errorf("second login: session for user %d, want %d", id, user.Id)
+	}
+	identities, err := h.Store.Identities.ListByUser(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].Subject != "subject-1" || identities[0].Issuer != issuer.URL {
+		t.Errorf("identities = %+v", identities)
+	}
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	h, issuer := newOIDCTestHandler(t)
+	ctx := context.Background()
+	verified := createUser(t, h, "bob", "correct horse", "bob@example.com")
+	if err := h.Store.Users.VerifyEmail(ctx, verified.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	unverified := createUser(t, h, "carol", "correct horse", "carol@example.com")
+
+	w := oidcLogin(t, h, issuer, "bob-at-provider", oidctest.Claims{"email": "bob@example.com", "email_verified": true}, nil)
+	if id := loggedInUser(t, h, w); id != verified.Id {
+		t.Errorf("verified email: session for user %d, want %d", id, verified.Id)
+	}
+
+	// an address nobody proved owning on our side isn't enough to take
+	// the account over
+	w = oidcLogin(t, h, issuer, "carol-at-provider", oidctest.Claims{"email": "carol@example.com", "email_verified": true}, nil)
+	if id := loggedInUser(t, h, w); id == 0 || id == unverified.Id {
+		t.Errorf("unverified email: session for user %d, want a new account", id)
+	}
+
+	// nor is an address the provider didn't verify
+	w = oidcLogin(t, h, issuer, "bob-again", oidctest.Claims{"email": "bob@example.com", "email_verified": false}, nil)
+	if id := loggedInUser(t, h, w); id == 0 || id == verified.Id {
+		t.Errorf("email unverified by the provider: session for user %d, want a new account", id)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	cases := map[string]struct {
+		claims     oidctest.Claims
+		changeFlow func(*oidcFlow)
+		issuedAt   time.Time
+	}{
+		"state mismatch":  {changeFlow: func(flow *oidcFlow) { flow.State = "forged" }},
+		"nonce mismatch":  {changeFlow: func(flow *oidcFlow) { flow.Nonce = "replayed" }},
+		"wrong verifier":  {changeFlow: func(flow *oidcFlow) { flow.Verifier = "not the one challenged" }},
+		"other issuer":    {claims: oidctest.Claims{"iss": "https://evil.example.com"}},
+		"other audience":  {claims: oidctest.Claims{"aud": "someone-else"}},
+		"expired token":   {issuedAt: time.Now().Add(-3 * time.Hour)},
+		"missing subject": {claims: oidctest.Claims{"sub": ""}},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			h, issuer := newOIDCTestHandler(t)
+			if !c.issuedAt.IsZero() {
+				issuer.Now = func() time.Time { return c.issuedAt }
+			}
+			w := oidcLogin(t, h, issuer, "subject-1", c.claims, c.changeFlow)
+			if oidcError(w) != "oidc_failed" {
+				t.Errorf("redirected to %q, want error=oidc_failed", w.Header().Get("Location"))
+			}
+			if id := loggedInUser(t, h, w); id != 0 {
+				t.Errorf("session started for user %d", id)
+			}
+			if _, err := h.Store.Identities.Get(context.Background(), issuer.URL, "subject-1"); err != database.ErrNotFound {
+				t.Errorf("identity lookup: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestOIDCLinkToLoggedInUser(t *testing.T) {
+	h, issuer := newOIDCTestHandler(t)
+	user := createUser(t, h, "dave", "correct horse", "")
+
+	w := serve(h.OIDCLogin, httptest.NewRequest("GET", "/auth/oidc/login?link=true", nil))
+	callback, err := issuer.Authorize(w.Header().Get("Location"), "dave-at-provider", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := asUser(httptest.NewRequest("GET", callback, nil), user)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = serve(h.OIDCCallback, r)
+	if oidcError(w) != "" {
+		t.Fatalf("link failed: %s", w.Header().Get("Location"))
+	}
+
+	identity, err := h.Store.Identities.Get(context.Background(), issuer.URL, "dave-at-provider")
+	if err != nil || identity.UserId != user.Id {
+		t.Errorf("identity = %+v, %v, want linked to user %d", identity, err, user.Id)
+	}
+}
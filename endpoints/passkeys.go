@@ -0,0 +1,458 @@
+package endpoints
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"quickstart/database"
+	"quickstart/webauthn"
+)
+
+const (
+	// passkeyChallengeTTL is how long the browser has to answer a challenge,
+	// it's also the timeout the options give the browser
+	passkeyChallengeTTL   = 5 * time.Minute
+	maxPasskeyNameLength  = 100
+	defaultPasskeyName    = "Passkey"
+	passkeyCredentialType = "public-key"
+)
+
+var (
+	errInvalidPasskey      = &Error{Status: http.StatusUnauthorized, Code: "invalid_passkey", Message: "The passkey couldn't be verified"}
+	errPasskeyRegistration = &Error{Status: http.StatusBadRequest, Code: "invalid_passkey", Message: "The passkey couldn't be verified, try again"}
+	errPasskeyChallenge    = &Error{Status: http.StatusBadRequest, Code: "invalid_challenge", Message: "This passkey request has expired, try again"}
+	errPasskeyTaken        = errConflict("passkey_already_registered", "This passkey is already registered")
+)
+
+func (h *Handler) relyingParty() webauthn.RelyingParty {
+	return webauthn.RelyingParty{
+		ID:      h.Config.WebAuthnRPID(),
+		Name:    h.Config.WebAuthn.RPName,
+		Origins: h.Config.WebAuthnOrigins(),
+	}
+}
+
+// userHandle is the id the authenticator keeps for the user, it's handed
+// back on login
+func userHandle(userId int) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userId))
+	return handle
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newPasskeyChallenge stores a fresh challenge, userId is 0 for logins
+func (h *Handler) newPasskeyChallenge(r *http.Request, userId int, purpose string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	encoded := encodeBase64(challenge)
+	err = h.Store.Passkeys.CreateChallenge(r.Context(), database.PasskeyChallenge{
+		Hash:      database.HashToken(encoded),
+		UserId:    userId,
+		Purpose:   purpose,
+		ExpiresAt: h.now().Add(passkeyChallengeTTL),
+	})
+	return encoded, err
+}
+
+// consumePasskeyChallenge finds the challenge the browser answered, it
+// can't be answered again
+func (h *Handler) consumePasskeyChallenge(r *http.Request, clientDataJSON []byte, purpose string) (database.PasskeyChallenge, []byte, error) {
+	clientData, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		return database.PasskeyChallenge{}, nil, err
+	}
+	challenge, err := clientData.ChallengeBytes()
+	if err != nil {
+		return database.PasskeyChallenge{}, nil, err
+	}
+	stored, err := h.Store.Passkeys.ConsumeChallenge(r.Context(), purpose, database.HashToken(encodeBase64(challenge)), h.now())
+	return stored, challenge, err
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type passkeyJSON struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+func newPasskeyJSON(passkey database.Passkey) passkeyJSON {
+	result := passkeyJSON{Id: passkey.Id, Name: passkey.Name, CreatedAt: passkey.CreatedAt}
+	if passkey.LastUsedAt.Valid {
+		result.LastUsedAt = &passkey.LastUsedAt.Time
+	}
+	return result
+}
+
+// credentialJSON is a PublicKeyCredential as the browser's toJSON()
+// serializes it, binary values are base64url encoded
+type credentialJSON struct {
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// decodeAll returns the binary values, or nil when one is missing or invalid
+func decodeAll(values ...string) [][]byte {
+	decoded := make([][]byte, len(values))
+	for i, value := range values {
+		b, err := webauthn.DecodeBase64(value)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		decoded[i] = b
+	}
+	return decoded
+}
+
+var errMalformedCredential = errValidation(map[string]string{"credential": "Malformed credential"})
+
+// PasskeyRegistrationOptions starts registering a passkey for the current
+// user after reauthenticating them, since a passkey can skip the second
+// factor. The answer is the publicKey argument of
+// navigator.credentials.create() in its JSON form, as
+// PublicKeyCredential.parseCreationOptionsFromJSON() takes it.
+func (h *Handler) PasskeyRegistrationOptions(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	user := identity.User
+
+	var creds reauthentication
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if !h.reauthenticate(w, r, identity, creds) {
+		return
+	}
+
+	passkeys, err := h.Store.Passkeys.ListByUser(r.Context(), user.Id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	challenge, err := h.newPasskeyChallenge(r, user.Id, database.ChallengePasskeyRegistration)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	type credentialParameter struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	params := make([]credentialParameter, 0, len(webauthn.Algorithms))
+	for _, alg := range webauthn.Algorithms {
+		params = append(params, credentialParameter{passkeyCredentialType, alg})
+	}
+	// the authenticator refuses to register a second passkey for the same
+	// account
+	exclude := make([]credentialDescriptor, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		exclude = append(exclude, credentialDescriptor{passkeyCredentialType, encodeBase64(passkey.CredentialId)})
+	}
+	rp := h.relyingParty()
+
+	var options struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"rp"`
+		User struct {
+			Id          string `json:"id"`
+			Name        string `json:"name"`
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection struct {
+			ResidentKey      string `json:"residentKey"`
+			RequireResident  bool   `json:"requireResidentKey"`
+			UserVerification string `json:"userVerification"`
+		} `json:"authenticatorSelection"`
+		Attestation string `json:"attestation"`
+	}
+	options.Challenge = challenge
+	options.RP.Id = rp.ID
+	options.RP.Name = rp.Name
+	options.User.Id = encodeBase64(userHandle(user.Id))
+	options.User.Name = user.Username
+	options.User.DisplayName = user.Username
+	options.PubKeyCredParams = params
+	options.Timeout = passkeyChallengeTTL.Milliseconds()
+	options.ExcludeCredentials = exclude
+	// a discoverable credential logs in without typing the username
+	options.AuthenticatorSelection.ResidentKey = "required"
+	options.AuthenticatorSelection.RequireResident = true
+	options.AuthenticatorSelection.UserVerification = "preferred"
+	options.Attestation = "none"
+
+	json.NewEncoder(w).Encode(options)
+}
+
+// Passkeys lists the current user's passkeys on GET. POST finishes a
+// registration started with PasskeyRegistrationOptions, it takes the
+// credential navigator.credentials.create() returned and an optional name.
+func (h *Handler) Passkeys(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	switch r.Method {
+	case "GET":
+		passkeys, err := h.Store.Passkeys.ListByUser(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		result := make([]passkeyJSON, 0, len(passkeys))
+		for _, passkey := range passkeys {
+			result = append(result, newPasskeyJSON(passkey))
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case "POST":
+		var input struct {
+			Name       string         `json:"name"`
+			Credential credentialJSON `json:"credential"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, errInvalidJSON)
+			return
+		}
+		name := strings.TrimSpace(input.Name)
+		if name == "" {
+			name = defaultPasskeyName
+		}
+		if utf8.RuneCountInString(name) > maxPasskeyNameLength {
+			writeError(w, errValidation(map[string]string{"name": "Name is too long"}))
+			return
+		}
+		values := decodeAll(input.Credential.Response.ClientDataJSON, input.Credential.Response.AttestationObject)
+		if values == nil || input.Credential.Type != passkeyCredentialType {
+			writeError(w, errMalformedCredential)
+			return
+		}
+		clientDataJSON, attestationObject := values[0], values[1]
+
+		stored, challenge, err := h.consumePasskeyChallenge(r, clientDataJSON, database.ChallengePasskeyRegistration)
+		if err != nil || stored.UserId != identity.User.Id {
+			if err != nil && err != database.ErrNotFound && !isWebAuthnError(err) {
+				writeInternalError(w, r, err)
+				return
+			}
+			writeError(w, errPasskeyChallenge)
+			return
+		}
+
+		credential, err := h.relyingParty().VerifyRegistration(challenge, clientDataJSON, attestationObject, false)
+		if err != nil {
+			logger(r).Info("passkey registration failed", "error", err)
+			writeError(w, errPasskeyRegistration)
+			return
+		}
+
+		passkey, err := h.Store.Passkeys.Create(r.Context(), database.Passkey{
+			UserId:       identity.User.Id,
+			CredentialId: credential.ID,
+			PublicKey:    credential.PublicKey,
+			SignCount:    int64(credential.SignCount),
+			Name:         name,
+			CreatedAt:    h.now(),
+		})
+		if err != nil {
+			if err == database.ErrConflict {
+				writeError(w, errPasskeyTaken)
+				return
+			}
+			writeInternalError(w, r, err)
+			return
+		}
+		logger(r).Info("passkey registered", "passkey_id", passkey.Id)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newPasskeyJSON(passkey))
+	}
+}
+
+// Passkey removes one of the current user's passkeys, unless it's the only
+// way they can log in
+func (h *Handler) Passkey(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	id, ok := pathId(r, "passkeyId")
+	if !ok {
+		writeError(w, errNotFound("Passkey"))
+		return
+	}
+
+	methods, err := h.loginMethods(r, identity.User)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if methods <= 1 {
+		// only refused when it's theirs, other ids get the not found
+		passkeys, err := h.Store.Passkeys.ListByUser(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		for _, passkey := range passkeys {
+			if passkey.Id == id {
+				writeError(w, errLastLoginMethod)
+				return
+			}
+		}
+	}
+
+	err = h.Store.Passkeys.DeleteForUser(r.Context(), identity.User.Id, id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("Passkey"))
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	logger(r).Info("passkey removed", "passkey_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PasskeyLoginOptions starts a passkey login. The answer is the publicKey
+// argument of navigator.credentials.get() in its JSON form. No credentials
+// are listed, the browser offers the user the passkeys it has for this
+// site.
+func (h *Handler) PasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, err := h.newPasskeyChallenge(r, 0, database.ChallengePasskeyLogin)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Challenge        string                 `json:"challenge"`
+		RPId             string                 `json:"rpId"`
+		Timeout          int64                  `json:"timeout"`
+		AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+		UserVerification string                 `json:"userVerification"`
+	}{challenge, h.Config.WebAuthnRPID(), passkeyChallengeTTL.Milliseconds(), []credentialDescriptor{}, "preferred"})
+}
+
+// PasskeyLogin logs in with the credential navigator.credentials.get()
+// returned for a PasskeyLoginOptions challenge. A passkey that verified the
+// user, with a PIN or biometrics, is two factors by itself. Otherwise users
+// with 2FA still have to give a code.
+func (h *Handler) PasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Credential credentialJSON `json:"credential"`
+		RememberMe bool           `json:"rememberMe"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	response := input.Credential.Response
+	values := decodeAll(input.Credential.Id, response.ClientDataJSON, response.AuthenticatorData, response.Signature)
+	if values == nil || input.Credential.Type != passkeyCredentialType {
+		writeError(w, errMalformedCredential)
+		return
+	}
+	credentialId, assertion := values[0], webauthn.Assertion{
+		ClientDataJSON:    values[1],
+		AuthenticatorData: values[2],
+		Signature:         values[3],
+	}
+
+	_, challenge, err := h.consumePasskeyChallenge(r, assertion.ClientDataJSON, database.ChallengePasskeyLogin)
+	if err != nil {
+		if err != database.ErrNotFound && !isWebAuthnError(err) {
+			writeInternalError(w, r, err)
+			return
+		}
+		writeError(w, errPasskeyChallenge)
+		return
+	}
+
+	passkey, err := h.Store.Passkeys.GetByCredentialId(r.Context(), credentialId)
+	if err != nil {
+		if err == database.ErrNotFound {
+			logger(r).Info("passkey login with an unknown credential")
+			writeError(w, errInvalidPasskey)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	// discoverable credentials say whose they are, it has to be the owner
+	if response.UserHandle != "" {
+		handle, err := webauthn.DecodeBase64(response.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle(passkey.UserId)) {
+			logger(r).Info("passkey login with a mismatched user handle", "passkey_id", passkey.Id)
+			writeError(w, errInvalidPasskey)
+			return
+		}
+	}
+
+	result, err := h.relyingParty().VerifyAssertion(challenge, passkey.PublicKey, uint32(passkey.SignCount), assertion, false)
+	if err != nil {
+		if err == webauthn.ErrClonedAuthenticator {
+			logger(r).Warn("passkey signature counter went backwards, it may have been cloned", "passkey_id", passkey.Id, "user_id", passkey.UserId)
+		} else {
+			logger(r).Info("passkey login failed", "passkey_id", passkey.Id, "error", err)
+		}
+		writeError(w, errInvalidPasskey)
+		return
+	}
+	if err := h.Store.Passkeys.Use(r.Context(), passkey.Id, int64(result.SignCount), h.now()); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	user, err := h.Store.Users.Get(r.Context(), passkey.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	if !result.UserVerified {
+		enrollment, err := h.Store.TwoFactor.Get(r.Context(), user.Id)
+		if err != nil && err != database.ErrNotFound {
+			writeInternalError(w, r, err)
+			return
+		}
+		if enrollment.Enabled() {
+			h.requireSecondFactor(w, r, user)
+			return
+		}
+	}
+
+	logger(r).Info("passkey login", "user_id", user.Id, "passkey_id", passkey.Id)
+	h.completeLogin(w, r, user, h.loginKeys(r, user.Username)[0].key, input.RememberMe)
+}
+
+func isWebAuthnError(err error) bool {
+	return errors.Is(err, webauthn.ErrInvalidResponse)
+}
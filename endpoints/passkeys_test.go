@@ -0,0 +1,46 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPasskeyRegistrationNeedsReauthentication(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	user := createUser(t, h, "alice", "correct horse", "")
+	passwordless := createPasswordlessUser(t, h, "bob")
+	staleLogin := now.Add(-freshLoginTTL - time.Minute)
+
+	cases := []struct {
+		name       string
+		r          *http.Request
+		wantStatus int
+		wantCode   string
+	}{
+		{"session only", asUser(jsonRequest(t, "POST", "/auth/passkeys/register/options", map[string]string{}), user), http.StatusForbidden, "reauthentication_failed"},
+		{"wrong password", asUser(jsonRequest(t, "POST", "/auth/passkeys/register/options", map[string]string{"password": "wrong"}), user), http.StatusForbidden, "reauthentication_failed"},
+		{"password", asUser(jsonRequest(t, "POST", "/auth/passkeys/register/options", map[string]string{"password": "correct horse"}), user), http.StatusOK, ""},
+		{"no password, stale login", asUserSince(jsonRequest(t, "POST", "/auth/passkeys/register/options", map[string]string{}), passwordless, staleLogin), http.StatusForbidden, "reauthentication_required"},
+		{"no password, fresh login", asUserSince(jsonRequest(t, "POST", "/auth/passkeys/register/options", map[string]string{}), passwordless, *now), http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		w := serve(h.PasskeyRegistrationOptions, c.r)
+		if w.Code != c.wantStatus {
+			t.Errorf("%s: %d %s, want %d", c.name, w.Code, w.Body, c.wantStatus)
+			continue
+		}
+		if c.wantCode != "" {
+			if code := errorCode(t, w.Body.Bytes()); code != c.wantCode {
+				t.Errorf("%s: code %q, want %q", c.name, code, c.wantCode)
+			}
+			continue
+		}
+		var options struct{ Challenge string }
+		if err := json.NewDecoder(w.Body).Decode(&options); err != nil || options.Challenge == "" {
+			t.Errorf("%s: no challenge in the options: %v", c.name, err)
+		}
+	}
+}
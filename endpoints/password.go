@@ -0,0 +1,151 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"quickstart/database"
+	"quickstart/mailer"
+)
+
+var errInvalidResetToken = &Error{Status: http.StatusBadRequest, Code: "invalid_token", Message: "This reset link is invalid or has expired"}
+
+// RequestPasswordReset mails a reset link to the account with the given
+// email address, once it's verified. It answers 202 whether there is such
+// an account or not, so that it can't be used to find out who has one.
+func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	email, ok := normalizeEmail(input.Email)
+	if !ok {
+		writeError(w, errValidation(map[string]string{"email": "Invalid email address"}))
+		return
+	}
+
+	user, err := h.Store.Users.GetByEmail(r.Context(), email)
+	switch {
+	case err == database.ErrNotFound:
+		logger(r).Info("password reset for an unknown email")
+	case err != nil:
+		writeInternalError(w, r, err)
+		return
+	case !user.EmailVerified():
+		// whoever typed this address may not be the one reading it
+		logger(r).Info("password reset for an unverified email", "user_id", user.Id)
+	default:
+		if err := h.sendPasswordReset(r, user); err != nil {
+			// still 202, an error would tell the account exists
+			logger(r).Error("sending password reset", "user_id", user.Id, "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) sendPasswordReset(r *http.Request, user database.User) error {
+	plain, err := h.issueToken(r, user.Id, database.TokenPasswordReset, h.Config.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := h.appLink("/reset-password", url.Values{"token": {plain}})
+	return h.Mailer.Send(r.Context(), mailer.Message{
+		To:      user.Email.String,
+		Subject: "Reset your Mytinerary password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your Mytinerary account. "+
+			"If it was you, open this link within %s to choose a new one:\n\n%s\n\n"+
+			"Otherwise you can ignore this email, your password hasn't changed.\n",
+			user.Username, h.Config.PasswordResetTTL, link),
+	})
+}
+
+// ResetPassword sets a new password using a token mailed by
+// RequestPasswordReset. Every session and API token of the account is
+// revoked.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	problems := map[string]string{}
+	if input.Token == "" {
+		problems["token"] = "Missing token"
+	}
+	if input.Password == "" {
+		problems["password"] = "Missing password"
+	}
+	if e := errValidation(problems); e != nil {
+		writeError(w, e)
+		return
+	}
+
+	tokenHash := database.HashToken(input.Token)
+	token, err := h.Store.Tokens.Get(r.Context(), database.TokenPasswordReset, tokenHash, h.now())
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errInvalidResetToken)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	user, err := h.Store.Users.Get(r.Context(), token.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	// checked before the token is used up, so that the user can pick
+	// another password with the same link
+	if problem := h.PasswordPolicy.Check(input.Password, user.Username); problem != "" {
+		writeError(w, errValidation(map[string]string{"password": problem}))
+		return
+	}
+
+	if _, err := h.Store.Tokens.Consume(r.Context(), database.TokenPasswordReset, tokenHash, h.now()); err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errInvalidResetToken)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	hash, err := h.hashPassword(input.Password)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := h.Store.Users.SetPassword(r.Context(), token.UserId, hash); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	revoked, err := h.Store.Sessions.DeleteAllForUser(r.Context(), token.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	revokedTokens, err := h.Store.APITokens.DeleteAllForUser(r.Context(), token.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	// whoever locked the account out by guessing doesn't know the new password
+	if err := h.Store.Throttles.Reset(r.Context(), h.loginKeys(r, user.Username)[0].key); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	logger(r).Info("password reset", "user_id", token.UserId, "revoked_sessions", revoked, "revoked_api_tokens", revokedTokens)
+	w.WriteHeader(http.StatusNoContent)
+}
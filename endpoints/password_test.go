@@ -0,0 +1,66 @@
+package endpoints
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"quickstart/database"
+)
+
+func TestRequestPasswordResetNeedsVerifiedEmail(t *testing.T) {
+	h, mail := newTestHandler(t)
+	createUser(t, h, "unverified", "correct horse", "unverified@example.com")
+	verified := createUser(t, h, "verified", "correct horse", "verified@example.com")
+	if err := h.Store.Users.VerifyEmail(context.Background(), verified.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"unknown@example.com", "unverified@example.com", "verified@example.com"} {
+		w := serve(h.RequestPasswordReset, jsonRequest(t, "POST", "/auth/password/reset", map[string]string{"email": email}))
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: status %d, want 202", email, w.Code)
+		}
+	}
+
+	messages := mail.Messages()
+	if len(messages) != 1 || messages[0].To != "verified@example.com" {
+		t.Errorf("mailed %+v, want a single link to the verified address", messages)
+	}
+}
+
+func TestResetPasswordRevokesSessionsAndTokens(t *testing.T) {
+	h, mail := newTestHandler(t)
+	ctx := context.Background()
+	user := createUser(t, h, "alice", "correct horse", "alice@example.com")
+	other := createUser(t, h, "bob", "correct horse", "")
+	if err := h.Store.Users.VerifyEmail(ctx, user.Id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for i, userId := range []int{user.Id, user.Id, other.Id} {
+		if _, err := h.Store.APITokens.Create(ctx, database.APIToken{UserId: userId, Name: "script", TokenHash: database.HashToken(fmt.Sprint("token ", i)), Scopes: []string{"read"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Store.Sessions.Create(ctx, database.Session{User_id: user.Id, Session_id: "stolen", Expiration: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	serve(h.RequestPasswordReset, jsonRequest(t, "POST", "/auth/password/reset", map[string]string{"email": "alice@example.com"}))
+	body := map[string]string{"token": lastToken(t, mail, "alice@example.com"), "password": "a long new password"}
+	if w := serve(h.ResetPassword, jsonRequest(t, "POST", "/auth/password/reset/confirm", body)); w.Code != http.StatusNoContent {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+
+	if tokens, err := h.Store.APITokens.ListByUser(ctx, user.Id); err != nil || len(tokens) != 0 {
+		t.Errorf("tokens left after a reset: %v %v", tokens, err)
+	}
+	if tokens, err := h.Store.APITokens.ListByUser(ctx, other.Id); err != nil || len(tokens) != 1 {
+		t.Errorf("another user's tokens: %v %v, want 1", tokens, err)
+	}
+	if _, err := h.Store.Sessions.Get(ctx, "stolen"); err != database.ErrNotFound {
+		t.Errorf("session after a reset: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,73 @@
+package endpoints
+
+import (
+	"net/http"
+	"quickstart/database"
+)
+
+// Permission is an action only some roles are allowed to perform
+type Permission string
+
+const (
+	// ManageCities allows creating, updating and deleting cities
+	ManageCities Permission = "cities:manage"
+	// ModerateItineraries allows editing and deleting anyone's itineraries
+	ModerateItineraries Permission = "itineraries:moderate"
+	// ViewJobs allows looking at the background jobs' stats
+	ViewJobs Permission = "jobs:view"
+	// ViewSecurityEvents allows looking at login lockouts
+	ViewSecurityEvents Permission = "security:view"
+)
+
+var rolePermissions = map[database.Role][]Permission{
+	database.RoleUser:      {},
+	database.RoleModerator: {ModerateItineraries},
+	database.RoleAdmin:     {ManageCities, ModerateItineraries, ViewJobs, ViewSecurityEvents},
+}
+
+// Scope limits what an API token can be used for
+type Scope string
+
+const (
+	// ScopeRead allows GET requests
+	ScopeRead Scope = "read"
+	// ScopeWriteItineraries allows creating, editing and deleting
+	// itineraries and comments
+	ScopeWriteItineraries Scope = "write:itineraries"
+	// ScopeAdmin allows the routes that require a permission, if the
+	// token's user has it
+	ScopeAdmin Scope = "admin"
+)
+
+var scopes = []Scope{ScopeRead, ScopeWriteItineraries, ScopeAdmin}
+
+func isValidScope(scope string) bool {
+	for _, known := range scopes {
+		if string(known) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenScope is the scope an API token needs to make the request, empty
+// when only sessions may
+func (a Access) tokenScope(r *http.Request) Scope {
+	switch {
+	case a.permission != "":
+		return ScopeAdmin
+	case r.Method == "GET" || r.Method == "HEAD":
+		return ScopeRead
+	default:
+		return a.scope
+	}
+}
+
+func HasPermission(role database.Role, permission Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"quickstart/database"
+)
+
+const maxUserAgentLength = 512
+
+type sessionJSON struct {
+	Id         int       `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	// Current is the session making the request
+	Current bool `json:"current"`
+}
+
+// Sessions lists the current user's active sessions on GET and logs them
+// all out, the current one included, on DELETE
+func (h *Handler) Sessions(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	switch r.Method {
+	case "GET":
+		sessions, err := h.Store.Sessions.ListByUser(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+
+		result := make([]sessionJSON, 0, len(sessions))
+		for _, session := range sessions {
+			result = append(result, sessionJSON{
+				Id:         session.Id,
+				CreatedAt:  session.CreatedAt,
+				LastSeenAt: session.LastSeenAt,
+				ExpiresAt:  session.Expiration,
+				UserAgent:  session.UserAgent,
+				IP:         session.IP,
+				Current:    session.Id == identity.Session.Id,
+			})
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case "DELETE":
+		revoked, err := h.Store.Sessions.DeleteAllForUser(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		logger(r).Info("logged out everywhere", "sessions", revoked)
+		h.expireSessionCookie(w)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Session revokes one of the current user's sessions
+func (h *Handler) Session(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	id, ok := pathId(r, "sessionId")
+	if !ok {
+		writeError(w, errNotFound("Session"))
+		return
+	}
+
+	err := h.Store.Sessions.DeleteForUser(r.Context(), identity.User.Id, id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("Session"))
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	if id == identity.Session.Id {
+		h.expireSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) sessionPolicy() database.SessionPolicy {
+	return database.SessionPolicy{
+		MaxAge:         h.Config.SessionMaxAge,
+		RememberMaxAge: h.Config.SessionRememberMaxAge,
+		AbsoluteMaxAge: h.Config.SessionAbsoluteMaxAge,
+		RenewAfter:     h.Config.SessionRenewAfter,
+	}
+}
+
+// sessionCookie returns the sid cookie with the configured attributes. It's
+// HttpOnly, scripts only ever need the CSRF token.
+func (h *Handler) sessionCookie(value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     "sid",
+		Value:    value,
+		Path:     "/",
+		Domain:   h.Config.CookieDomain,
+		HttpOnly: true,
+		Secure:   h.Config.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch h.Config.CookieSameSite {
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	return cookie
+}
+
+// setSessionCookie sends the sid cookie. Only remember me sessions outlive
+// the browser, the others are expired on the server side.
+func (h *Handler) setSessionCookie(w http.ResponseWriter, session database.Session) {
+	cookie := h.sessionCookie(session.Session_id)
+	if session.RememberMe {
+		cookie.Expires = session.Expiration
+		cookie.MaxAge = int(time.Until(session.Expiration).Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (h *Handler) expireSessionCookie(w http.ResponseWriter) {
+	cookie := h.sessionCookie("")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// clientIP is the address the request came from, without the port. When
+// it's a trusted proxy the client is the rightmost address of
+// X-Forwarded-For that isn't one, since anything left of it may have been
+// made up by the client.
+func (h *Handler) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	proxies := h.Config.TrustedProxyNets()
+	trusted := func(addr string) bool {
+		parsed := net.ParseIP(addr)
+		for _, network := range proxies {
+			if parsed != nil && network.Contains(parsed) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && trusted(ip); i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+	}
+	return ip
+}
+
+// truncate cuts s to at most max bytes without splitting a character
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
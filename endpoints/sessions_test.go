@@ -0,0 +1,40 @@
+package endpoints
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", nil, "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted forwarder", nil, "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy address", []string{"10.0.0.2"}, "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left part", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"several headers", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"198.51.100.1", "10.0.0.3"}, "198.51.100.1"},
+		{"only proxies", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"no header", []string{"10.0.0.0/8"}, "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"garbage", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"198.51.100.1, not-an-ip"}, "10.0.0.2"},
+		{"ipv6", []string{"fd00::/8"}, "[fd00::1]:5000", []string{"2001:db8::5"}, "2001:db8::5"},
+	}
+	for _, c := range cases {
+		h, _ := newTestHandler(t)
+		h.Config.TrustedProxies = c.proxies
+		r := httptest.NewRequest("POST", "/auth/login", nil)
+		r.RemoteAddr = c.remoteAddr
+		for _, header := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := h.clientIP(r); got != c.want {
+			t.Errorf("%s: clientIP = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quickstart/database"
+)
+
+var errInvalidCredentials = &Error{Status: http.StatusUnauthorized, Code: "invalid_credentials", Message: "Wrong username or password"}
+
+// loginKey is a failed login counter along with its lockout threshold
+type loginKey struct {
+	key       string
+	threshold int
+}
+
+// loginKeys returns the counters a login attempt goes through: one for the
+// account, whether it exists or not, and one for the client's IP
+func (h *Handler) loginKeys(r *http.Request, username string) []loginKey {
+	return []loginKey{
+		{"account:" + strings.ToLower(username), h.Config.LoginLockoutThreshold},
+		{"ip:" + h.clientIP(r), h.Config.LoginIPLockoutThreshold},
+	}
+}
+
+// backoff is how long after its last failure a counter blocks new attempts
+func (h *Handler) backoff(failures int) time.Duration {
+	excess := failures - h.Config.LoginFreeAttempts
+	if excess <= 0 {
+		return 0
+	}
+	delay := time.Duration(float64(h.Config.LoginBackoffBase) * math.Pow(2, float64(excess-1)))
+	if delay > h.Config.LoginLockoutDuration || delay < 0 {
+		delay = h.Config.LoginLockoutDuration
+	}
+	return delay
+}
+
+// loginBlockedUntil returns when the attempt may be made, zero if it may
+// be made right away
+func (h *Handler) loginBlockedUntil(ctx context.Context, keys []loginKey) (time.Time, error) {
+	var until time.Time
+	for _, k := range keys {
+		throttle, err := h.Store.Throttles.Get(ctx, k.key)
+		if err == database.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		blocked := throttle.LastFailureAt.Add(h.backoff(throttle.Failures))
+		if throttle.LockedUntil.Valid && throttle.LockedUntil.Time.After(blocked) {
+			blocked = throttle.LockedUntil.Time
+		}
+		if blocked.After(until) {
+			until = blocked
+		}
+	}
+	if !until.After(h.now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// recordLoginFailure counts the failure on every key, locking out those
+// reaching their threshold
+func (h *Handler) recordLoginFailure(r *http.Request, keys []loginKey) error {
+	now := h.now()
+	for _, k := range keys {
+		throttle, err := h.Store.Throttles.RecordFailure(r.Context(), k.key, now, now.Add(-h.Config.LoginLockoutDuration))
+		if err != nil {
+			return err
+		}
+		if throttle.Failures < k.threshold || (throttle.LockedUntil.Valid && throttle.LockedUntil.Time.After(now)) {
+			continue
+		}
+
+		lockedUntil := now.Add(h.Config.LoginLockoutDuration)
+		if err := h.Store.Throttles.Lock(r.Context(), k.key, lockedUntil); err != nil {
+			return err
+		}
+		logger(r).Warn("login locked out", "key", k.key, "failures", throttle.Failures, "locked_until", lockedUntil)
+		err = h.Store.Throttles.RecordLockout(r.Context(), database.LockoutEvent{
+			Key:         k.key,
+			IP:          h.clientIP(r),
+			Failures:    throttle.Failures,
+			LockedUntil: lockedUntil,
+			CreatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTooManyAttempts answers a throttled login, the same way whether the
+// account exists or not
+func (h *Handler) writeTooManyAttempts(w http.ResponseWriter, until time.Time) {
+	seconds := int(math.Ceil(until.Sub(h.now()).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, &Error{Status: http.StatusTooManyRequests, Code: "too_many_attempts", Message: "Too many failed logins, try again later"})
+}
+
+type lockoutJSON struct {
+	Id          int       `json:"id"`
+	Key         string    `json:"key"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Lockouts lists the most recent login lockouts
+func (h *Handler) Lockouts(w http.ResponseWriter, r *http.Request) {
+	events, err := h.Store.Throttles.ListLockouts(r.Context(), 100)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	result := make([]lockoutJSON, 0, len(events))
+	for _, event := range events {
+		result = append(result, lockoutJSON{
+			Id:          event.Id,
+			Key:         event.Key,
+			IP:          event.IP,
+			Failures:    event.Failures,
+			LockedUntil: event.LockedUntil,
+			CreatedAt:   event.CreatedAt,
+		})
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,141 @@
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"quickstart/database"
+)
+
+// login attempts a password login from ip
+func login(t *testing.T, h *Handler, ip string, username string, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := jsonRequest(t, "POST", "/auth/login", map[string]string{"username": username, "password": password})
+	r.RemoteAddr = ip + ":5000"
+	return serve(h.Login, r)
+}
+
+// wantThrottled checks that w is a 429 telling to retry in retryAfter
+func wantThrottled(t *testing.T, w *httptest.ResponseRecorder, retryAfter string) {
+	t.Helper()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("%d %s, want 429", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != retryAfter {
+		t.Errorf("Retry-After %q, want %q", got, retryAfter)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	createUser(t, h, "alice", "correct horse", "")
+
+	// the free attempts, and the one after them, aren't slowed down
+	for i := 0; i <= h.Config.LoginFreeAttempts; i++ {
+		if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: %d %s, want 401", i+1, w.Code, w.Body)
+		}
+	}
+
+	// then each failure doubles the wait, even for the right password
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "correct horse"), "1")
+	*now = now.Add(time.Second)
+	if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("after the backoff: %d %s, want 401", w.Code, w.Body)
+	}
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "wrong"), "2")
+	*now = now.Add(time.Second)
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "wrong"), "1")
+	*now = now.Add(time.Second)
+	if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("after the second backoff: %d %s, want 401", w.Code, w.Body)
+	}
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "wrong"), "4")
+
+	// the account counter applies from any IP
+	wantThrottled(t, login(t, h, "198.51.100.1", "alice", "correct horse"), "4")
+
+	*now = now.Add(4 * time.Second)
+	if w := login(t, h, "198.51.100.1", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("right password after the backoff: %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	createUser(t, h, "alice", "correct horse", "")
+
+	// failures spaced past every backoff, but close enough to keep counting
+	for i := 1; i <= h.Config.LoginLockoutThreshold; i++ {
+		*now = now.Add(2 * time.Minute)
+		if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: %d %s, want 401", i, w.Code, w.Body)
+		}
+	}
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "correct horse"), "900")
+
+	events, err := h.Store.Throttles.ListLockouts(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Key != "account:alice" || events[0].IP != "203.0.113.7" || events[0].Failures != h.Config.LoginLockoutThreshold {
+		t.Fatalf("lockouts %+v, want one of account:alice", events)
+	}
+	if want := now.Add(h.Config.LoginLockoutDuration); !events[0].LockedUntil.Equal(want) {
+		t.Errorf("locked until %v, want %v", events[0].LockedUntil, want)
+	}
+
+	*now = now.Add(h.Config.LoginLockoutDuration - time.Minute)
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "correct horse"), "60")
+	*now = now.Add(time.Minute)
+	if w := login(t, h, "203.0.113.7", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("after the lockout: %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestLoginSuccessResetsOnlyTheAccount(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	h.Config.LoginIPLockoutThreshold = 5
+	createUser(t, h, "alice", "correct horse", "")
+	ctx := context.Background()
+
+	if w := login(t, h, "203.0.113.7", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("%d %s, want 401", w.Code, w.Body)
+	}
+	for _, username := range []string{"bob", "carol", "dave"} {
+		if w := login(t, h, "203.0.113.7", username, "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: %d %s, want 401", username, w.Code, w.Body)
+		}
+	}
+	// past the backoff of the IP's fourth failure
+	*now = now.Add(time.Second)
+	if w := login(t, h, "203.0.113.7", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("right password: %d %s, want 200", w.Code, w.Body)
+	}
+
+	if _, err := h.Store.Throttles.Get(ctx, "account:alice"); err != database.ErrNotFound {
+		t.Errorf("account counter after a login: got %v, want ErrNotFound", err)
+	}
+	throttle, err := h.Store.Throttles.Get(ctx, "ip:203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Failures != 4 {
+		t.Errorf("IP counter after a login: %d failures, want 4", throttle.Failures)
+	}
+
+	// one more guess locks the IP out, for every account but not for others
+	if w := login(t, h, "203.0.113.7", "erin", "guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("%d %s, want 401", w.Code, w.Body)
+	}
+	wantThrottled(t, login(t, h, "203.0.113.7", "alice", "correct horse"), "900")
+	if w := login(t, h, "198.51.100.1", "alice", "correct horse"); w.Code != http.StatusOK {
+		t.Fatalf("from another IP: %d %s, want 200", w.Code, w.Body)
+	}
+}
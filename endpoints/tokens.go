@@ -0,0 +1,180 @@
+package endpoints
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"quickstart/database"
+)
+
+// apiTokenPrefix makes tokens recognizable, e.g. by secret scanners
+const apiTokenPrefix = "myt_"
+
+const (
+	maxTokenNameLength   = 100
+	maxTokenLifetimeDays = 365
+	apiTokenRandomBytes  = 32
+)
+
+type apiTokenJSON struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	// Token is only sent once, when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func newAPITokenJSON(token database.APIToken) apiTokenJSON {
+	result := apiTokenJSON{
+		Id:        token.Id,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+	}
+	if token.ExpiresAt.Valid {
+		result.ExpiresAt = &token.ExpiresAt.Time
+	}
+	if token.LastUsedAt.Valid {
+		result.LastUsedAt = &token.LastUsedAt.Time
+	}
+	return result
+}
+
+type apiTokenInput struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is optional, tokens without it never expire
+	ExpiresInDays *int `json:"expiresInDays"`
+}
+
+func (input apiTokenInput) validate(role database.Role) map[string]string {
+	problems := map[string]string{}
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		problems["name"] = "Missing name"
+	} else if utf8.RuneCountInString(name) > maxTokenNameLength {
+		problems["name"] = "Name is too long"
+	}
+
+	if len(input.Scopes) == 0 {
+		problems["scopes"] = "Missing scopes"
+	}
+	for _, scope := range input.Scopes {
+		if !isValidScope(scope) {
+			problems["scopes"] = "Unknown scope " + scope
+			break
+		}
+		// a token can't do more than its user
+		if Scope(scope) == ScopeAdmin && len(rolePermissions[role]) == 0 {
+			problems["scopes"] = "Your role can't use the admin scope"
+			break
+		}
+	}
+
+	if input.ExpiresInDays != nil && (*input.ExpiresInDays < 1 || *input.ExpiresInDays > maxTokenLifetimeDays) {
+		problems["expiresInDays"] = "Must be between 1 and 365"
+	}
+	return problems
+}
+
+// APITokens lists the current user's API tokens on GET and creates one on
+// POST. Creating and revoking tokens takes a session, a token can't mint
+// another.
+func (h *Handler) APITokens(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	switch r.Method {
+	case "GET":
+		tokens, err := h.Store.APITokens.ListByUser(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		result := make([]apiTokenJSON, 0, len(tokens))
+		for _, token := range tokens {
+			result = append(result, newAPITokenJSON(token))
+		}
+		json.NewEncoder(w).Encode(result)
+
+	case "POST":
+		var input apiTokenInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, errInvalidJSON)
+			return
+		}
+		if e := errValidation(input.validate(identity.User.Role)); e != nil {
+			writeError(w, e)
+			return
+		}
+
+		secret, err := randomToken(apiTokenRandomBytes)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		plain := apiTokenPrefix + secret
+
+		token := database.APIToken{
+			UserId:    identity.User.Id,
+			Name:      strings.TrimSpace(input.Name),
+			TokenHash: database.HashToken(plain),
+			Scopes:    dedupe(input.Scopes),
+			CreatedAt: time.Now(),
+		}
+		if input.ExpiresInDays != nil {
+			token.ExpiresAt = sql.NullTime{Time: token.CreatedAt.AddDate(0, 0, *input.ExpiresInDays), Valid: true}
+		}
+
+		token, err = h.Store.APITokens.Create(r.Context(), token)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		logger(r).Info("created api token", "token_id", token.Id, "scopes", token.Scopes)
+
+		result := newAPITokenJSON(token)
+		result.Token = plain
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// APIToken revokes one of the current user's API tokens
+func (h *Handler) APIToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(r, "tokenId")
+	if !ok {
+		writeError(w, errNotFound("Token"))
+		return
+	}
+
+	err := h.Store.APITokens.DeleteForUser(r.Context(), currentUserId(r), id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("Token"))
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
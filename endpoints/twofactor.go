@@ -0,0 +1,416 @@
+package endpoints
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"quickstart/database"
+	"quickstart/totp"
+)
+
+const (
+	// secondFactorTTL is how long after the password the code can be given
+	secondFactorTTL = 5 * time.Minute
+	// freshLoginTTL is how long after logging in a user without a password
+	// counts as reauthenticated
+	freshLoginTTL = 10 * time.Minute
+	// totpSkew is how many 30s steps a code may be early or late
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 5 // bytes, i.e. 8 characters
+)
+
+var (
+	errSecondFactorExpired  = &Error{Status: http.StatusUnauthorized, Code: "invalid_token", Message: "This login attempt has expired, log in again"}
+	errInvalidCode          = &Error{Status: http.StatusUnauthorized, Code: "invalid_code", Message: "The code is wrong or was already used"}
+	errReauthentication     = &Error{Status: http.StatusForbidden, Code: "reauthentication_failed", Message: "The password or code is wrong"}
+	errLoginNotFresh        = &Error{Status: http.StatusForbidden, Code: "reauthentication_required", Message: "Log in again to confirm it's you"}
+	errTwoFactorEnabled     = errConflict("2fa_already_enabled", "Two-factor authentication is already enabled")
+	errTwoFactorNotEnrolled = &Error{Status: http.StatusBadRequest, Code: "2fa_not_enrolled", Message: "Start the two-factor setup first"}
+)
+
+// secondFactor is a code from the authenticator app or, when it's lost,
+// one of the recovery codes
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func (f secondFactor) empty() bool {
+	return f.Code == "" && f.RecoveryCode == ""
+}
+
+// reauthentication is asked for before disabling 2FA or other changes an
+// open laptop shouldn't be enough for. Users without a password only give
+// the second factor.
+type reauthentication struct {
+	Password string `json:"password"`
+	secondFactor
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes returns the codes to show the user and the hashes to
+// store
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return
+}
+
+// hashRecoveryCode ignores case, dashes and spaces so that codes can be
+// typed back loosely
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	return database.HashToken(code)
+}
+
+// checkSecondFactor reports whether the code is valid for the user, using
+// it up. Users without 2FA have no valid code.
+func (h *Handler) checkSecondFactor(r *http.Request, userId int, factor secondFactor) (bool, error) {
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), userId)
+	if err == database.ErrNotFound || (err == nil && !enrollment.Enabled()) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if factor.RecoveryCode != "" {
+		err = h.Store.TwoFactor.UseRecoveryCode(r.Context(), userId, hashRecoveryCode(factor.RecoveryCode), h.now())
+	} else {
+		step, ok := totp.Validate(enrollment.Secret, factor.Code, h.now(), totpSkew)
+		if !ok {
+			return false, nil
+		}
+		// a code seen once, e.g. over a shoulder, doesn't work again
+		err = h.Store.TwoFactor.UseStep(r.Context(), userId, step)
+	}
+	if err == database.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// reauthenticate checks the current user's password, and second factor
+// when 2FA is enabled. Users without a password, who log in through a
+// provider, a passkey or a magic link, have to have logged in within
+// freshLoginTTL instead. It writes the error response and returns false
+// when they don't match. Failures count as failed logins.
+func (h *Handler) reauthenticate(w http.ResponseWriter, r *http.Request, identity Identity, creds reauthentication) bool {
+	user := identity.User
+	keys := h.loginKeys(r, user.Username)
+	blockedUntil, err := h.loginBlockedUntil(r.Context(), keys)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return false
+	}
+	if !blockedUntil.IsZero() {
+		h.writeTooManyAttempts(w, blockedUntil)
+		return false
+	}
+
+	var ok bool
+	if user.Password == "" {
+		if h.now().Sub(identity.Session.CreatedAt) > freshLoginTTL {
+			writeError(w, errLoginNotFresh)
+			return false
+		}
+		ok = true
+	} else {
+		ok = h.checkPassword(creds.Password, user.Password)
+	}
+	if ok {
+		enrollment, err := h.Store.TwoFactor.Get(r.Context(), user.Id)
+		if err != nil && err != database.ErrNotFound {
+			writeInternalError(w, r, err)
+			return false
+		}
+		if enrollment.Enabled() {
+			ok, err = h.checkSecondFactor(r, user.Id, creds.secondFactor)
+			if err != nil {
+				writeInternalError(w, r, err)
+				return false
+			}
+		}
+	}
+
+	if !ok {
+		if err := h.recordLoginFailure(r, keys); err != nil {
+			writeInternalError(w, r, err)
+			return false
+		}
+		writeError(w, errReauthentication)
+		return false
+	}
+	return true
+}
+
+// requireSecondFactor answers a correct password of a user with 2FA. The
+// returned token stands for the password in LoginSecondFactor.
+func (h *Handler) requireSecondFactor(w http.ResponseWriter, r *http.Request, user database.User) {
+	token, err := h.issueToken(r, user.Id, database.TokenLoginSecondFactor, secondFactorTTL)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		TwoFactorToken    string `json:"twoFactorToken"`
+	}{true, token})
+}
+
+// LoginSecondFactor is the second step of Login for users with 2FA. It
+// takes the token Login returned along with a code, and starts the
+// session.
+func (h *Handler) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"twoFactorToken"`
+		secondFactor
+		RememberMe bool `json:"rememberMe"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	problems := map[string]string{}
+	if input.Token == "" {
+		problems["twoFactorToken"] = "Missing token"
+	}
+	if input.empty() {
+		problems["code"] = "Missing code"
+	}
+	if e := errValidation(problems); e != nil {
+		writeError(w, e)
+		return
+	}
+
+	tokenHash := database.HashToken(input.Token)
+	token, err := h.Store.Tokens.Get(r.Context(), database.TokenLoginSecondFactor, tokenHash, h.now())
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errSecondFactorExpired)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	user, err := h.Store.Users.Get(r.Context(), token.UserId)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	// codes are guessed against the same counters as passwords
+	keys := h.loginKeys(r, user.Username)
+	blockedUntil, err := h.loginBlockedUntil(r.Context(), keys)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !blockedUntil.IsZero() {
+		h.writeTooManyAttempts(w, blockedUntil)
+		return
+	}
+
+	ok, err := h.checkSecondFactor(r, user.Id, input.secondFactor)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !ok {
+		if err := h.recordLoginFailure(r, keys); err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		writeError(w, errInvalidCode)
+		return
+	}
+
+	if _, err := h.Store.Tokens.Consume(r.Context(), database.TokenLoginSecondFactor, tokenHash, h.now()); err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errSecondFactorExpired)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	h.completeLogin(w, r, user, keys[0].key, input.RememberMe)
+}
+
+// TwoFactor tells whether the current user has 2FA enabled and how many
+// recovery codes they have left
+func (h *Handler) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), identity.User.Id)
+	if err != nil && err != database.ErrNotFound {
+		writeInternalError(w, r, err)
+		return
+	}
+	var status struct {
+		Enabled           bool `json:"enabled"`
+		RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+	}
+	if enrollment.Enabled() {
+		status.Enabled = true
+		status.RecoveryCodesLeft, err = h.Store.TwoFactor.CountRecoveryCodes(r.Context(), identity.User.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// EnrollTwoFactor starts the 2FA setup with a new secret, to be added to an
+// authenticator app and confirmed with ConfirmTwoFactor. Starting again
+// replaces the secret.
+func (h *Handler) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := h.Store.TwoFactor.Enroll(r.Context(), identity.User.Id, secret); err != nil {
+		if err == database.ErrConflict {
+			writeError(w, errTwoFactorEnabled)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Secret string `json:"secret"`
+		// OtpauthURI is meant to be shown as a QR code
+		OtpauthURI string `json:"otpauthUri"`
+	}{secret, totp.URI(h.Config.TOTPIssuer, identity.User.Username, secret)})
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves their app generates the
+// right codes, and returns the recovery codes. They are only shown here.
+func (h *Handler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), identity.User.Id)
+	switch {
+	case err == database.ErrNotFound:
+		writeError(w, errTwoFactorNotEnrolled)
+		return
+	case err != nil:
+		writeInternalError(w, r, err)
+		return
+	case enrollment.Enabled():
+		writeError(w, errTwoFactorEnabled)
+		return
+	}
+
+	step, ok := totp.Validate(enrollment.Secret, input.Code, h.now(), totpSkew)
+	if !ok {
+		writeError(w, errValidation(map[string]string{"code": "Wrong code"}))
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := h.Store.TwoFactor.Confirm(r.Context(), identity.User.Id, step, h.now(), hashes); err != nil {
+		if err == database.ErrNotFound {
+			// confirmed by a concurrent request
+			writeError(w, errTwoFactorEnabled)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	logger(r).Info("two-factor authentication enabled")
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes})
+}
+
+// DisableTwoFactor turns 2FA off, or cancels a setup, after checking the
+// password and a code again
+func (h *Handler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	var creds reauthentication
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if !h.reauthenticate(w, r, identity, creds) {
+		return
+	}
+
+	if err := h.Store.TwoFactor.Delete(r.Context(), identity.User.Id); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	logger(r).Info("two-factor authentication disabled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, used or not, after
+// checking the password and a code again
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	var creds reauthentication
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+
+	enrollment, err := h.Store.TwoFactor.Get(r.Context(), identity.User.Id)
+	if err != nil && err != database.ErrNotFound {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !enrollment.Enabled() {
+		writeError(w, errTwoFactorNotEnrolled)
+		return
+	}
+	if !h.reauthenticate(w, r, identity, creds) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := h.Store.TwoFactor.ReplaceRecoveryCodes(r.Context(), identity.User.Id, hashes); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes})
+}
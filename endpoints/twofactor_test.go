@@ -0,0 +1,163 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"quickstart/database"
+	"quickstart/totp"
+)
+
+// enableTwoFactor enrolls and confirms the user at the handler's clock and
+// returns the secret and recovery codes
+func enableTwoFactor(t *testing.T, h *Handler, user database.User) (string, []string) {
+	t.Helper()
+	w := serve(h.EnrollTwoFactor, asUser(httptest.NewRequest("POST", "/auth/2fa/enroll", nil), user))
+	var enrollment struct{ Secret string }
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("enroll: %d %v", w.Code, err)
+	}
+
+	code := totpCode(t, enrollment.Secret, totp.Step(h.now()))
+	w = serve(h.ConfirmTwoFactor, asUser(jsonRequest(t, "POST", "/auth/2fa/confirm", map[string]string{"code": code}), user))
+	var confirmation struct{ RecoveryCodes []string }
+	if err := json.NewDecoder(w.Body).Decode(&confirmation); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("confirm: %d %v", w.Code, err)
+	}
+	return enrollment.Secret, confirmation.RecoveryCodes
+}
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// startLogin logs in with a password and returns the second step's token
+func startLogin(t *testing.T, h *Handler, username string, password string) string {
+	t.Helper()
+	w := serve(h.Login, jsonRequest(t, "POST", "/auth/login", map[string]string{"username": username, "password": password}))
+	var challenge struct {
+		TwoFactorRequired bool
+		TwoFactorToken    string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("login: %d %v", w.Code, err)
+	}
+	if !challenge.TwoFactorRequired || challenge.TwoFactorToken == "" {
+		t.Fatalf("login didn't ask for a code: %+v", challenge)
+	}
+	if sessionCookie(w) != nil {
+		t.Fatal("login set a session cookie before the second factor")
+	}
+	return challenge.TwoFactorToken
+}
+
+func finishLogin(t *testing.T, h *Handler, token string, factor secondFactor) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(h.LoginSecondFactor, jsonRequest(t, "POST", "/auth/login/2fa", map[string]string{
+		"twoFactorToken": token,
+		"code":           factor.Code,
+		"recoveryCode":   factor.RecoveryCode,
+	}))
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "sid" && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// fixedClock pins h's clock to the returned time, which the test can move
+func fixedClock(h *Handler, start time.Time) *time.Time {
+	now := start
+	h.Clock = func() time.Time { return now }
+	return &now
+}
+
+func TestLoginAsksForSecondFactor(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 15, 0, time.UTC))
+	user := createUser(t, h, "alice", "correct horse", "")
+	secret, _ := enableTwoFactor(t, h, user)
+
+	*now = now.Add(time.Minute)
+	token := startLogin(t, h, "alice", "correct horse")
+
+	w := finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, totp.Step(*now))})
+	if w.Code != http.StatusOK || sessionCookie(w) == nil {
+		t.Fatalf("second step: %d %s, want a session", w.Code, w.Body)
+	}
+	// the token went with the successful attempt
+	w = finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, totp.Step(*now)+1)})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reused token: %d, want 401", w.Code)
+	}
+}
+
+func TestSecondFactorStepWindow(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 15, 0, time.UTC))
+	user := createUser(t, h, "alice", "correct horse", "")
+	secret, _ := enableTwoFactor(t, h, user)
+
+	*now = now.Add(10 * time.Minute)
+	current := totp.Step(*now)
+	token := startLogin(t, h, "alice", "correct horse")
+	for _, offset := range []int64{-2, 2} {
+		w := finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, current+offset)})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("code %d steps off: %d, want 401", offset, w.Code)
+		}
+	}
+	w := finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, current-1)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("code a step early: %d %s, want 200", w.Code, w.Body)
+	}
+
+	// the same code, or an older one, doesn't work twice
+	token = startLogin(t, h, "alice", "correct horse")
+	w = finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, current-1)})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code: %d, want 401", w.Code)
+	}
+	w = finishLogin(t, h, token, secondFactor{Code: totpCode(t, secret, current+1)})
+	if w.Code != http.StatusOK {
+		t.Errorf("code a step late: %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	h, _ := newTestHandler(t)
+	fixedClock(h, time.Date(2026, 3, 1, 12, 0, 15, 0, time.UTC))
+	user := createUser(t, h, "alice", "correct horse", "")
+	_, codes := enableTwoFactor(t, h, user)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// typed back without the dash and in capitals
+	typed := strings.ToUpper(strings.Replace(codes[0], "-", "", 1))
+	token := startLogin(t, h, "alice", "correct horse")
+	if w := finishLogin(t, h, token, secondFactor{RecoveryCode: typed}); w.Code != http.StatusOK {
+		t.Fatalf("recovery code: %d %s, want 200", w.Code, w.Body)
+	}
+
+	token = startLogin(t, h, "alice", "correct horse")
+	if w := finishLogin(t, h, token, secondFactor{RecoveryCode: codes[0]}); w.Code != http.StatusUnauthorized {
+		t.Errorf("used recovery code: %d, want 401", w.Code)
+	}
+	if w := finishLogin(t, h, token, secondFactor{RecoveryCode: codes[1]}); w.Code != http.StatusOK {
+		t.Errorf("another recovery code: %d %s, want 200", w.Code, w.Body)
+	}
+}
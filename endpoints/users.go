@@ -0,0 +1,241 @@
+package endpoints
+
+import (
+	"database/sql"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"unicode/utf8"
+
+	"quickstart/database"
+)
+
+// profileJSON is what anyone can see of a user
+type profileJSON struct {
+	Id         int     `json:"id"`
+	Username   string  `json:"username"`
+	ProfilePic *string `json:"profilePic"`
+}
+
+func newProfileJSON(user database.User) profileJSON {
+	res := profileJSON{Id: user.Id, Username: user.Username}
+	if user.ProfilePic.Valid {
+		res.ProfilePic = &user.ProfilePic.String
+	}
+	return res
+}
+
+// validateUsername returns what's wrong with the username, empty if it's valid
+func validateUsername(username string) string {
+	if username == "" {
+		return "Missing username"
+	}
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return "Username is too long"
+	}
+	return ""
+}
+
+// User returns the public profile of a user along with their itineraries
+func (h *Handler) User(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathId(r, "userId")
+	if !ok {
+		writeError(w, errNotFound("User"))
+		return
+	}
+
+	user, err := h.Store.Users.Get(r.Context(), id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeError(w, errNotFound("User"))
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	dbItineraries, err := h.Store.Itineraries.ListByCreator(r.Context(), user.Id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	var itineraryIds []int
+	for _, itinerary := range dbItineraries {
+		itineraryIds = append(itineraryIds, itinerary.Id)
+	}
+	var comments []database.Comment
+	if len(itineraryIds) > 0 {
+		comments, err = h.Store.Comments.ListByItineraries(r.Context(), itineraryIds)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+	}
+
+	itineraries := []itineraryJSON{}
+	for _, itinerary := range dbItineraries {
+		itineraries = append(itineraries, newItineraryJSON(itinerary, comments))
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		profileJSON
+		Itineraries []itineraryJSON `json:"itineraries"`
+	}{newProfileJSON(user), itineraries})
+}
+
+// profileInput leaves the fields that aren't given unchanged
+type profileInput struct {
+	Username         *string `json:"username"`
+	RemoveProfilePic bool    `json:"removeProfilePic"`
+}
+
+// UpdateProfile changes the current user's username and profile picture.
+// It takes JSON, or a multipart form to upload a new picture.
+func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	user := identity.User
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, errContentType)
+		return
+	}
+
+	var input profileInput
+	multipartForm := mediaType == "multipart/form-data"
+	if multipartForm {
+		if err := r.ParseMultipartForm(h.Config.MaxUploadBytes); err != nil {
+			writeError(w, errInvalidForm)
+			return
+		}
+		if values := r.MultipartForm.Value["username"]; len(values) > 0 {
+			input.Username = &values[0]
+		}
+		input.RemoveProfilePic = r.FormValue("removeProfilePic") == "true"
+	} else if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+
+	if input.Username != nil {
+		if problem := validateUsername(*input.Username); problem != "" {
+			writeError(w, errValidation(map[string]string{"username": problem}))
+			return
+		}
+		user.Username = *input.Username
+	}
+	if input.RemoveProfilePic {
+		// the file itself goes with the next image cleanup
+		user.ProfilePic = sql.NullString{}
+	}
+
+	var storedImagePath string
+	if multipartForm {
+		pfpFile, header, err := r.FormFile("profilePic")
+		switch err {
+		case nil:
+			defer pfpFile.Close()
+			var imageUrl string
+			imageUrl, storedImagePath, err = h.saveProfilePic(r, pfpFile, header)
+			if err != nil {
+				writeInternalError(w, r, err)
+				return
+			}
+			user.ProfilePic = sql.NullString{String: imageUrl, Valid: true}
+
+		case http.ErrMissingFile:
+
+		default:
+			writeError(w, errInvalidForm)
+			return
+		}
+	}
+
+	if err := h.Store.Users.UpdateProfile(r.Context(), user.Id, user.Username, user.ProfilePic); err != nil {
+		removeProfilePic(r, storedImagePath)
+		if err == database.ErrConflict {
+			writeError(w, errUsernameTaken)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(newProfileJSON(user))
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// second factor when 2FA is enabled. Users without a password set their
+// first one within freshLoginTTL of logging in. Every other session and every
+// API token of the user is revoked, the session making the change stays
+// logged in.
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	var input struct {
+		reauthentication
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if problem := h.PasswordPolicy.Check(input.NewPassword, identity.User.Username); problem != "" {
+		writeError(w, errValidation(map[string]string{"newPassword": problem}))
+		return
+	}
+	if !h.reauthenticate(w, r, identity, input.reauthentication) {
+		return
+	}
+
+	hash, err := h.hashPassword(input.NewPassword)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := h.Store.Users.SetPassword(r.Context(), identity.User.Id, hash); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	revoked, err := h.Store.Sessions.DeleteOthersForUser(r.Context(), identity.User.Id, identity.Session.Session_id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	// the route takes a session, so no token is the current one
+	revokedTokens, err := h.Store.APITokens.DeleteAllForUser(r.Context(), identity.User.Id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	logger(r).Info("password changed", "user_id", identity.User.Id, "revoked_sessions", revoked, "revoked_api_tokens", revokedTokens)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAccount deletes the current user after checking their password,
+// or a recent login without one, and second factor when 2FA is enabled.
+// Their itineraries and comments are kept without an author or deleted, as
+// ACCOUNT_DELETION_POLICY says.
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+
+	var creds reauthentication
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, errInvalidJSON)
+		return
+	}
+	if !h.reauthenticate(w, r, identity, creds) {
+		return
+	}
+
+	policy := database.DeletionPolicy(h.Config.AccountDeletionPolicy)
+	if err := h.Store.Users.Delete(r.Context(), identity.User.Id, policy); err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	h.expireSessionCookie(w)
+	logger(r).Info("account deleted", "user_id", identity.User.Id, "policy", policy)
+	w.WriteHeader(http.StatusNoContent)
+}
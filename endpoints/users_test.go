@@ -0,0 +1,124 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"quickstart/database"
+	"quickstart/totp"
+)
+
+// asUserSince is asUser with a session started at loggedInAt
+func asUserSince(r *http.Request, user database.User, loggedInAt time.Time) *http.Request {
+	identity := Identity{User: user, Session: database.Session{User_id: user.Id, Session_id: "test-session", CreatedAt: loggedInAt}}
+	return r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+}
+
+// createPasswordlessUser makes a user like an OIDC or passkey signup does
+func createPasswordlessUser(t *testing.T, h *Handler, username string) database.User {
+	t.Helper()
+	user, err := h.Store.Users.Create(context.Background(), database.User{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var res struct{ Code string }
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("error body %q: %v", body, err)
+	}
+	return res.Code
+}
+
+func TestSetFirstPasswordAfterLogin(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	user := createPasswordlessUser(t, h, "alice")
+	body := map[string]string{"newPassword": "a long new password"}
+
+	loggedInAt := *now
+	*now = now.Add(freshLoginTTL + time.Second)
+	w := serve(h.ChangePassword, asUserSince(jsonRequest(t, "POST", "/users/me/password", body), user, loggedInAt))
+	if w.Code != http.StatusForbidden || errorCode(t, w.Body.Bytes()) != "reauthentication_required" {
+		t.Fatalf("stale session: %d %s, want 403 reauthentication_required", w.Code, w.Body)
+	}
+
+	loggedInAt = *now
+	w = serve(h.ChangePassword, asUserSince(jsonRequest(t, "POST", "/users/me/password", body), user, loggedInAt))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("fresh session: %d %s", w.Code, w.Body)
+	}
+	user, err := h.Store.Users.Get(context.Background(), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.checkPassword("a long new password", user.Password) {
+		t.Error("password wasn't set")
+	}
+
+	// from then on the password is asked for, however recent the login
+	body = map[string]string{"newPassword": "another new password"}
+	w = serve(h.ChangePassword, asUserSince(jsonRequest(t, "POST", "/users/me/password", body), user, loggedInAt))
+	if w.Code != http.StatusForbidden || errorCode(t, w.Body.Bytes()) != "reauthentication_failed" {
+		t.Errorf("without the new password: %d %s, want 403 reauthentication_failed", w.Code, w.Body)
+	}
+}
+
+func TestChangePasswordRevokesOtherSessionsAndTokens(t *testing.T) {
+	h, _ := newTestHandler(t)
+	ctx := context.Background()
+	user := createUser(t, h, "alice", "correct horse", "")
+	for _, sessionId := range []string{"test-session", "other-session"} {
+		if err := h.Store.Sessions.Create(ctx, database.Session{User_id: user.Id, Session_id: sessionId, Expiration: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.Store.APITokens.Create(ctx, database.APIToken{UserId: user.Id, Name: "script", TokenHash: database.HashToken("token"), Scopes: []string{"read"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]string{"password": "correct horse", "newPassword": "a long new password"}
+	if w := serve(h.ChangePassword, asUser(jsonRequest(t, "POST", "/users/me/password", body), user)); w.Code != http.StatusNoContent {
+		t.Fatalf("change: %d %s", w.Code, w.Body)
+	}
+
+	if _, err := h.Store.Sessions.Get(ctx, "test-session"); err != nil {
+		t.Errorf("the session making the change: %v", err)
+	}
+	if _, err := h.Store.Sessions.Get(ctx, "other-session"); err != database.ErrNotFound {
+		t.Errorf("another session: got %v, want ErrNotFound", err)
+	}
+	if tokens, err := h.Store.APITokens.ListByUser(ctx, user.Id); err != nil || len(tokens) != 0 {
+		t.Errorf("tokens left after a change: %v %v", tokens, err)
+	}
+}
+
+func TestDeletePasswordlessAccount(t *testing.T) {
+	h, _ := newTestHandler(t)
+	now := fixedClock(h, time.Date(2026, 3, 1, 12, 0, 15, 0, time.UTC))
+	user := createPasswordlessUser(t, h, "bob")
+	secret, _ := enableTwoFactor(t, h, user)
+	loggedInAt := *now
+
+	// a recent login stands for the password, not for the second factor
+	w := serve(h.DeleteAccount, asUserSince(jsonRequest(t, "DELETE", "/users/me", map[string]string{}), user, loggedInAt))
+	if w.Code != http.StatusForbidden || errorCode(t, w.Body.Bytes()) != "reauthentication_failed" {
+		t.Fatalf("without a code: %d %s, want 403 reauthentication_failed", w.Code, w.Body)
+	}
+
+	*now = now.Add(time.Minute)
+	body := map[string]string{"code": totpCode(t, secret, totp.Step(*now))}
+	w = serve(h.DeleteAccount, asUserSince(jsonRequest(t, "DELETE", "/users/me", body), user, loggedInAt))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("with a code: %d %s", w.Code, w.Body)
+	}
+	if _, err := h.Store.Users.Get(context.Background(), user.Id); err != database.ErrNotFound {
+		t.Errorf("Get after delete: got %v, want ErrNotFound", err)
+	}
+}
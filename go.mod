@@ -9,3 +9,5 @@ require (
 	github.com/lib/pq v1.10.3
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
+
+require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
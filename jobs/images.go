@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"quickstart/database"
+	"quickstart/logging"
+)
+
+// minImageAge spares images uploaded moments ago, their user may not have
+// been created yet
+const minImageAge = time.Hour
+
+// CleanupImages deletes the files in imagesDir that no user has as its
+// profile picture, e.g. left behind by a registration that failed half way
+func CleanupImages(users database.UserStore, imagesDir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		logger := logging.FromContext(ctx)
+
+		entries, err := os.ReadDir(imagesDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		pics, err := users.ListProfilePics(ctx)
+		if err != nil {
+			return err
+		}
+		inUse := make(map[string]bool, len(pics))
+		for _, pic := range pics {
+			// profile pictures are stored as the url they are served at
+			if parsed, err := url.Parse(pic); err == nil {
+				inUse[path.Base(parsed.Path)] = true
+			}
+		}
+
+		deleted := 0
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() || inUse[entry.Name()] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < minImageAge {
+				continue
+			}
+			if err := os.Remove(filepath.Join(imagesDir, entry.Name())); err != nil {
+				logger.Error("deleting orphan image", "file", entry.Name(), "error", err)
+				continue
+			}
+			deleted++
+		}
+		logger.Info("deleted orphan images", "count", deleted)
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"quickstart/logging"
+)
+
+// leaderKey identifies the Postgres advisory lock held by the instance
+// running the jobs, next to the one used by the migrations
+const leaderKey = 727_100_002
+
+// Leader decides which instance runs the jobs when several are deployed
+type Leader interface {
+	// Acquire reports whether this instance leads, trying to become the
+	// leader if it doesn't yet
+	Acquire(ctx context.Context) (bool, error)
+	Release()
+}
+
+// Standalone always leads, for a single instance or the in-memory store
+type Standalone struct{}
+
+func (Standalone) Acquire(ctx context.Context) (bool, error) { return true, nil }
+func (Standalone) Release()                                  {}
+
+// PostgresLeader holds a session level advisory lock on a dedicated
+// connection, so leadership moves to another instance as soon as that
+// connection goes away
+type PostgresLeader struct {
+	db *sql.DB
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+func NewPostgresLeader(db *sql.DB) *PostgresLeader {
+	return &PostgresLeader{db: db}
+}
+
+func (l *PostgresLeader) Acquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+		// the lock went away with the connection, or will once it's closed
+		l.release()
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderKey).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return false, err
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *PostgresLeader) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release()
+}
+
+func (l *PostgresLeader) release() {
+	if l.conn == nil {
+		return
+	}
+	// closing only returns the connection to the pool, which would keep
+	// the lock, so unlock explicitly
+	if _, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", leaderKey); err != nil {
+		logging.Default().Warn("releasing job leadership", "error", err)
+	}
+	l.conn.Close()
+	l.conn = nil
+}
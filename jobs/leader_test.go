@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to TEST_DATABASE_URL, skipping the test without it
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func acquire(t *testing.T, l *PostgresLeader, want bool) {
+	t.Helper()
+	leads, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leads != want {
+		t.Fatalf("Acquire: %v, want %v", leads, want)
+	}
+}
+
+func TestPostgresLeader(t *testing.T) {
+	db := openTestDB(t)
+	first, second := NewPostgresLeader(db), NewPostgresLeader(db)
+	defer first.Release()
+	defer second.Release()
+
+	acquire(t, first, true)
+	acquire(t, first, true)
+	acquire(t, second, false)
+
+	first.Release()
+	acquire(t, second, true)
+	acquire(t, first, false)
+}
+
+func TestPostgresLeaderReacquiresAfterDroppedConnection(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	leader, other := NewPostgresLeader(db), NewPostgresLeader(db)
+	defer leader.Release()
+	defer other.Release()
+
+	acquire(t, leader, true)
+	var pid int
+	if err := leader.conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "SELECT pg_terminate_backend($1)", pid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lock went away with the connection, whoever asks first gets it
+	acquire(t, leader, true)
+	acquire(t, other, false)
+
+	var held bool
+	err := leader.conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND objid = $1 AND pid = pg_backend_pid())", leaderKey).Scan(&held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Error("the new connection doesn't hold the advisory lock")
+	}
+}
@@ -0,0 +1,194 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"quickstart/logging"
+)
+
+// Job is a named task the Scheduler runs every Interval. Run gets a context
+// carrying a logger tagged with the job name.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Stats are the counters kept for a job since the process started
+type Stats struct {
+	Name     string
+	Interval time.Duration
+	Runs     int64
+	Failures int64
+	// Skipped counts the runs left to another instance holding the leadership
+	Skipped      int64
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+}
+
+// Scheduler runs jobs on their own interval, only on the instance that is
+// the leader. Every wait gets a random delay of up to jitter added so that
+// replicas started together don't hit the database at the same moment.
+type Scheduler struct {
+	leader Leader
+	jitter time.Duration
+	logger *logging.Logger
+
+	// sleep waits for d, returning false instead when ctx is cancelled
+	// first. Tests replace it to run without waiting.
+	sleep func(ctx context.Context, d time.Duration) bool
+
+	mu    sync.Mutex
+	jobs  []Job
+	stats map[string]*Stats
+	rand  *rand.Rand
+}
+
+func New(leader Leader, jitter time.Duration, logger *logging.Logger) *Scheduler {
+	return &Scheduler{
+		leader: leader,
+		jitter: jitter,
+		logger: logger,
+		sleep:  sleep,
+		stats:  map[string]*Stats{},
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add registers a job, a job without a positive interval is disabled
+func (s *Scheduler) Add(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.stats[job.Name]; ok {
+		panic(fmt.Sprintf("jobs: %s added twice", job.Name))
+	}
+	s.stats[job.Name] = &Stats{Name: job.Name, Interval: job.Interval}
+	if job.Interval <= 0 {
+		s.logger.Info("job disabled", "job", job.Name)
+		return
+	}
+	s.jobs = append(s.jobs, job)
+}
+
+// Run blocks until ctx is cancelled and every running job has returned,
+// then gives up the leadership
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	jobs := append([]Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			s.loop(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+	s.leader.Release()
+}
+
+// Stats returns a snapshot of every job's counters, sorted by name
+func (s *Scheduler) Stats() []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]Stats, 0, len(s.stats))
+	for _, stat := range s.stats {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+	// the first run only waits for the jitter so that short lived
+	// instances still get their turn
+	delay := s.randomDelay()
+	for s.sleep(ctx, delay) {
+		s.runOnce(ctx, job)
+		delay = job.Interval + s.randomDelay()
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *Scheduler) randomDelay() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.jitter)))
+}
+
+func (s *Scheduler) runOnce(ctx context.Context, job Job) {
+	logger := s.logger.With("job", job.Name)
+
+	leader, err := s.leader.Acquire(ctx)
+	if err != nil {
+		logger.Error("acquiring leadership", "error", err)
+	}
+	if !leader {
+		s.record(job.Name, func(stat *Stats) { stat.Skipped++ })
+		return
+	}
+
+	start := time.Now()
+	err = run(logging.NewContext(ctx, logger), job)
+	duration := time.Since(start)
+
+	s.record(job.Name, func(stat *Stats) {
+		stat.Runs++
+		stat.LastRun = start
+		stat.LastDuration = duration
+		stat.LastError = ""
+		if err != nil {
+			stat.Failures++
+			stat.LastError = err.Error()
+		}
+	})
+
+	if err != nil {
+		logger.Error("job failed", "duration_ms", duration.Milliseconds(), "error", err)
+		return
+	}
+	logger.Info("job finished", "duration_ms", duration.Milliseconds())
+}
+
+// run calls the job, turning a panic into an error so that one broken job
+// doesn't take the server down
+func run(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func (s *Scheduler) record(name string, update func(stat *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(s.stats[name])
+}
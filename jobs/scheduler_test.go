@@ -0,0 +1,226 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"quickstart/logging"
+)
+
+// fakeLeader leads or not as told by leads, one answer per Acquire,
+// repeating the last one
+type fakeLeader struct {
+	mu       sync.Mutex
+	leads    []bool
+	err      error
+	acquired int
+	released int
+}
+
+func (l *fakeLeader) Acquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	leads := l.leads[len(l.leads)-1]
+	if l.acquired < len(l.leads) {
+		leads = l.leads[l.acquired]
+	}
+	l.acquired++
+	return leads, l.err
+}
+
+func (l *fakeLeader) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released++
+}
+
+// fakeSleep records the waits without waiting, and cancels the run on the
+// wait after the first n
+type fakeSleep struct {
+	mu     sync.Mutex
+	n      int
+	cancel context.CancelFunc
+	waits  []time.Duration
+}
+
+func (f *fakeSleep) sleep(ctx context.Context, d time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waits = append(f.waits, d)
+	if len(f.waits) > f.n {
+		f.cancel()
+		return false
+	}
+	return true
+}
+
+// newTestScheduler returns a scheduler whose job loops stop after n runs
+func newTestScheduler(leader Leader, jitter time.Duration, n int) (*Scheduler, *fakeSleep, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sleep := &fakeSleep{n: n, cancel: cancel}
+	s := New(leader, jitter, logging.New(io.Discard))
+	s.sleep = sleep.sleep
+	s.rand = rand.New(rand.NewSource(1))
+	return s, sleep, ctx
+}
+
+func counter(runs *int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		*runs++
+		return nil
+	}
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	leader := &fakeLeader{leads: []bool{true}}
+	s, sleep, ctx := newTestScheduler(leader, 0, 3)
+	var runs int
+	s.Add(Job{Name: "cleanup", Interval: time.Hour, Run: counter(&runs)})
+	s.Run(ctx)
+
+	want := []time.Duration{0, time.Hour, time.Hour, time.Hour}
+	if len(sleep.waits) != len(want) {
+		t.Fatalf("waits %v, want %v", sleep.waits, want)
+	}
+	for i := range want {
+		if sleep.waits[i] != want[i] {
+			t.Errorf("wait %d: %v, want %v", i, sleep.waits[i], want[i])
+		}
+	}
+	if runs != 3 {
+		t.Errorf("%d runs, want 3", runs)
+	}
+	stats := s.Stats()
+	if len(stats) != 1 || stats[0].Runs != 3 || stats[0].Skipped != 0 || stats[0].LastRun.IsZero() {
+		t.Errorf("stats %+v, want 3 runs", stats)
+	}
+	if leader.released != 1 {
+		t.Errorf("leadership released %d times, want once", leader.released)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	s, sleep, ctx := newTestScheduler(&fakeLeader{leads: []bool{true}}, time.Minute, 20)
+	var runs int
+	s.Add(Job{Name: "cleanup", Interval: time.Hour, Run: counter(&runs)})
+	s.Run(ctx)
+
+	if first := sleep.waits[0]; first < 0 || first >= time.Minute {
+		t.Errorf("first wait %v, want under the jitter", first)
+	}
+	distinct := map[time.Duration]bool{}
+	for i, wait := range sleep.waits[1:] {
+		if wait < time.Hour || wait >= time.Hour+time.Minute {
+			t.Errorf("wait %d: %v, want the interval plus up to a minute", i+1, wait)
+		}
+		distinct[wait] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("waits %v, want them to vary", sleep.waits)
+	}
+}
+
+func TestSchedulerSkipsWhenNotLeader(t *testing.T) {
+	leader := &fakeLeader{leads: []bool{false, true, false}}
+	s, _, ctx := newTestScheduler(leader, 0, 4)
+	var runs int
+	s.Add(Job{Name: "cleanup", Interval: time.Hour, Run: counter(&runs)})
+	s.Run(ctx)
+
+	if runs != 1 {
+		t.Errorf("%d runs, want only the one as the leader", runs)
+	}
+	if stats := s.Stats(); stats[0].Runs != 1 || stats[0].Skipped != 3 {
+		t.Errorf("stats %+v, want 1 run and 3 skipped", stats[0])
+	}
+
+	// an error asking for the leadership skips the run too
+	leader = &fakeLeader{leads: []bool{false}, err: errors.New("connection refused")}
+	s, _, ctx = newTestScheduler(leader, 0, 2)
+	runs = 0
+	s.Add(Job{Name: "cleanup", Interval: time.Hour, Run: counter(&runs)})
+	s.Run(ctx)
+	if runs != 0 {
+		t.Errorf("%d runs after errors, want 0", runs)
+	}
+	if stats := s.Stats(); stats[0].Skipped != 2 {
+		t.Errorf("stats %+v, want 2 skipped", stats[0])
+	}
+}
+
+func TestSchedulerRecordsFailures(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(ctx context.Context) error
+		want string
+	}{
+		{"error", func(ctx context.Context) error { return errors.New("disk full") }, "disk full"},
+		{"panic", func(ctx context.Context) error { panic("nil map") }, "panic: nil map"},
+	}
+	for _, c := range cases {
+		s, _, ctx := newTestScheduler(&fakeLeader{leads: []bool{true}}, 0, 2)
+		s.Add(Job{Name: "failing", Interval: time.Hour, Run: c.run})
+		s.Run(ctx)
+		if stats := s.Stats(); stats[0].Runs != 2 || stats[0].Failures != 2 || stats[0].LastError != c.want {
+			t.Errorf("%s: stats %+v, want 2 failures with %q", c.name, stats[0], c.want)
+		}
+	}
+}
+
+func TestSchedulerDisabledJob(t *testing.T) {
+	s, sleep, ctx := newTestScheduler(&fakeLeader{leads: []bool{true}}, 0, 1)
+	s.Add(Job{Name: "disabled", Run: func(ctx context.Context) error {
+		t.Error("disabled job ran")
+		return nil
+	}})
+	s.Run(ctx)
+	if len(sleep.waits) != 0 {
+		t.Errorf("waits %v, want none", sleep.waits)
+	}
+	if stats := s.Stats(); len(stats) != 1 || stats[0].Name != "disabled" || stats[0].Runs != 0 {
+		t.Errorf("stats %+v, want the disabled job listed without runs", stats)
+	}
+}
+
+func TestSchedulerStopsOnCancel(t *testing.T) {
+	leader := &fakeLeader{leads: []bool{true}}
+	s := New(leader, 0, logging.New(io.Discard))
+	started, stopped := make(chan struct{}), make(chan struct{})
+	s.Add(Job{Name: "slow", Interval: time.Hour, Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	}})
+	s.Add(Job{Name: "waiting", Interval: time.Hour, Run: func(ctx context.Context) error {
+		return nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Run returned before the running job")
+	}
+	if leader.released != 1 {
+		t.Errorf("leadership released %d times, want once", leader.released)
+	}
+}
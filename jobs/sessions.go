@@ -0,0 +1,46 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"quickstart/database"
+	"quickstart/logging"
+)
+
+// PurgeSessions deletes every expired session in a single statement
+func PurgeSessions(sessions database.SessionStore) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		deleted, err := sessions.DeleteExpired(ctx)
+		if err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("purged expired sessions", "count", deleted)
+		return nil
+	}
+}
+
+// PurgeLoginThrottles forgets the failed logins older than maxAge
+func PurgeLoginThrottles(throttles database.LoginThrottleStore, maxAge time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		deleted, err := throttles.DeleteStale(ctx, time.Now().Add(-maxAge))
+		if err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("purged stale login throttles", "count", deleted)
+		return nil
+	}
+}
+
+// PurgePasskeyChallenges deletes the challenges of passkey registrations
+// and logins that were never finished
+func PurgePasskeyChallenges(passkeys database.PasskeyStore) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		deleted, err := passkeys.DeleteExpiredChallenges(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("purged expired passkey challenges", "count", deleted)
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger writes one JSON object per line. Loggers derived through With
+// share the output and its lock.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	fields map[string]interface{}
+}
+
+func New(out io.Writer) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, fields: map[string]interface{}{}}
+}
+
+var defaultLogger = New(os.Stdout)
+
+// Default is used when there is no logger in the context
+func Default() *Logger {
+	return defaultLogger
+}
+
+// With returns a logger that adds the given key value pairs to every line
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+len(keyValues)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	addFields(fields, keyValues)
+	return &Logger{mu: l.mu, out: l.out, fields: fields}
+}
+
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.write("info", msg, keyValues)
+}
+
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.write("warn", msg, keyValues)
+}
+
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.write("error", msg, keyValues)
+}
+
+func (l *Logger) write(level string, msg string, keyValues []interface{}) {
+	line := make(map[string]interface{}, len(l.fields)+len(keyValues)/2+3)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	addFields(line, keyValues)
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = msg
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		encoded, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": "unencodable log line", "error": err.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(encoded, '\n'))
+}
+
+func addFields(fields map[string]interface{}, keyValues []interface{}) {
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		key := fmt.Sprint(keyValues[i])
+		value := keyValues[i+1]
+		// errors marshal as {} otherwise
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+	if len(keyValues)%2 == 1 {
+		fields["!extra"] = keyValues[len(keyValues)-1]
+	}
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the request scoped logger, or the default one
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File writes every message as an .eml file in a directory, for local
+// development
+type File struct {
+	dir  string
+	from string
+
+	mu    sync.Mutex
+	count int
+}
+
+func NewFile(dir string, from string) *File {
+	return &File{dir: dir, from: from}
+}
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	body, err := render(f.from, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.count++
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405.000000000"), f.count)
+	f.mu.Unlock()
+
+	return os.WriteFile(filepath.Join(f.dir, name), body, 0600)
+}
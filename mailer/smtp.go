@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+
+	"quickstart/config"
+)
+
+// SMTP sends through a mail server, authenticating when a username is set
+type SMTP struct {
+	addr string
+	from string
+	// envelope is the bare address of from, e.g. without a display name
+	envelope string
+	auth     smtp.Auth
+}
+
+func NewSMTP(cfg config.Mail) *SMTP {
+	s := &SMTP{addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort), from: cfg.From, envelope: cfg.From}
+	if address, err := mail.ParseAddress(cfg.From); err == nil {
+		s.envelope = address.Address
+	}
+	if cfg.SMTPUsername != "" {
+		s.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return s
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	body, err := render(s.from, msg)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp doesn't take a context, at least don't start once cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.envelope, []string{msg.To}, body)
+}
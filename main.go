@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"quickstart/config"
 	"quickstart/database"
 	"quickstart/endpoints"
-	"time"
+	"quickstart/jobs"
+	"quickstart/logging"
+	"quickstart/mailer"
+	"quickstart/migrations"
+	"quickstart/passwords"
+	"syscall"
 
-	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -20,113 +29,133 @@ type City struct {
 	Name string `json:"name"`
 }
 
-var Db *sql.DB
+func main() {
+	godotenv.Load()
 
-// Cron job to delete expired sessions every 24 hours
-func deleteOldSessions() {
-	for range time.Tick(time.Hour * 24) {
-		rows, err := Db.Query("SELECT session_id, id FROM sessions WHERE expiration < NOW()")
+	log.SetOutput(os.Stdout) // Set log output to standard output
 
-		if err != nil {
-			panic(err)
-		}
+	if err := run(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// run starts the server and blocks until it has shut down, so that its
+// deferred cleanup runs before main exits
+func run() error {
+	cfg, args, err := config.Load(os.Args[1:], os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	// cancelled on SIGINT/SIGTERM, stopping the server and background jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		for rows.Next() {
-			var sessionId string
-			var id int
-			err = rows.Scan(&sessionId, &id)
-			if err != nil {
-				panic(err)
-			}
-			log.Println("Deleting session:", sessionId)
-			_, err := Db.Exec("DELETE FROM sessions WHERE id = $1", id)
-			if err != nil {
-				panic(err)
-			}
+	newDb, err := sql.Open("postgres", cfg.DB.ConnectionString())
+	if err != nil {
+		return err
+	}
+	defer newDb.Close()
+
+	err = newDb.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Successfully connected!")
+
+	migrator, err := migrations.New(newDb)
+	if err != nil {
+		return err
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		return runMigrateCommand(ctx, migrator, args[1:])
+	}
+
+	// Bring the schema up to date unless explicitly disabled
+	if cfg.DB.AutoMigrate {
+		if err := migrator.Up(ctx); err != nil {
+			return err
 		}
 	}
 
-}
+	store := database.NewPostgresStores(newDb)
 
-func main() {
-	godotenv.Load()
+	if len(args) > 0 && args[0] == "make-admin" {
+		return runMakeAdminCommand(ctx, store.Users, args[1:])
+	}
 
-	log.SetOutput(os.Stdout) // Set log output to standard output
+	// the login link counters share the throttles table, keep them as long
+	// as they matter
+	throttleMaxAge := cfg.LoginLockoutDuration
+	if cfg.MagicLinkWindow > throttleMaxAge {
+		throttleMaxAge = cfg.MagicLinkWindow
+	}
 
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	dbname := os.Getenv("DB_DBNAME")
+	scheduler := jobs.New(jobs.NewPostgresLeader(newDb), cfg.JobJitter, logging.Default())
+	scheduler.Add(jobs.Job{Name: "purge_sessions", Interval: cfg.SessionPurgeInterval, Run: jobs.PurgeSessions(store.Sessions)})
+	scheduler.Add(jobs.Job{Name: "purge_login_throttles", Interval: cfg.SessionPurgeInterval, Run: jobs.PurgeLoginThrottles(store.Throttles, throttleMaxAge)})
+	scheduler.Add(jobs.Job{Name: "purge_passkey_challenges", Interval: cfg.SessionPurgeInterval, Run: jobs.PurgePasskeyChallenges(store.Passkeys)})
+	scheduler.Add(jobs.Job{Name: "cleanup_images", Interval: cfg.ImageCleanupInterval, Run: jobs.CleanupImages(store.Users, filepath.Join(cfg.StaticDir, "images"))})
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	newDb, err := sql.Open("postgres", psqlInfo)
+	mail, err := mailer.New(cfg.Mail)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	Db = newDb
-	database.Db = newDb
 
-	err = newDb.Ping()
+	policy, err := passwords.NewPolicy(cfg.Passwords)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Println("Successfully connected!")
-	defer newDb.Close()
+	h, err := endpoints.New(cfg, store, scheduler, mail, policy)
+	if err != nil {
+		return err
+	}
 
-	r := mux.NewRouter()
-
-	// CORS
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// TODO Allow Origin is string array or origin
-			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-			w.Header().Set("Vary", "Origin")
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			// if Preflight
-			if r.Method == "OPTIONS" {
-				w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%v", (60*5)))
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			next.ServeHTTP(w, r)
-
-		})
-	})
-
-	s := http.StripPrefix("/static/", http.FileServer(http.Dir("./static/")))
-	r.PathPrefix("/static/").Handler(s)
-
-	r.HandleFunc("/cities", returnsJSONMiddleware(endpoints.Cities))
-	r.HandleFunc("/cities/{cityId:[0-9]+}", returnsJSONMiddleware(endpoints.City))
-	r.HandleFunc("/cities/{cityId:[0-9]+}/itinerary", returnsJSONMiddleware(endpoints.CityItineraries))
-
-	r.HandleFunc("/auth/login", returnsJSONMiddleware(endpoints.Login))
-	r.HandleFunc("/auth/register", endpoints.Register)
-	r.HandleFunc("/auth/isLoggedIn", endpoints.IsLoggedIn)
-	r.HandleFunc("/auth/logout", endpoints.Logout)
-
-	r.HandleFunc("/itinerary", endpoints.Itineraries)
-	r.HandleFunc("/itinerary/{itineraryId:[0-9]+}", returnsJSONMiddleware(endpoints.Itinerary))
-	r.HandleFunc("/itinerary/{itineraryId:[0-9]+}/comment", returnsJSONMiddleware(endpoints.ItineraryComment))
-
-	http.Handle("/", r)
-
-	// Cron job
-	go deleteOldSessions()
-	log.Fatal(http.ListenAndServe(":8001", nil))
-}
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      newRouter(cfg, h),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
 
-type endpoint func(http.ResponseWriter, *http.Request)
+	// Background jobs, they stop with ctx
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		scheduler.Run(ctx)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	logger := logging.Default()
+	select {
+	case err = <-serverErr:
+		// the server never started, e.g. the address is in use
+		stop()
+		<-jobsDone
+		return err
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process right away
 
-func returnsJSONMiddleware(fn endpoint) endpoint {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fn(w, r)
+	logger.Info("shutting down", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("draining requests", "error", err)
 	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("serving", "error", err)
+	}
+
+	<-jobsDone
+	logger.Info("shut down")
+	return nil
 }
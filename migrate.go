@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"quickstart/migrations"
+	"strconv"
+)
+
+var errMigrateUsage = errors.New("usage: migrate up | down [steps] | version")
+
+// runMigrateCommand handles `migrate up`, `migrate down [steps]` and
+// `migrate version`
+func runMigrateCommand(ctx context.Context, migrator *migrations.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return errors.New("steps must be a positive number")
+			}
+		}
+		return migrator.Down(ctx, steps)
+
+	case "version":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("current: %d, latest: %d\n", version, migrator.Latest())
+		return nil
+
+	default:
+		return errMigrateUsage
+	}
+}
@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func mapFS(files ...string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for _, name := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte("-- " + name)}
+	}
+	return fsys
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(mapFS(
+		"0010_comments.up.sql",
+		"0002_users.down.sql",
+		"0001_init.up.sql",
+		"0002_users.up.sql",
+		"0001_init.down.sql",
+		"0003_no_way_back.up.sql",
+		"0004_cities.up.sql",
+		"0004_cities.down.sql",
+		"0005_e.up.sql", "0006_f.up.sql", "0007_g.up.sql", "0008_h.up.sql", "0009_i.up.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []int
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	if want := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !reflect.DeepEqual(versions, want) {
+		t.Fatalf("versions %v, want %v sorted numerically", versions, want)
+	}
+
+	want := []Migration{
+		{Version: 1, Name: "init", Up: "-- 0001_init.up.sql", Down: "-- 0001_init.down.sql"},
+		{Version: 2, Name: "users", Up: "-- 0002_users.up.sql", Down: "-- 0002_users.down.sql"},
+		{Version: 3, Name: "no_way_back", Up: "-- 0003_no_way_back.up.sql"},
+	}
+	if !reflect.DeepEqual(migrations[:3], want) {
+		t.Errorf("got %+v, want %+v", migrations[:3], want)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	cases := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"version gap", []string{"0001_init.up.sql", "0003_users.up.sql"}, "migration 2 is missing"},
+		{"no version 1", []string{"0002_users.up.sql"}, "migration 1 is missing"},
+		{"version 0", []string{"0000_init.up.sql", "0001_users.up.sql"}, "invalid migration file name"},
+		{"duplicate version", []string{"0001_init.up.sql", "0001_users.up.sql"}, "conflicting names"},
+		{"duplicate up file", []string{"0001_init.up.sql", "1_init.up.sql"}, "more than one up file"},
+		{"duplicate down file", []string{"0001_init.up.sql", "0001_init.down.sql", "01_init.down.sql"}, "more than one down file"},
+		{"down without up", []string{"0001_init.up.sql", "0002_users.down.sql"}, "migration 2 is missing its up file"},
+		{"no direction", []string{"0001_init.sql"}, "invalid migration file name"},
+		{"unknown direction", []string{"0001_init.sideways.sql"}, "invalid migration file name"},
+		{"no version", []string{"init.up.sql"}, "invalid migration file name"},
+		{"no name", []string{"0001.up.sql"}, "invalid migration file name"},
+		{"not sql", []string{"0001_init.up.sql", "README.md"}, "invalid migration file name"},
+	}
+	for _, c := range cases {
+		_, err := Load(mapFS(c.files...))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrator, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrator.migrations {
+		if migration.Down == "" {
+			t.Errorf("migration %d_%s has no down file", migration.Version, migration.Name)
+		}
+	}
+	if latest := migrator.Latest(); latest != len(migrator.migrations) {
+		t.Errorf("latest %d, want %d", latest, len(migrator.migrations))
+	}
+}
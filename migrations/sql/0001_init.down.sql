@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS SESSIONS;
+DROP TABLE IF EXISTS ITINERARY_COMMENTS;
+DROP TABLE IF EXISTS ITINERARY_COMMENT;
+DROP TABLE IF EXISTS ITINERARY;
+DROP TABLE IF EXISTS CITY;
+DROP TABLE IF EXISTS USERS;
@@ -35,4 +35,4 @@ create table if not exists SESSIONS (
     user_id INT not null references users(id),
     session_id TEXT not null unique,
     expiration TIMESTAMP with time zone not null
-);
\ No newline at end of file
+);
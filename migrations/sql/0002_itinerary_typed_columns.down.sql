@@ -0,0 +1,8 @@
+ALTER TABLE ITINERARY DROP COLUMN price_currency;
+ALTER TABLE ITINERARY DROP CONSTRAINT itinerary_price_amount_check;
+ALTER TABLE ITINERARY ALTER COLUMN price_amount TYPE VARCHAR(40) USING price_amount::TEXT;
+ALTER TABLE ITINERARY RENAME COLUMN price_amount TO price;
+
+ALTER TABLE ITINERARY DROP CONSTRAINT itinerary_duration_check;
+ALTER TABLE ITINERARY ALTER COLUMN duration TYPE VARCHAR(40) USING duration::TEXT;
+ALTER TABLE ITINERARY RENAME COLUMN duration TO time;
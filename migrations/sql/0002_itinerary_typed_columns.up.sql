@@ -0,0 +1,13 @@
+-- time and price used to be free-form VARCHARs holding numbers
+ALTER TABLE ITINERARY RENAME COLUMN time TO duration;
+ALTER TABLE ITINERARY
+    ALTER COLUMN duration TYPE INTEGER
+    USING COALESCE(substring(duration FROM '[0-9]+'), '0')::INTEGER;
+ALTER TABLE ITINERARY ADD CONSTRAINT itinerary_duration_check CHECK (duration >= 0);
+
+ALTER TABLE ITINERARY RENAME COLUMN price TO price_amount;
+ALTER TABLE ITINERARY
+    ALTER COLUMN price_amount TYPE NUMERIC(12, 2)
+    USING COALESCE(substring(price_amount FROM '[0-9]+(?:\.[0-9]+)?'), '0')::NUMERIC(12, 2);
+ALTER TABLE ITINERARY ADD CONSTRAINT itinerary_price_amount_check CHECK (price_amount >= 0);
+ALTER TABLE ITINERARY ADD COLUMN price_currency CHAR(3) NOT NULL DEFAULT 'USD';
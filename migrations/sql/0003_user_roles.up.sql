@@ -0,0 +1,2 @@
+ALTER TABLE USERS ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
+ALTER TABLE USERS ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'moderator', 'admin'));
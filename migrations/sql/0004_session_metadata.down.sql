@@ -0,0 +1,5 @@
+DROP INDEX sessions_user_id_idx;
+ALTER TABLE SESSIONS DROP COLUMN ip_address;
+ALTER TABLE SESSIONS DROP COLUMN user_agent;
+ALTER TABLE SESSIONS DROP COLUMN last_seen_at;
+ALTER TABLE SESSIONS DROP COLUMN created_at;
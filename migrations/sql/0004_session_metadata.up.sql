@@ -0,0 +1,5 @@
+ALTER TABLE SESSIONS ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE SESSIONS ADD COLUMN last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE SESSIONS ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE SESSIONS ADD COLUMN ip_address VARCHAR(45) NOT NULL DEFAULT '';
+CREATE INDEX sessions_user_id_idx ON SESSIONS (user_id);
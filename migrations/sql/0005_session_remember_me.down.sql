@@ -0,0 +1 @@
+ALTER TABLE SESSIONS DROP COLUMN remember_me;
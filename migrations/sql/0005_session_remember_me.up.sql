@@ -0,0 +1 @@
+ALTER TABLE SESSIONS ADD COLUMN remember_me BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+ALTER TABLE SESSIONS DROP COLUMN csrf_token;
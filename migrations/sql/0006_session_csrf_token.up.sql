@@ -0,0 +1,2 @@
+-- sessions from before this migration get a token on their first GET /auth/csrf
+ALTER TABLE SESSIONS ADD COLUMN csrf_token TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+DROP TABLE API_TOKENS;
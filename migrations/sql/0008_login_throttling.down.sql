@@ -0,0 +1,2 @@
+DROP TABLE LOCKOUT_EVENTS;
+DROP TABLE LOGIN_THROTTLES;
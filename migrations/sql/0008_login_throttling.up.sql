@@ -0,0 +1,17 @@
+-- failed logins per account (lowercased username) and per IP, keyed as
+-- account:<username> and ip:<address>
+CREATE TABLE LOGIN_THROTTLES (
+    key TEXT NOT NULL PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE LOCKOUT_EVENTS (
+    id SERIAL NOT NULL PRIMARY KEY,
+    key TEXT NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    failures INT NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP TABLE USER_TOKENS;
+DROP INDEX users_email_key;
+ALTER TABLE USERS DROP COLUMN email;
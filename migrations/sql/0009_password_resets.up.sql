@@ -0,0 +1,15 @@
+-- emails are stored lowercased
+ALTER TABLE USERS ADD COLUMN email VARCHAR(254);
+CREATE UNIQUE INDEX users_email_key ON USERS (email);
+
+-- single use tokens mailed to users, purpose tells what they are for
+CREATE TABLE USER_TOKENS (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX user_tokens_user_id_idx ON USER_TOKENS (user_id, purpose);
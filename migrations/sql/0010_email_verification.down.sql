@@ -0,0 +1 @@
+ALTER TABLE USERS DROP COLUMN email_verified_at;
@@ -0,0 +1,2 @@
+-- NULL until the user follows the link mailed to their current address
+ALTER TABLE USERS ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,2 @@
+DROP TABLE RECOVERY_CODES;
+DROP TABLE USER_TOTP;
@@ -0,0 +1,18 @@
+-- the secret is stored as is, codes can't be checked against a hash
+CREATE TABLE USER_TOTP (
+    user_id INT NOT NULL PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    -- NULL while enrolling, 2FA is only enforced once confirmed
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    -- time step of the last accepted code, so that a code works once
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE RECOVERY_CODES (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX recovery_codes_user_id_idx ON RECOVERY_CODES (user_id);
@@ -0,0 +1 @@
+DROP TABLE EXTERNAL_IDENTITIES;
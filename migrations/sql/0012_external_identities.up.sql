@@ -0,0 +1,12 @@
+-- accounts at OpenID Connect providers users log in with, the subject is
+-- only unique per issuer
+CREATE TABLE EXTERNAL_IDENTITIES (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(254),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+CREATE INDEX external_identities_user_id_idx ON EXTERNAL_IDENTITIES (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE PASSKEY_CHALLENGES;
+DROP TABLE PASSKEYS;
@@ -0,0 +1,23 @@
+-- WebAuthn credentials, the public key is COSE encoded as the authenticator
+-- sent it
+CREATE TABLE PASSKEYS (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX passkeys_user_id_idx ON PASSKEYS (user_id);
+
+-- challenges handed out for passkey ceremonies, login ones aren't tied to a
+-- user until the passkey tells who it is
+CREATE TABLE PASSKEY_CHALLENGES (
+    challenge_hash CHAR(64) NOT NULL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX passkey_challenges_expires_at_idx ON PASSKEY_CHALLENGES (expires_at);
@@ -0,0 +1,22 @@
+ALTER TABLE SESSIONS DROP CONSTRAINT sessions_user_id_fkey;
+ALTER TABLE SESSIONS ADD CONSTRAINT sessions_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES USERS(id);
+
+-- content without an author can't be kept
+DELETE FROM ITINERARY_COMMENTS
+WHERE comment_id IN (SELECT id FROM ITINERARY_COMMENT WHERE author_id IS NULL)
+    OR itinerary_id IN (SELECT id FROM ITINERARY WHERE creator IS NULL);
+DELETE FROM ITINERARY_COMMENT WHERE author_id IS NULL;
+DELETE FROM ITINERARY WHERE creator IS NULL;
+
+DROP INDEX itinerary_comment_author_id_idx;
+ALTER TABLE ITINERARY_COMMENT DROP CONSTRAINT itinerary_comment_author_id_fkey;
+ALTER TABLE ITINERARY_COMMENT ADD CONSTRAINT itinerary_comment_author_id_fkey
+    FOREIGN KEY (author_id) REFERENCES USERS(id);
+ALTER TABLE ITINERARY_COMMENT ALTER COLUMN author_id SET NOT NULL;
+
+DROP INDEX itinerary_creator_idx;
+ALTER TABLE ITINERARY DROP CONSTRAINT itinerary_creator_fkey;
+ALTER TABLE ITINERARY ADD CONSTRAINT itinerary_creator_fkey
+    FOREIGN KEY (creator) REFERENCES USERS(id);
+ALTER TABLE ITINERARY ALTER COLUMN creator SET NOT NULL;
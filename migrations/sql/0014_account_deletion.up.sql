@@ -0,0 +1,17 @@
+-- itineraries and comments can outlive their deleted author, depending on
+-- ACCOUNT_DELETION_POLICY
+ALTER TABLE ITINERARY ALTER COLUMN creator DROP NOT NULL;
+ALTER TABLE ITINERARY DROP CONSTRAINT itinerary_creator_fkey;
+ALTER TABLE ITINERARY ADD CONSTRAINT itinerary_creator_fkey
+    FOREIGN KEY (creator) REFERENCES USERS(id) ON DELETE SET NULL;
+CREATE INDEX itinerary_creator_idx ON ITINERARY (creator);
+
+ALTER TABLE ITINERARY_COMMENT ALTER COLUMN author_id DROP NOT NULL;
+ALTER TABLE ITINERARY_COMMENT DROP CONSTRAINT itinerary_comment_author_id_fkey;
+ALTER TABLE ITINERARY_COMMENT ADD CONSTRAINT itinerary_comment_author_id_fkey
+    FOREIGN KEY (author_id) REFERENCES USERS(id) ON DELETE SET NULL;
+CREATE INDEX itinerary_comment_author_id_idx ON ITINERARY_COMMENT (author_id);
+
+ALTER TABLE SESSIONS DROP CONSTRAINT sessions_user_id_fkey;
+ALTER TABLE SESSIONS ADD CONSTRAINT sessions_user_id_fkey
+    FOREIGN KEY (user_id) REFERENCES USERS(id) ON DELETE CASCADE;
@@ -0,0 +1,359 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// leeway allows for clock differences with the provider
+	leeway = time.Minute
+	// minKeyRefresh limits how often an unknown key id makes us fetch the
+	// key set again, so that forged tokens can't hammer the provider
+	minKeyRefresh = time.Minute
+	minRSABits    = 2048
+)
+
+var ErrInvalidToken = errors.New("oidc: invalid id token")
+
+// Claims are the ID token claims we use
+type Claims struct {
+	// Subject identifies the user at the issuer, it never changes
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// audience is a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*a = list
+	return err
+}
+
+// flexibleBool accepts "true" as some providers send email_verified as a
+// string
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = s == "true"
+		return nil
+	}
+	var v bool
+	err := json.Unmarshal(data, &v)
+	*b = flexibleBool(v)
+	return err
+}
+
+type idToken struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          audience     `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expiry            float64      `json:"exp"`
+	IssuedAt          float64      `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
+
+// Verify checks the ID token's signature against the provider's keys and
+// its claims as OpenID Connect Core 1.0 section 3.1.3.7 requires
+func (p *Provider) Verify(ctx context.Context, raw string, nonce string, now time.Time) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return Claims{}, invalid("not a JWS compact serialization")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, invalid("header: %v", err)
+	}
+	// the algorithm comes from the token, only accept asymmetric ones so
+	// that "none" or a public key used as an HMAC secret can't get through
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return Claims{}, invalid("unsupported alg %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, invalid("signature: %v", err)
+	}
+
+	key, err := p.publicKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return Claims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], signature) {
+		return Claims{}, invalid("bad signature")
+	}
+
+	var token idToken
+	if err := decodeSegment(parts[1], &token); err != nil {
+		return Claims{}, invalid("payload: %v", err)
+	}
+	if token.Issuer != p.cfg.Issuer {
+		return Claims{}, invalid("issuer %q", token.Issuer)
+	}
+	if !token.Audience.contains(p.cfg.ClientID) {
+		return Claims{}, invalid("not issued for this client")
+	}
+	if (len(token.Audience) > 1 || token.AuthorizedParty != "") && token.AuthorizedParty != p.cfg.ClientID {
+		return Claims{}, invalid("authorized party %q", token.AuthorizedParty)
+	}
+	if token.Expiry == 0 || now.After(unixTime(token.Expiry).Add(leeway)) {
+		return Claims{}, invalid("expired")
+	}
+	if token.IssuedAt == 0 || unixTime(token.IssuedAt).After(now.Add(leeway)) {
+		return Claims{}, invalid("issued in the future")
+	}
+	if subtle.ConstantTimeCompare([]byte(token.Nonce), []byte(nonce)) != 1 {
+		return Claims{}, invalid("nonce mismatch")
+	}
+	if token.Subject == "" {
+		return Claims{}, invalid("no subject")
+	}
+
+	return Claims{
+		Subject:           token.Subject,
+		Email:             token.Email,
+		EmailVerified:     bool(token.EmailVerified),
+		Name:              token.Name,
+		PreferredUsername: token.PreferredUsername,
+	}, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		// JWS uses the fixed size r || s encoding, RFC 7518 section 3.4
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest, r, s)
+	}
+	return false
+}
+
+// keySet caches the provider's signing keys by key id
+type keySet struct {
+	keys map[string]crypto.PublicKey
+	// fetchedAt is when the set was last fetched, or failed to be
+	fetchedAt time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the key the token says it's signed with, fetching the
+// key set again when the id is unknown since providers rotate their keys.
+// The lock is never held during the fetch, and concurrent requests for
+// unknown keys wait for a single fetch.
+func (p *Provider) publicKey(ctx context.Context, kid string, alg string) (crypto.PublicKey, error) {
+	for {
+		p.mu.Lock()
+		if key, ok := p.keys.find(kid, alg); ok {
+			p.mu.Unlock()
+			return key, nil
+		}
+		if wait := p.refreshing; wait != nil {
+			p.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if time.Since(p.keys.fetchedAt) < minKeyRefresh {
+			p.mu.Unlock()
+			return nil, invalid("unknown key %q", kid)
+		}
+		done := make(chan struct{})
+		p.refreshing = done
+		p.mu.Unlock()
+
+		keys, err := p.fetchKeys(ctx)
+
+		p.mu.Lock()
+		if err == nil {
+			p.keys = &keySet{keys: keys, fetchedAt: time.Now()}
+		} else {
+			// a failed fetch counts too, a provider that is down isn't
+			// asked again on every login
+			p.keys = &keySet{keys: p.keys.keys, fetchedAt: time.Now()}
+		}
+		p.refreshing = nil
+		close(done)
+		p.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchKeys downloads the provider's key set
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, m.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// keys we can't use are skipped rather than failing the whole set
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// find looks the key up by id. Tokens without a key id are accepted when
+// the set has a single key of the right type.
+func (s *keySet) find(kid string, alg string) (crypto.PublicKey, bool) {
+	if kid != "" {
+		key, ok := s.keys[kid]
+		return key, ok
+	}
+	var found crypto.PublicKey
+	for _, key := range s.keys {
+		if keyMatches(key, alg) {
+			if found != nil {
+				return nil, false
+			}
+			found = key
+		}
+	}
+	return found, found != nil
+}
+
+func keyMatches(key crypto.PublicKey, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	}
+	return false
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < minRSABits || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unacceptable rsa key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,306 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"quickstart/config"
+	"quickstart/oidc/oidctest"
+)
+
+const testClientID = "mytinerary"
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	t.Helper()
+	issuer := oidctest.NewIssuer(testClientID)
+	t.Cleanup(issuer.Close)
+	provider := New(config.OIDC{
+		Issuer:      issuer.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost:8001/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+	return provider, issuer
+}
+
+// login goes through the authorization code flow and returns the code the
+// provider sent back
+func login(t *testing.T, p *Provider, issuer *oidctest.Issuer, req AuthRequest, claims oidctest.Claims) string {
+	t.Helper()
+	authURL, err := p.AuthURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := issuer.Authorize(authURL, "subject-1", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Query().Get("state") != req.State {
+		t.Fatalf("state %q came back as %q", req.State, parsed.Query().Get("state"))
+	}
+	return parsed.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := login(t, p, issuer, req, oidctest.Claims{"email": "alice@example.com", "email_verified": "true", "preferred_username": "alice"})
+
+	claims, err := p.Exchange(context.Background(), code, req, time.Now())
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := Claims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: true, PreferredUsername: "alice"}
+	if claims != want {
+		t.Errorf("claims = %+v, want %+v", claims, want)
+	}
+
+	// the code is single use
+	if _, err := p.Exchange(context.Background(), code, req, time.Now()); err == nil {
+		t.Error("second Exchange with the same code succeeded")
+	}
+}
+
+func TestExchangeChecksPKCEVerifier(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := login(t, p, issuer, req, nil)
+
+	other, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Verifier = other.Verifier
+	if _, err := p.Exchange(context.Background(), code, req, time.Now()); err == nil {
+		t.Error("Exchange with the wrong code verifier succeeded")
+	}
+}
+
+func TestVerifyRejectsClaims(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	now := time.Now()
+	cases := map[string]struct {
+		claims oidctest.Claims
+		nonce  string
+	}{
+		"other issuer":     {claims: oidctest.Claims{"iss": "https://evil.example.com"}, nonce: "n"},
+		"other audience":   {claims: oidctest.Claims{"aud": "someone-else"}, nonce: "n"},
+		"wrong azp":        {claims: oidctest.Claims{"aud": []string{testClientID, "someone-else"}, "azp": "someone-else"}, nonce: "n"},
+		"expired":          {claims: oidctest.Claims{"exp": now.Add(-2 * leeway).Unix()}, nonce: "n"},
+		"no expiry":        {claims: oidctest.Claims{"exp": nil}, nonce: "n"},
+		"issued in future": {claims: oidctest.Claims{"iat": now.Add(2 * leeway).Unix()}, nonce: "n"},
+		"nonce mismatch":   {claims: nil, nonce: "other nonce"},
+		"no subject":       {claims: oidctest.Claims{"sub": ""}, nonce: "n"},
+	}
+	for name, c := range cases {
+		raw := issuer.IDToken("subject-1", "n", c.claims)
+		if _, err := p.Verify(context.Background(), raw, c.nonce, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	if _, err := p.Verify(context.Background(), issuer.IDToken("subject-1", "n", nil), "n", now); err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+	// the signature covers the payload
+	raw := issuer.IDToken("subject-1", "n", nil)
+	tampered := raw[:len(raw)-4] + "AAAA"
+	if _, err := p.Verify(context.Background(), tampered, "n", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("tampered signature: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestVerifyRejectsHeaders(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	now := time.Now()
+
+	cases := map[string]oidctest.Claims{
+		"alg none":           {"alg": "none"},
+		"no alg":             {"alg": nil},
+		"symmetric alg":      {"alg": "HS256"},
+		"other hash":         {"alg": "RS512"},
+		"alg of another key": {"alg": "ES256"},
+		"unknown kid":        {"kid": "key-99"},
+	}
+	for name, header := range cases {
+		raw := issuer.IDTokenWithHeader(header, "subject-1", "n", nil)
+		if _, err := p.Verify(context.Background(), raw, "n", now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	// unsigned, and signed with the public key as an HMAC secret
+	raw := issuer.IDToken("subject-1", "n", nil)
+	parts := strings.Split(raw, ".")
+	payload := parts[1]
+	unsigned := encodeHeader(t, map[string]string{"alg": "none", "typ": "JWT"}) + "." + payload + "."
+	if _, err := p.Verify(context.Background(), unsigned, "n", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("unsigned token: got %v, want ErrInvalidToken", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(issuer.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := [][]byte{der, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})}
+	for _, secret := range secrets {
+		signed := encodeHeader(t, map[string]string{"alg": "HS256", "typ": "JWT", "kid": "key-1"}) + "." + payload
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		confused := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		if _, err := p.Verify(context.Background(), confused, "n", now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("HS256 with the public key: got %v, want ErrInvalidToken", err)
+		}
+	}
+
+	// without a kid the key is picked by alg
+	if _, err := p.Verify(context.Background(), issuer.IDTokenWithHeader(oidctest.Claims{"kid": nil}, "subject-1", "n", nil), "n", now); err != nil {
+		t.Errorf("token without a kid: %v", err)
+	}
+}
+
+func encodeHeader(t *testing.T, header map[string]string) string {
+	t.Helper()
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func TestUnknownKeyRefetchesKeySet(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	if _, err := p.Verify(ctx, issuer.IDToken("subject-1", "n", nil), "n", now); err != nil {
+		t.Fatal(err)
+	}
+	if issuer.KeyRequests() != 1 {
+		t.Fatalf("%d key set requests, want 1", issuer.KeyRequests())
+	}
+
+	issuer.RotateKey()
+	rotated := issuer.IDToken("subject-1", "n", nil)
+	// just fetched, an unknown key isn't worth asking again
+	if _, err := p.Verify(ctx, rotated, "n", now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("rotated key within minKeyRefresh: got %v, want ErrInvalidToken", err)
+	}
+	if issuer.KeyRequests() != 1 {
+		t.Errorf("%d key set requests, want 1", issuer.KeyRequests())
+	}
+
+	p.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-2 * minKeyRefresh)
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, rotated, "n", now); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if issuer.KeyRequests() != 2 {
+		t.Errorf("%d key set requests, want 2", issuer.KeyRequests())
+	}
+}
+
+func TestKeyFetchDoesNotBlockCachedKeys(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	cached := issuer.IDToken("subject-1", "n", nil)
+	if _, err := p.Verify(ctx, cached, "n", now); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.RotateKey()
+	release := issuer.BlockKeys()
+	defer release()
+	p.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-2 * minKeyRefresh)
+	p.mu.Unlock()
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	fetched := make(chan error)
+	go func() {
+		_, err := p.Verify(fetchCtx, issuer.IDToken("subject-1", "n", nil), "n", now)
+		fetched <- err
+	}()
+	for issuer.KeyRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error)
+	go func() {
+		_, err := p.Verify(ctx, cached, "n", now)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Errorf("cached key during a fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a cached key waited for the key set fetch")
+	}
+
+	// the hanging fetch gives up with its request
+	cancel()
+	if err := <-fetched; err == nil {
+		t.Error("cancelled fetch succeeded")
+	}
+}
+
+func TestConcurrentUnknownKeysFetchOnce(t *testing.T) {
+	p, issuer := newTestProvider(t)
+	ctx := context.Background()
+	now := time.Now()
+	if _, err := p.Verify(ctx, issuer.IDToken("subject-1", "n", nil), "n", now); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.RotateKey()
+	rotated := issuer.IDToken("subject-1", "n", nil)
+	release := issuer.BlockKeys()
+	p.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-2 * minKeyRefresh)
+	p.mu.Unlock()
+
+	const logins = 10
+	results := make(chan error, logins)
+	for i := 0; i < logins; i++ {
+		go func() {
+			_, err := p.Verify(ctx, rotated, "n", now)
+			results <- err
+		}()
+	}
+	for issuer.KeyRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	for i := 0; i < logins; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("login %d: %v", i, err)
+		}
+	}
+	if issuer.KeyRequests() != 2 {
+		t.Errorf("%d key set requests, want 2", issuer.KeyRequests())
+	}
+}
@@ -0,0 +1,294 @@
+// Package oidctest runs a fake OpenID Connect provider for tests: discovery,
+// a key set, and a token endpoint that checks PKCE and hands out RS256
+// signed ID tokens.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Claims are merged over the defaults of an ID token, a nil value removes
+// the claim
+type Claims map[string]interface{}
+
+type grant struct {
+	claims      Claims
+	challenge   string
+	redirectURI string
+}
+
+// Issuer is a provider listening on a local port. Its URL is the issuer
+// identifier.
+type Issuer struct {
+	URL      string
+	ClientID string
+	// Now is the time ID tokens are issued at, time.Now when nil
+	Now func() time.Time
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	key          *rsa.PrivateKey
+	kid          string
+	keyCount     int
+	grants       map[string]grant
+	keyRequests  int
+	keysReleased chan struct{}
+}
+
+// NewIssuer starts a provider that knows a single client
+func NewIssuer(clientID string) *Issuer {
+	issuer := &Issuer{ClientID: clientID, grants: map[string]grant{}}
+	issuer.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "log in through Issuer.Authorize", http.StatusNotImplemented)
+	})
+	mux.HandleFunc("/token", issuer.token)
+	mux.HandleFunc("/keys", issuer.keys)
+	issuer.server = httptest.NewServer(mux)
+	issuer.URL = issuer.server.URL
+	return issuer
+}
+
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// RotateKey replaces the signing key with a new one under a new key id,
+// the key set only publishes the new one
+func (i *Issuer) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keyCount++
+	i.key = key
+	i.kid = fmt.Sprintf("key-%d", i.keyCount)
+}
+
+// PublicKey returns the current signing key's public half
+func (i *Issuer) PublicKey() *rsa.PublicKey {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return &i.key.PublicKey
+}
+
+// KeyRequests returns how many times the key set was fetched
+func (i *Issuer) KeyRequests() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.keyRequests
+}
+
+// BlockKeys makes key set requests hang until the returned function is
+// called
+func (i *Issuer) BlockKeys() (release func()) {
+	released := make(chan struct{})
+	i.mu.Lock()
+	i.keysReleased = released
+	i.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(released) })
+	}
+}
+
+func (i *Issuer) now() time.Time {
+	if i.Now != nil {
+		return i.Now()
+	}
+	return time.Now()
+}
+
+// IDToken returns a signed ID token for the client with the given subject,
+// changed by claims
+func (i *Issuer) IDToken(subject string, nonce string, claims Claims) string {
+	return i.IDTokenWithHeader(nil, subject, nonce, claims)
+}
+
+// IDTokenWithHeader is IDToken with header merged over the default JOSE
+// header like claims are. The token is RS256 signed with the current key
+// whatever the header says.
+func (i *Issuer) IDTokenWithHeader(header Claims, subject string, nonce string, claims Claims) string {
+	now := i.now()
+	merged := Claims{
+		"iss":   i.URL,
+		"sub":   subject,
+		"aud":   i.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+
+	i.mu.Lock()
+	key, kid := i.key, i.kid
+	i.mu.Unlock()
+
+	mergedHeader := Claims{"alg": "RS256", "typ": "JWT", "kid": kid}
+	for name, value := range header {
+		if value == nil {
+			delete(mergedHeader, name)
+		} else {
+			mergedHeader[name] = value
+		}
+	}
+
+	encodedHeader, err := json.Marshal(mergedHeader)
+	if err != nil {
+		panic(err)
+	}
+	payload, err := json.Marshal(merged)
+	if err != nil {
+		panic(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Authorize plays the user logging in at the provider: it takes the URL
+// the relying party sent the browser to and returns the callback URL the
+// browser is sent back to. The code it carries is exchanged for an ID
+// token with the given subject and claims.
+func (i *Issuer) Authorize(authURL string, subject string, claims Claims) (string, error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != i.ClientID {
+		return "", fmt.Errorf("unknown client %q", query.Get("client_id"))
+	}
+	if query.Get("code_challenge_method") != "S256" {
+		return "", fmt.Errorf("code_challenge_method %q", query.Get("code_challenge_method"))
+	}
+
+	merged := Claims{"sub": subject, "nonce": query.Get("nonce")}
+	for name, value := range claims {
+		merged[name] = value
+	}
+	code := randomString()
+	i.mu.Lock()
+	i.grants[code] = grant{claims: merged, challenge: query.Get("code_challenge"), redirectURI: query.Get("redirect_uri")}
+	i.mu.Unlock()
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		return "", err
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	return callback.String(), nil
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/keys",
+	})
+}
+
+func (i *Issuer) keys(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	i.keyRequests++
+	released := i.keysReleased
+	key, kid := i.key, i.kid
+	i.mu.Unlock()
+	if released != nil {
+		select {
+		case <-released:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID := r.PostForm.Get("client_id")
+	if username, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(username)
+	}
+
+	i.mu.Lock()
+	grant, ok := i.grants[r.PostForm.Get("code")]
+	// codes work once
+	delete(i.grants, r.PostForm.Get("code"))
+	i.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code" || clientID != i.ClientID:
+		tokenError(w, "invalid_client")
+	case !ok || grant.redirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, "invalid_grant")
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge:
+		// PKCE, RFC 7636 section 4.6
+		tokenError(w, "invalid_grant")
+	default:
+		subject, _ := grant.claims["sub"].(string)
+		nonce, _ := grant.claims["nonce"].(string)
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": randomString(),
+			"token_type":   "Bearer",
+			"id_token":     i.IDToken(subject, nonce, grant.claims),
+		})
+	}
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,73 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"quickstart/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptConfig(cost int) config.Passwords {
+	return config.Passwords{Hasher: Bcrypt, BcryptCost: cost}
+}
+
+func argon2Config(memory int) config.Passwords {
+	return config.Passwords{Hasher: Argon2id, BcryptCost: bcrypt.MinCost, Argon2Memory: memory, Argon2Iterations: 1, Argon2Parallelism: 1}
+}
+
+func mustHash(t *testing.T, h Hasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestVerify(t *testing.T) {
+	bcryptHash := mustHash(t, NewHasher(bcryptConfig(bcrypt.MinCost)), "correct horse")
+	argon2Hash := mustHash(t, NewHasher(argon2Config(64)), "correct horse")
+	if !strings.HasPrefix(argon2Hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("argon2id hash %q", argon2Hash)
+	}
+
+	cases := []struct {
+		name         string
+		cfg          config.Passwords
+		hash         string
+		password     string
+		wantOK       bool
+		wantOutdated bool
+	}{
+		{"bcrypt", bcryptConfig(bcrypt.MinCost), bcryptHash, "correct horse", true, false},
+		{"bcrypt, wrong password", bcryptConfig(bcrypt.MinCost), bcryptHash, "wrong horse", false, false},
+		{"bcrypt, cost raised", bcryptConfig(bcrypt.MinCost + 1), bcryptHash, "correct horse", true, true},
+		{"bcrypt, now argon2id", argon2Config(64), bcryptHash, "correct horse", true, true},
+		{"argon2id", argon2Config(64), argon2Hash, "correct horse", true, false},
+		{"argon2id, wrong password", argon2Config(64), argon2Hash, "wrong horse", false, false},
+		{"argon2id, memory raised", argon2Config(128), argon2Hash, "correct horse", true, true},
+		{"argon2id, now bcrypt", bcryptConfig(bcrypt.MinCost), argon2Hash, "correct horse", true, true},
+		{"empty hash", bcryptConfig(bcrypt.MinCost), "", "", false, false},
+		{"plain text", bcryptConfig(bcrypt.MinCost), "correct horse", "correct horse", false, false},
+		{"argon2id, other version", argon2Config(64), strings.Replace(argon2Hash, "v=19", "v=16", 1), "correct horse", false, false},
+		{"argon2id, no iterations", argon2Config(64), strings.Replace(argon2Hash, "t=1", "t=0", 1), "correct horse", false, false},
+		{"argon2id, truncated", argon2Config(64), argon2Hash[:strings.LastIndex(argon2Hash, "$")], "correct horse", false, false},
+	}
+	for _, c := range cases {
+		ok, outdated := NewHasher(c.cfg).Verify(c.password, c.hash)
+		if ok != c.wantOK || outdated != c.wantOutdated {
+			t.Errorf("%s: got ok %v outdated %v, want %v %v", c.name, ok, outdated, c.wantOK, c.wantOutdated)
+		}
+	}
+}
+
+func TestHashSalts(t *testing.T) {
+	for _, cfg := range []config.Passwords{bcryptConfig(bcrypt.MinCost), argon2Config(64)} {
+		h := NewHasher(cfg)
+		if mustHash(t, h, "correct horse") == mustHash(t, h, "correct horse") {
+			t.Errorf("%s: the same password hashed twice gave the same hash", cfg.Hasher)
+		}
+	}
+}
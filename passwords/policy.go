@@ -0,0 +1,103 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"quickstart/config"
+)
+
+const (
+	// bcrypt ignores what comes after 72 bytes, so longer passwords aren't
+	// accepted rather than silently cut
+	bcryptMaxBytes = 72
+	// maxBytes bounds the work a single argon2id hash can be made to do
+	maxBytes = 1024
+)
+
+// Policy decides which passwords users can choose
+type Policy struct {
+	minLength int
+	maxBytes  int
+	// breached holds the uppercase hex SHA-1 of every refused password
+	breached map[string]struct{}
+}
+
+// NewPolicy loads the breached passwords file, if there is one. It has a
+// password per line, in plain text or as the hex SHA-1 that Have I Been
+// Pwned's downloads use, optionally followed by ":<count>". Lines starting
+// with # are ignored.
+func NewPolicy(cfg config.Passwords) (*Policy, error) {
+	p := &Policy{minLength: cfg.MinLength, maxBytes: maxBytes, breached: map[string]struct{}{}}
+	if cfg.Hasher == Bcrypt {
+		p.maxBytes = bcryptMaxBytes
+	}
+	if cfg.BreachedFile == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(cfg.BreachedFile)
+	if err != nil {
+		return nil, fmt.Errorf("breached passwords: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash := strings.SplitN(line, ":", 2)[0]; isSHA1(hash) {
+			p.breached[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		p.breached[sha1Hex(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("breached passwords: %w", err)
+	}
+	return p, nil
+}
+
+// BreachedCount returns how many passwords the list refuses
+func (p *Policy) BreachedCount() int {
+	return len(p.breached)
+}
+
+// Check returns what's wrong with the password, for the user to read, or ""
+// when it's acceptable
+func (p *Policy) Check(password string, username string) string {
+	switch {
+	case password == "":
+		return "Missing password"
+	case utf8.RuneCountInString(password) < p.minLength:
+		return fmt.Sprintf("Password must be at least %d characters long", p.minLength)
+	case len(password) > p.maxBytes:
+		return "Password is too long"
+	case strings.EqualFold(password, username):
+		return "Password can't be your username"
+	}
+	if _, ok := p.breached[sha1Hex(password)]; ok {
+		return "This password appears in known data breaches, choose another one"
+	}
+	return ""
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,73 @@
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"quickstart/config"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	lines := []string{
+		"# a comment, not a password",
+		"password123",
+		sha1Hex("letmein12345") + ":42",
+		strings.ToLower(sha1Hex("qwertyuiop")),
+		"trustno1trustno1\r",
+	}
+	if err := os.WriteFile(breached, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bcryptPolicy, err := NewPolicy(config.Passwords{Hasher: Bcrypt, MinLength: 8, BreachedFile: breached})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bcryptPolicy.BreachedCount(); n != 4 {
+		t.Errorf("BreachedCount = %d, want 4", n)
+	}
+	argon2Policy, err := NewPolicy(config.Passwords{Hasher: Argon2id, MinLength: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		policy   *Policy
+		password string
+		ok       bool
+	}{
+		{"fine", bcryptPolicy, "correct horse", true},
+		{"empty", bcryptPolicy, "", false},
+		{"too short", bcryptPolicy, "short", false},
+		{"counted in characters", bcryptPolicy, "ééééééé", false},
+		{"long enough in characters", bcryptPolicy, "éééééééé", true},
+		{"the username", bcryptPolicy, "alice-in-wonderland", false},
+		{"the username in other case", bcryptPolicy, "Alice-In-Wonderland", false},
+		{"containing the username", bcryptPolicy, "alice-in-wonderland!", true},
+		{"breached, plain text", bcryptPolicy, "password123", false},
+		{"breached, hash with count", bcryptPolicy, "letmein12345", false},
+		{"breached, lowercase hash", bcryptPolicy, "qwertyuiop", false},
+		{"breached, CRLF line", bcryptPolicy, "trustno1trustno1", false},
+		{"the comment", bcryptPolicy, "# a comment, not a password", true},
+		{"not breached without a file", argon2Policy, "password123", true},
+		{"over bcrypt's 72 bytes", bcryptPolicy, strings.Repeat("a", 73), false},
+		{"72 bytes", bcryptPolicy, strings.Repeat("a", 72), true},
+		{"73 bytes with argon2id", argon2Policy, strings.Repeat("a", 73), true},
+		{"over the argon2id limit", argon2Policy, strings.Repeat("a", maxBytes+1), false},
+	}
+	for _, c := range cases {
+		problem := c.policy.Check(c.password, "alice-in-wonderland")
+		if (problem == "") != c.ok {
+			t.Errorf("%s: got %q", c.name, problem)
+		}
+	}
+}
+
+func TestNewPolicyMissingFile(t *testing.T) {
+	if _, err := NewPolicy(config.Passwords{Hasher: Bcrypt, BreachedFile: filepath.Join(t.TempDir(), "missing.txt")}); err == nil {
+		t.Error("NewPolicy with a missing breached passwords file succeeded")
+	}
+}
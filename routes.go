@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"quickstart/config"
+	"quickstart/endpoints"
+	"quickstart/logging"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func newRouter(cfg config.Config, h *endpoints.Handler) http.Handler {
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(endpoints.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(endpoints.MethodNotAllowed)
+
+	r.Use(endpoints.TagRoute, h.Authenticate, h.VerifyCSRF)
+
+	s := http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.StaticDir)))
+	r.PathPrefix("/static/").Handler(s)
+
+	// route registers fn with the access level required to call it, every
+	// endpoint has to be declared through here
+	route := func(path string, access endpoints.Access, fn endpoint, methods ...string) {
+		route := r.HandleFunc(path, h.Protect(access, fn))
+		if len(methods) > 0 {
+			route.Methods(methods...)
+		}
+	}
+
+	route("/cities", endpoints.Public, returnsJSONMiddleware(h.Cities), "GET")
+	route("/cities", endpoints.Requires(endpoints.ManageCities), returnsJSONMiddleware(h.Cities), "POST")
+	route("/cities/{cityId:[0-9]+}", endpoints.Public, returnsJSONMiddleware(h.City), "GET")
+	route("/cities/{cityId:[0-9]+}", endpoints.Requires(endpoints.ManageCities), returnsJSONMiddleware(h.City), "PUT", "DELETE")
+	route("/cities/{cityId:[0-9]+}/itinerary", endpoints.Public, returnsJSONMiddleware(h.CityItineraries), "GET")
+	route("/cities/{cityId:[0-9]+}/itinerary", endpoints.Authenticated.Scoped(endpoints.ScopeWriteItineraries).VerifiedEmail(), returnsJSONMiddleware(h.CityItineraries), "POST")
+
+	route("/auth/login", endpoints.Public, returnsJSONMiddleware(h.Login))
+	route("/auth/magic-link", endpoints.Public, h.RequestMagicLink, "POST")
+	route("/auth/magic-link/login", endpoints.Public, returnsJSONMiddleware(h.MagicLinkLogin), "POST")
+	route("/auth/login/2fa", endpoints.Public, returnsJSONMiddleware(h.LoginSecondFactor), "POST")
+	if cfg.OIDC.Enabled() {
+		route("/auth/oidc/login", endpoints.Public, h.OIDCLogin, "GET")
+		route("/auth/oidc/callback", endpoints.Public, h.OIDCCallback, "GET")
+	}
+	route("/auth/identities", endpoints.Authenticated, returnsJSONMiddleware(h.Identities), "GET")
+	route("/auth/identities/{identityId:[0-9]+}", endpoints.Authenticated, h.ExternalIdentity, "DELETE")
+	route("/auth/passkeys/login/options", endpoints.Public, returnsJSONMiddleware(h.PasskeyLoginOptions), "POST")
+	route("/auth/passkeys/login", endpoints.Public, returnsJSONMiddleware(h.PasskeyLogin), "POST")
+	route("/auth/passkeys/register/options", endpoints.Authenticated, returnsJSONMiddleware(h.PasskeyRegistrationOptions), "POST")
+	route("/auth/passkeys", endpoints.Authenticated, returnsJSONMiddleware(h.Passkeys), "GET", "POST")
+	route("/auth/passkeys/{passkeyId:[0-9]+}", endpoints.Authenticated, h.Passkey, "DELETE")
+	route("/auth/register", endpoints.Public, h.Register)
+	route("/auth/isLoggedIn", endpoints.Authenticated, h.IsLoggedIn)
+	route("/auth/logout", endpoints.Public, h.Logout)
+	route("/auth/password/reset", endpoints.Public, h.RequestPasswordReset, "POST")
+	route("/auth/password/reset/confirm", endpoints.Public, h.ResetPassword, "POST")
+	route("/auth/email", endpoints.Authenticated, returnsJSONMiddleware(h.Email), "GET", "PUT")
+	route("/auth/email/verification", endpoints.Authenticated, h.ResendEmailVerification, "POST")
+	route("/auth/email/verify", endpoints.Public, h.VerifyEmail, "POST")
+	route("/auth/2fa", endpoints.Authenticated, returnsJSONMiddleware(h.TwoFactor), "GET")
+	route("/auth/2fa/enroll", endpoints.Authenticated, returnsJSONMiddleware(h.EnrollTwoFactor), "POST")
+	route("/auth/2fa/confirm", endpoints.Authenticated, returnsJSONMiddleware(h.ConfirmTwoFactor), "POST")
+	route("/auth/2fa/disable", endpoints.Authenticated, h.DisableTwoFactor, "POST")
+	route("/auth/2fa/recovery-codes", endpoints.Authenticated, returnsJSONMiddleware(h.RegenerateRecoveryCodes), "POST")
+	route("/auth/csrf", endpoints.Authenticated, returnsJSONMiddleware(h.CsrfToken), "GET")
+	route("/auth/sessions", endpoints.Authenticated, returnsJSONMiddleware(h.Sessions), "GET", "DELETE")
+	route("/auth/sessions/{sessionId:[0-9]+}", endpoints.Authenticated, h.Session, "DELETE")
+	route("/auth/tokens", endpoints.Authenticated, returnsJSONMiddleware(h.APITokens), "GET", "POST")
+	route("/auth/tokens/{tokenId:[0-9]+}", endpoints.Authenticated, h.APIToken, "DELETE")
+
+	route("/users/{userId:[0-9]+}", endpoints.Public, returnsJSONMiddleware(h.User), "GET")
+	route("/users/me", endpoints.Authenticated, returnsJSONMiddleware(h.UpdateProfile), "PATCH")
+	route("/users/me", endpoints.Authenticated, h.DeleteAccount, "DELETE")
+	route("/users/me/password", endpoints.Authenticated, h.ChangePassword, "POST")
+
+	route("/itinerary", endpoints.Authenticated.Scoped(endpoints.ScopeWriteItineraries).VerifiedEmail(), h.Itineraries, "POST")
+	route("/itinerary/{itineraryId:[0-9]+}", endpoints.Public, returnsJSONMiddleware(h.Itinerary), "GET")
+	route("/itinerary/{itineraryId:[0-9]+}", endpoints.ItineraryOwner.Scoped(endpoints.ScopeWriteItineraries), returnsJSONMiddleware(h.Itinerary), "PUT", "DELETE")
+	route("/itinerary/{itineraryId:[0-9]+}/comment", endpoints.Authenticated.Scoped(endpoints.ScopeWriteItineraries).VerifiedEmail(), returnsJSONMiddleware(h.ItineraryComment), "POST")
+
+	route("/admin/lockouts", endpoints.Requires(endpoints.ViewSecurityEvents), returnsJSONMiddleware(h.Lockouts), "GET")
+	route("/admin/jobs", endpoints.Requires(endpoints.ViewJobs), returnsJSONMiddleware(h.JobStats), "GET")
+
+	return endpoints.RequestLogger(logging.Default())(endpoints.Recover(cors(cfg.CORSOrigins())(r)))
+}
+
+type endpoint func(http.ResponseWriter, *http.Request)
+
+func returnsJSONMiddleware(fn endpoint) endpoint {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fn(w, r)
+	}
+}
+
+// CORS, wraps the whole router so preflight requests are answered before
+// route method matching. Only the allowed origins get CORS headers, the
+// browser blocks every other cross-origin read.
+func cors(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin != "" && allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			// if Preflight
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				if allowed[origin] {
+					w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%v", (60*5)))
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-CSRF-Token, X-Request-ID")
+					w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"quickstart/config"
+	"quickstart/database"
+	"quickstart/endpoints"
+	"quickstart/mailer"
+	"quickstart/passwords"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testRouter is the full router on memory stores
+type testRouter struct {
+	t      *testing.T
+	h      *endpoints.Handler
+	router http.Handler
+}
+
+func newTestRouter(t *testing.T, configure func(cfg *config.Config)) *testRouter {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Passwords.BcryptCost = bcrypt.MinCost
+	cfg.StaticDir = t.TempDir()
+	if configure != nil {
+		configure(&cfg)
+	}
+	policy, err := passwords.NewPolicy(cfg.Passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := endpoints.New(cfg, database.NewMemoryStores(), nil, mailer.NewMemory(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRouter{t: t, h: h, router: newRouter(cfg, h)}
+}
+
+// caller adds its credentials to requests, the zero value is anonymous
+type caller struct {
+	sessionId string
+	csrfToken string
+	apiToken  string
+}
+
+func (c caller) authorize(r *http.Request) {
+	if c.sessionId != "" {
+		r.AddCookie(&http.Cookie{Name: "sid", Value: c.sessionId})
+		r.Header.Set("X-CSRF-Token", c.csrfToken)
+	}
+	if c.apiToken != "" {
+		r.Header.Set("Authorization", "Bearer "+c.apiToken)
+	}
+}
+
+// user creates an account with the role, its email address verified or not
+func (tr *testRouter) user(username string, role database.Role, verified bool) database.User {
+	tr.t.Helper()
+	ctx := context.Background()
+	user, err := tr.h.Store.Users.Create(ctx, database.User{
+		Username: username,
+		Password: "not a login password",
+		Email:    sql.NullString{String: username + "@example.com", Valid: true},
+	})
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	if err := tr.h.Store.Users.SetRole(ctx, user.Id, role); err != nil {
+		tr.t.Fatal(err)
+	}
+	if verified {
+		if err := tr.h.Store.Users.VerifyEmail(ctx, user.Id, time.Now()); err != nil {
+			tr.t.Fatal(err)
+		}
+	}
+	user, err = tr.h.Store.Users.Get(ctx, user.Id)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return user
+}
+
+// session logs user in with a cookie
+func (tr *testRouter) session(user database.User) caller {
+	tr.t.Helper()
+	c := caller{sessionId: fmt.Sprintf("session-%d", user.Id), csrfToken: fmt.Sprintf("csrf-%d", user.Id)}
+	err := tr.h.Store.Sessions.Create(context.Background(), database.Session{
+		User_id:    user.Id,
+		Session_id: c.sessionId,
+		Expiration: time.Now().Add(time.Hour),
+		CsrfToken:  c.csrfToken,
+	})
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return c
+}
+
+// token issues user an API token with the scopes
+func (tr *testRouter) token(user database.User, scopes ...endpoints.Scope) caller {
+	tr.t.Helper()
+	plain := fmt.Sprintf("token-%d-%v", user.Id, scopes)
+	token := database.APIToken{UserId: user.Id, Name: "test", TokenHash: database.HashToken(plain), CreatedAt: time.Now()}
+	for _, scope := range scopes {
+		token.Scopes = append(token.Scopes, string(scope))
+	}
+	if _, err := tr.h.Store.APITokens.Create(context.Background(), token); err != nil {
+		tr.t.Fatal(err)
+	}
+	return caller{apiToken: plain}
+}
+
+// itinerary creates an itinerary by user in a new city
+func (tr *testRouter) itinerary(user database.User) database.Itinerary {
+	tr.t.Helper()
+	ctx := context.Background()
+	city, err := tr.h.Store.Cities.Create(ctx, database.City{Name: "Lisbon", Country: "Portugal"})
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	itinerary, err := tr.h.Store.Itineraries.Create(ctx, database.Itinerary{
+		Title:      "Trams and pastéis",
+		Creator:    database.Author{Id: user.Id},
+		Duration:   240,
+		Price:      database.Price{Amount: 2500, Currency: "EUR"},
+		Activities: []string{"Tram 28"},
+		Hashtags:   []string{"food"},
+		CityId:     city.Id,
+	})
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return itinerary
+}
+
+// routeCase is a request to the router and the status it must get
+type routeCase struct {
+	name   string
+	caller caller
+	method string
+	path   string
+	body   interface{}
+	want   int
+}
+
+func (tr *testRouter) run(cases []routeCase) {
+	tr.t.Helper()
+	for _, c := range cases {
+		var body []byte
+		if c.body != nil {
+			var err error
+			if body, err = json.Marshal(c.body); err != nil {
+				tr.t.Fatal(err)
+			}
+		}
+		r := httptest.NewRequest(c.method, c.path, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		c.caller.authorize(r)
+		w := httptest.NewRecorder()
+		tr.router.ServeHTTP(w, r)
+		if w.Code != c.want {
+			tr.t.Errorf("%s: %s %s got %d %s, want %d", c.name, c.method, c.path, w.Code, w.Body, c.want)
+		}
+	}
+}
+
+func TestRouteAuthentication(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	alice := tr.user("alice", database.RoleUser, true)
+	itinerary := tr.itinerary(alice)
+	anonymous := caller{}
+	unknownSession := caller{sessionId: "no-such-session", csrfToken: "whatever"}
+	unknownToken := caller{apiToken: "no-such-token"}
+	session := tr.session(alice)
+
+	tr.run([]routeCase{
+		{"public route", anonymous, "GET", "/cities", nil, http.StatusOK},
+		{"public itinerary", anonymous, "GET", fmt.Sprintf("/itinerary/%d", itinerary.Id), nil, http.StatusOK},
+		{"anonymous", anonymous, "GET", "/auth/sessions", nil, http.StatusUnauthorized},
+		{"anonymous write", anonymous, "POST", "/itinerary", map[string]string{}, http.StatusUnauthorized},
+		{"anonymous owner route", anonymous, "DELETE", fmt.Sprintf("/itinerary/%d", itinerary.Id), nil, http.StatusUnauthorized},
+		{"anonymous admin route", anonymous, "GET", "/admin/lockouts", nil, http.StatusUnauthorized},
+		{"unknown session", unknownSession, "GET", "/auth/sessions", nil, http.StatusUnauthorized},
+		{"unknown token", unknownToken, "GET", "/auth/sessions", nil, http.StatusUnauthorized},
+		{"session", session, "GET", "/auth/sessions", nil, http.StatusOK},
+		{"logged in without the permission", session, "GET", "/admin/lockouts", nil, http.StatusForbidden},
+		{"logged in but not the owner", tr.session(tr.user("bob", database.RoleUser, true)), "DELETE", fmt.Sprintf("/itinerary/%d", itinerary.Id), nil, http.StatusForbidden},
+	})
+}
+
+func TestRouteItineraryOwner(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	alice := tr.user("alice", database.RoleUser, true)
+	bob := tr.user("bob", database.RoleUser, true)
+	owner := tr.session(alice)
+	other := tr.session(bob)
+	moderator := tr.session(tr.user("mod", database.RoleModerator, true))
+	admin := tr.session(tr.user("admin", database.RoleAdmin, true))
+	path := func(itinerary database.Itinerary) string { return fmt.Sprintf("/itinerary/%d", itinerary.Id) }
+	update := map[string]interface{}{
+		"title":      "Trams at night",
+		"duration":   120,
+		"price":      map[string]interface{}{"amount": 12.5, "currency": "EUR"},
+		"activities": []string{"Tram 28"},
+	}
+
+	kept := tr.itinerary(alice)
+	tr.run([]routeCase{
+		{"owner updates", owner, "PUT", path(kept), update, http.StatusOK},
+		{"someone else updates", other, "PUT", path(kept), update, http.StatusForbidden},
+		{"someone else deletes", other, "DELETE", path(kept), nil, http.StatusForbidden},
+		{"moderator updates", moderator, "PUT", path(kept), update, http.StatusOK},
+		{"unknown itinerary", owner, "DELETE", "/itinerary/12345", nil, http.StatusNotFound},
+		{"owner deletes", owner, "DELETE", path(tr.itinerary(alice)), nil, http.StatusOK},
+		{"moderator deletes", moderator, "DELETE", path(tr.itinerary(alice)), nil, http.StatusOK},
+		{"admin deletes", admin, "DELETE", path(tr.itinerary(alice)), nil, http.StatusOK},
+	})
+
+	// the update kept the creator, and the comment is by the session's user
+	itinerary, err := tr.h.Store.Itineraries.Get(context.Background(), kept.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itinerary.Creator.Id != alice.Id {
+		t.Errorf("creator after updates %d, want %d", itinerary.Creator.Id, alice.Id)
+	}
+	tr.run([]routeCase{
+		{"comment claiming another author", other, "POST", path(kept) + "/comment", map[string]interface{}{"content": "Go early", "author": alice.Id}, http.StatusOK},
+	})
+	comments, err := tr.h.Store.Comments.ListByItineraries(context.Background(), []int{kept.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || comments[0].Author.Id != bob.Id {
+		t.Errorf("comments %+v, want one by bob", comments)
+	}
+}
+
+func TestRouteRequiresPermission(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	ctx := context.Background()
+	newCity := func() string {
+		city, err := tr.h.Store.Cities.Create(ctx, database.City{Name: "Porto", Country: "Portugal"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("/cities/%d", city.Id)
+	}
+
+	for _, role := range []database.Role{database.RoleUser, database.RoleModerator, database.RoleAdmin} {
+		session := tr.session(tr.user(string(role), role, true))
+		want := func(permission endpoints.Permission, allowed int) int {
+			if endpoints.HasPermission(role, permission) {
+				return allowed
+			}
+			return http.StatusForbidden
+		}
+		tr.run([]routeCase{
+			{string(role) + " creates a city", session, "POST", "/cities", map[string]string{"name": "Braga " + string(role), "country": "Portugal"}, want(endpoints.ManageCities, http.StatusOK)},
+			{string(role) + " deletes a city", session, "DELETE", newCity(), nil, want(endpoints.ManageCities, http.StatusNoContent)},
+			{string(role) + " lists lockouts", session, "GET", "/admin/lockouts", nil, want(endpoints.ViewSecurityEvents, http.StatusOK)},
+			{string(role) + " lists jobs", session, "GET", "/admin/jobs", nil, want(endpoints.ViewJobs, http.StatusOK)},
+			{string(role) + " reads cities", session, "GET", "/cities", nil, http.StatusOK},
+		})
+	}
+
+	// only admins hold these, moderators only moderate itineraries
+	for _, c := range []struct {
+		role       database.Role
+		permission endpoints.Permission
+		want       bool
+	}{
+		{database.RoleUser, endpoints.ModerateItineraries, false},
+		{database.RoleModerator, endpoints.ModerateItineraries, true},
+		{database.RoleModerator, endpoints.ManageCities, false},
+		{database.RoleAdmin, endpoints.ManageCities, true},
+		{database.RoleAdmin, endpoints.ViewSecurityEvents, true},
+		{database.Role("root"), endpoints.ManageCities, false},
+	} {
+		if got := endpoints.HasPermission(c.role, c.permission); got != c.want {
+			t.Errorf("HasPermission(%s, %s) = %v, want %v", c.role, c.permission, got, c.want)
+		}
+	}
+}
+
+func TestRouteVerifiedEmail(t *testing.T) {
+	for _, require := range []bool{false, true} {
+		tr := newTestRouter(t, func(cfg *config.Config) { cfg.RequireVerifiedEmail = require })
+		verified := tr.session(tr.user("alice", database.RoleUser, true))
+		unverified := tr.session(tr.user("bob", database.RoleUser, false))
+		itinerary := tr.itinerary(tr.user("carol", database.RoleUser, true))
+		comment := fmt.Sprintf("/itinerary/%d/comment", itinerary.Id)
+		cityItineraries := fmt.Sprintf("/cities/%d/itinerary", itinerary.CityId)
+
+		// an empty itinerary gets past the gate to fail validation
+		gated, gatedInvalid := http.StatusOK, http.StatusBadRequest
+		if require {
+			gated, gatedInvalid = http.StatusForbidden, http.StatusForbidden
+		}
+		tr.run([]routeCase{
+			{fmt.Sprintf("verified comments (required %v)", require), verified, "POST", comment, map[string]string{"content": "Go early"}, http.StatusOK},
+			{fmt.Sprintf("unverified comments (required %v)", require), unverified, "POST", comment, map[string]string{"content": "Go early"}, gated},
+			{fmt.Sprintf("unverified posts an itinerary (required %v)", require), unverified, "POST", "/itinerary", map[string]string{}, gatedInvalid},
+			{fmt.Sprintf("unverified posts in a city (required %v)", require), unverified, "POST", cityItineraries, map[string]string{}, gatedInvalid},
+			{fmt.Sprintf("unverified reads its email (required %v)", require), unverified, "GET", "/auth/email", nil, http.StatusOK},
+		})
+	}
+}
+
+func TestRouteTokenScopes(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	alice := tr.user("alice", database.RoleUser, true)
+	admin := tr.user("admin", database.RoleAdmin, true)
+	itinerary := tr.itinerary(alice)
+	comment := fmt.Sprintf("/itinerary/%d/comment", itinerary.Id)
+	read := tr.token(alice, endpoints.ScopeRead)
+	write := tr.token(alice, endpoints.ScopeWriteItineraries)
+	noCSRF := tr.session(alice)
+	noCSRF.csrfToken = ""
+	newToken := func(scopes ...string) map[string]interface{} {
+		return map[string]interface{}{"name": "script", "scopes": scopes}
+	}
+
+	tr.run([]routeCase{
+		{"read token reads", read, "GET", "/auth/email", nil, http.StatusOK},
+		{"read token comments", read, "POST", comment, map[string]string{"content": "Go early"}, http.StatusForbidden},
+		{"read token deletes", read, "DELETE", fmt.Sprintf("/itinerary/%d", itinerary.Id), nil, http.StatusForbidden},
+		{"write-only token reads", write, "GET", "/auth/email", nil, http.StatusForbidden},
+		{"write token comments without a CSRF token", write, "POST", comment, map[string]string{"content": "Go early"}, http.StatusOK},
+		{"session comments without a CSRF token", noCSRF, "POST", comment, map[string]string{"content": "Go early"}, http.StatusForbidden},
+		{"token mints a token", write, "POST", "/auth/tokens", newToken("read"), http.StatusForbidden},
+		{"user asks for the admin scope", tr.session(alice), "POST", "/auth/tokens", newToken("admin"), http.StatusBadRequest},
+		{"admin asks for the admin scope", tr.session(admin), "POST", "/auth/tokens", newToken("admin"), http.StatusCreated},
+		{"admin token of an admin", tr.token(admin, endpoints.ScopeAdmin), "GET", "/admin/lockouts", nil, http.StatusOK},
+		{"read token of an admin", tr.token(admin, endpoints.ScopeRead), "GET", "/admin/lockouts", nil, http.StatusForbidden},
+		{"admin token of a user", tr.token(alice, endpoints.ScopeAdmin), "GET", "/admin/lockouts", nil, http.StatusForbidden},
+		{"write token deletes", write, "DELETE", fmt.Sprintf("/itinerary/%d", itinerary.Id), nil, http.StatusOK},
+	})
+}
+
+func TestCORS(t *testing.T) {
+	handler := cors([]string{"https://app.example.com/", "http://localhost:3000"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllowed bool
+	}{
+		{"allowed origin", "GET", "https://app.example.com", false, http.StatusTeapot, true},
+		{"allowed with a trailing slash in the config", "POST", "https://app.example.com", false, http.StatusTeapot, true},
+		{"other allowed origin", "GET", "http://localhost:3000", false, http.StatusTeapot, true},
+		{"other origin", "GET", "https://evil.example.com", false, http.StatusTeapot, false},
+		{"other scheme", "GET", "http://app.example.com", false, http.StatusTeapot, false},
+		{"same origin", "GET", "", false, http.StatusTeapot, false},
+		{"preflight", "OPTIONS", "https://app.example.com", true, http.StatusNoContent, true},
+		{"preflight from another origin", "OPTIONS", "https://evil.example.com", true, http.StatusNoContent, false},
+		{"options without preflight", "OPTIONS", "https://app.example.com", false, http.StatusTeapot, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/cities", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.preflight {
+			r.Header.Set("Access-Control-Request-Method", "DELETE")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.wantStatus {
+			t.Errorf("%s: %d, want %d", c.name, w.Code, c.wantStatus)
+		}
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		credentials := w.Header().Get("Access-Control-Allow-Credentials")
+		if c.wantAllowed && (allowOrigin != c.origin || credentials != "true") {
+			t.Errorf("%s: Allow-Origin %q Allow-Credentials %q, want %q and true", c.name, allowOrigin, credentials, c.origin)
+		}
+		if !c.wantAllowed && (allowOrigin != "" || credentials != "") {
+			t.Errorf("%s: Allow-Origin %q Allow-Credentials %q, want none", c.name, allowOrigin, credentials)
+		}
+		if methods := w.Header().Get("Access-Control-Allow-Methods"); (methods != "") != (c.preflight && c.wantAllowed) {
+			t.Errorf("%s: Allow-Methods %q", c.name, methods)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: Vary %q, want Origin", c.name, w.Header().Get("Vary"))
+		}
+	}
+}
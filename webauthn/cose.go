@@ -0,0 +1,129 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers, https://www.iana.org/assignments/cose
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms are the signature algorithms we accept for credentials, in
+// order of preference
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+const minRSABits = 2048
+
+// COSE key parameters, RFC 9053 section 7
+const (
+	coseKty    = 1
+	coseAlg    = 3
+	coseCrv    = -1 // also n for RSA
+	coseX      = -2 // also e for RSA
+	coseY      = -3
+	ktyOKP     = 1
+	ktyEC2     = 2
+	ktyRSA     = 3
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// publicKey is a credential public key decoded from its COSE encoding
+type publicKey struct {
+	alg int
+	key crypto.PublicKey
+}
+
+// parsePublicKey decodes a COSE_Key. The key is kept in its COSE encoding
+// by callers, which is what the authenticator gave us.
+func parsePublicKey(cose []byte) (publicKey, error) {
+	item, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return publicKey{}, err
+	}
+	if len(rest) != 0 {
+		return publicKey{}, errors.New("trailing data after the public key")
+	}
+	return publicKeyFrom(item)
+}
+
+func publicKeyFrom(item interface{}) (publicKey, error) {
+	m, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return publicKey{}, errors.New("public key is not a map")
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, ok := m[int64(coseAlg)].(int64)
+	if !ok {
+		return publicKey{}, errors.New("public key without an algorithm")
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, y := param(coseX), param(coseY)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, errors.New("invalid P-256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return publicKey{}, errors.New("point not on curve")
+		}
+		return publicKey{alg: AlgES256, key: key}, nil
+
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x := param(coseX)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("invalid Ed25519 key")
+		}
+		return publicKey{alg: AlgEdDSA, key: ed25519.PublicKey(x)}, nil
+
+	case kty == ktyRSA && alg == AlgRS256:
+		n := new(big.Int).SetBytes(param(coseCrv))
+		e := new(big.Int).SetBytes(param(coseX))
+		if n.BitLen() < minRSABits || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return publicKey{}, errors.New("unacceptable rsa key")
+		}
+		return publicKey{alg: AlgRS256, key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// verify checks signature over data
+func (k publicKey) verify(data []byte, signature []byte) bool {
+	return verifySignature(k.alg, k.key, data, signature)
+}
+
+func verifySignature(alg int, key crypto.PublicKey, data []byte, signature []byte) bool {
+	switch alg {
+	case AlgES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		digest := sha256.Sum256(data)
+		// WebAuthn signatures are ASN.1 DER, unlike JWS
+		return ok && ecdsa.VerifyASN1(ecKey, digest[:], signature)
+	case AlgEdDSA:
+		edKey, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(edKey, data, signature)
+	case AlgRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		digest := sha256.Sum256(data)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
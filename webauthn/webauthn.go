@@ -0,0 +1,359 @@
+// Package webauthn is the relying party side of Web Authentication
+// (https://www.w3.org/TR/webauthn-2/): checking the responses of
+// navigator.credentials.create() when a passkey is registered and of
+// navigator.credentials.get() when it's used to log in.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChallengeSize is the number of random bytes in a challenge
+const ChallengeSize = 32
+
+// maxCredentialIdLength is the limit of section 5.8.3
+const maxCredentialIdLength = 1023
+
+var (
+	ErrInvalidResponse = errors.New("webauthn: invalid response")
+	// ErrClonedAuthenticator means the signature counter went backwards,
+	// which points at a copy of the credential's private key being used
+	ErrClonedAuthenticator = errors.New("webauthn: signature counter went backwards")
+)
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidResponse, fmt.Sprintf(format, args...))
+}
+
+// RelyingParty is this server as browsers and authenticators see it
+type RelyingParty struct {
+	// ID is the domain credentials are scoped to
+	ID   string
+	Name string
+	// Origins are the origins of the frontend allowed to use the
+	// credentials
+	Origins []string
+}
+
+// NewChallenge returns fresh random bytes for a ceremony
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ClientData is the collected client data the browser signs over
+type ClientData struct {
+	Type string `json:"type"`
+	// Challenge is base64url encoded
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// ParseClientData decodes clientDataJSON, so that the challenge can be
+// looked up before the response is verified
+func ParseClientData(clientDataJSON []byte) (ClientData, error) {
+	var clientData ClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return ClientData{}, invalid("client data: %v", err)
+	}
+	return clientData, nil
+}
+
+// ChallengeBytes decodes the challenge the response was made for
+func (c ClientData) ChallengeBytes() ([]byte, error) {
+	challenge, err := DecodeBase64(c.Challenge)
+	if err != nil {
+		return nil, invalid("challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+// DecodeBase64 decodes the base64url encoding WebAuthn uses for binary
+// values in JSON, with or without padding
+func DecodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// verifyClientData covers steps 7 to 10 of registration and 10 to 13 of
+// authentication
+func (rp RelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	clientData, err := ParseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+	if clientData.Type != ceremony {
+		return invalid("type %q", clientData.Type)
+	}
+	got, err := clientData.ChallengeBytes()
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return invalid("challenge mismatch")
+	}
+	if !rp.allowedOrigin(clientData.Origin) {
+		return invalid("origin %q", clientData.Origin)
+	}
+	if clientData.CrossOrigin {
+		return invalid("cross origin")
+	}
+	return nil
+}
+
+func (rp RelyingParty) allowedOrigin(origin string) bool {
+	for _, allowed := range rp.Origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator data flags, section 6.1
+const (
+	flagUserPresent      = 1 << 0
+	flagUserVerified     = 1 << 2
+	flagBackupEligible   = 1 << 3
+	flagAttestedCredData = 1 << 6
+	flagExtensionData    = 1 << 7
+)
+
+type authenticatorData struct {
+	rpIdHash  []byte
+	flags     byte
+	signCount uint32
+	// set when flagAttestedCredData is
+	aaguid       []byte
+	credentialId []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, invalid("authenticator data too short")
+	}
+	ad := authenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if ad.flags&flagAttestedCredData != 0 {
+		if len(rest) < 18 {
+			return authenticatorData{}, invalid("attested credential data too short")
+		}
+		ad.aaguid = rest[:16]
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length > maxCredentialIdLength || len(rest) < length {
+			return authenticatorData{}, invalid("credential id length")
+		}
+		ad.credentialId = rest[:length]
+		rest = rest[length:]
+
+		// the key is followed by the extensions, if any, so decoding it is
+		// the only way to know where it ends
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, invalid("credential public key: %v", err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if ad.flags&flagExtensionData != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, invalid("extensions: %v", err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return authenticatorData{}, invalid("trailing authenticator data")
+	}
+	return ad, nil
+}
+
+// check covers the checks shared by both ceremonies: the RP ID hash and the
+// user flags
+func (rp RelyingParty) check(ad authenticatorData, requireUserVerification bool) error {
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIdHash, rpIdHash[:]) {
+		return invalid("rp id hash mismatch")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return invalid("user not present")
+	}
+	if requireUserVerification && ad.flags&flagUserVerified == 0 {
+		return invalid("user not verified")
+	}
+	return nil
+}
+
+// Credential is a newly registered credential
+type Credential struct {
+	ID []byte
+	// PublicKey is COSE encoded
+	PublicKey []byte
+	SignCount uint32
+	AAGUID    []byte
+	// UserVerified is whether the authenticator checked a PIN or biometric
+	UserVerified bool
+	// BackupEligible is whether the credential can be synced between
+	// devices
+	BackupEligible bool
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create()
+// to the given challenge, section 7.1. Attestation is checked for
+// consistency but not against a list of trusted authenticators, the
+// "none" and "packed" formats are supported.
+func (rp RelyingParty) VerifyRegistration(challenge []byte, clientDataJSON []byte, attestationObject []byte, requireUserVerification bool) (Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	item, rest, err := decodeCBOR(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, invalid("attestation object: %v", err)
+	}
+	object, _ := item.(map[interface{}]interface{})
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[interface{}]interface{})
+	rawAuthData, _ := object["authData"].([]byte)
+	if format == "" || statement == nil || rawAuthData == nil {
+		return Credential{}, invalid("incomplete attestation object")
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.check(ad, requireUserVerification); err != nil {
+		return Credential{}, err
+	}
+	if ad.flags&flagAttestedCredData == 0 {
+		return Credential{}, invalid("no attested credential data")
+	}
+	key, err := parsePublicKey(ad.publicKey)
+	if err != nil {
+		return Credential{}, invalid("credential public key: %v", err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	if err := verifyAttestation(format, statement, key, signed); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:             append([]byte(nil), ad.credentialId...),
+		PublicKey:      append([]byte(nil), ad.publicKey...),
+		SignCount:      ad.signCount,
+		AAGUID:         append([]byte(nil), ad.aaguid...),
+		UserVerified:   ad.flags&flagUserVerified != 0,
+		BackupEligible: ad.flags&flagBackupEligible != 0,
+	}, nil
+}
+
+// verifyAttestation checks the attestation statement, sections 8.2 and 8.7
+func verifyAttestation(format string, statement map[interface{}]interface{}, key publicKey, signed []byte) error {
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return invalid("none attestation with a statement")
+		}
+		return nil
+
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		sig, _ := statement["sig"].([]byte)
+		if sig == nil {
+			return invalid("packed attestation without a signature")
+		}
+		chain, ok := statement["x5c"].([]interface{})
+		if !ok {
+			// self attestation, signed with the credential key itself
+			if int(alg) != key.alg || !key.verify(signed, sig) {
+				return invalid("bad self attestation signature")
+			}
+			return nil
+		}
+		if len(chain) == 0 {
+			return invalid("empty attestation certificate chain")
+		}
+		der, _ := chain[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return invalid("attestation certificate: %v", err)
+		}
+		if cert.Version != 3 || cert.IsCA {
+			return invalid("unacceptable attestation certificate")
+		}
+		if !verifySignature(int(alg), cert.PublicKey, signed, sig) {
+			return invalid("bad attestation signature")
+		}
+		return nil
+	}
+	return invalid("unsupported attestation format %q", format)
+}
+
+// Assertion is the response of navigator.credentials.get()
+type Assertion struct {
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+}
+
+// Result is what a successful assertion tells about the authenticator
+type Result struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyAssertion checks an assertion made for the given challenge with
+// the stored credential, section 7.2. The caller stores the returned
+// signature counter for the next login.
+func (rp RelyingParty) VerifyAssertion(challenge []byte, publicKeyCOSE []byte, storedSignCount uint32, assertion Assertion, requireUserVerification bool) (Result, error) {
+	if err := rp.verifyClientData(assertion.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return Result{}, err
+	}
+
+	ad, err := parseAuthenticatorData(assertion.AuthenticatorData)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := rp.check(ad, requireUserVerification); err != nil {
+		return Result{}, err
+	}
+
+	key, err := parsePublicKey(publicKeyCOSE)
+	if err != nil {
+		return Result{}, err
+	}
+	clientDataHash := sha256.Sum256(assertion.ClientDataJSON)
+	signed := append(append([]byte(nil), assertion.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, assertion.Signature) {
+		return Result{}, invalid("bad signature")
+	}
+
+	// authenticators without a counter always send 0, section 6.1.1
+	if (ad.signCount != 0 || storedSignCount != 0) && ad.signCount <= storedSignCount {
+		return Result{}, ErrClonedAuthenticator
+	}
+	return Result{SignCount: ad.signCount, UserVerified: ad.flags&flagUserVerified != 0}, nil
+}
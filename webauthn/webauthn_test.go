@@ -0,0 +1,436 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testRP = RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+
+// cborMap keeps its keys in the order given, so encodings are stable
+type cborMap []cborPair
+
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+// encodeCBOR encodes the few types the tests need
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return append([]byte{major<<5 | 25}, uint16Bytes(uint16(n))...)
+		}
+		return append([]byte{major<<5 | 26}, uint32Bytes(uint32(n))...)
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, encodeCBOR(pair.key)...)
+			out = append(out, encodeCBOR(pair.value)...)
+		}
+		return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func uint16Bytes(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// authenticator is a software ES256 authenticator holding one credential
+type authenticator struct {
+	key *ecdsa.PrivateKey
+	id  []byte
+}
+
+func newAuthenticator(t testing.TB) authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return authenticator{key: key, id: id}
+}
+
+func (a authenticator) publicKeyCOSE() []byte {
+	coordinate := func(n interface{ FillBytes([]byte) []byte }) []byte {
+		return n.FillBytes(make([]byte, 32))
+	}
+	return encodeCBOR(cborMap{
+		{coseKty, ktyEC2},
+		{coseAlg, AlgES256},
+		{coseCrv, crvP256},
+		{coseX, coordinate(a.key.X)},
+		{coseY, coordinate(a.key.Y)},
+	})
+}
+
+func (a authenticator) sign(t testing.TB, authData []byte, clientDataJSON []byte) []byte {
+	t.Helper()
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// ceremony is what the browser and authenticator put in a response, each
+// test case changes one thing from a valid one
+type ceremony struct {
+	rpID      string
+	origin    string
+	challenge []byte
+	flags     byte
+	signCount uint32
+	// trailing is appended to the authenticator data
+	trailing []byte
+}
+
+func validCeremony(challenge []byte) ceremony {
+	return ceremony{
+		rpID:      testRP.ID,
+		origin:    testRP.Origins[0],
+		challenge: challenge,
+		flags:     flagUserPresent | flagUserVerified,
+		signCount: 1,
+	}
+}
+
+func (c ceremony) clientDataJSON(ceremonyType string) []byte {
+	clientDataJSON, _ := json.Marshal(ClientData{
+		Type:      ceremonyType,
+		Challenge: base64.RawURLEncoding.EncodeToString(c.challenge),
+		Origin:    c.origin,
+	})
+	return clientDataJSON
+}
+
+func (c ceremony) authData(attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIdHash[:], c.flags)
+	data = append(data, uint32Bytes(c.signCount)...)
+	data = append(data, attested...)
+	return append(data, c.trailing...)
+}
+
+// register returns clientDataJSON and the attestation object, in the
+// "none" or self attested "packed" format
+func (a authenticator) register(t testing.TB, c ceremony, format string) ([]byte, []byte) {
+	t.Helper()
+	clientDataJSON := c.clientDataJSON("webauthn.create")
+	attested := make([]byte, 16) // zero AAGUID
+	attested = append(attested, uint16Bytes(uint16(len(a.id)))...)
+	attested = append(attested, a.id...)
+	attested = append(attested, a.publicKeyCOSE()...)
+	c.flags |= flagAttestedCredData
+	authData := c.authData(attested)
+
+	statement := cborMap{}
+	if format == "packed" {
+		statement = cborMap{{"alg", AlgES256}, {"sig", a.sign(t, authData, clientDataJSON)}}
+	}
+	return clientDataJSON, encodeCBOR(cborMap{{"fmt", format}, {"attStmt", statement}, {"authData", authData}})
+}
+
+func (a authenticator) assert(t *testing.T, c ceremony) Assertion {
+	t.Helper()
+	clientDataJSON := c.clientDataJSON("webauthn.get")
+	authData := c.authData(nil)
+	return Assertion{ClientDataJSON: clientDataJSON, AuthenticatorData: authData, Signature: a.sign(t, authData, clientDataJSON)}
+}
+
+func newTestChallenge(t *testing.T) []byte {
+	t.Helper()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+func TestRegistration(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		t.Run(format, func(t *testing.T) {
+			a := newAuthenticator(t)
+			challenge := newTestChallenge(t)
+			clientDataJSON, attestationObject := a.register(t, validCeremony(challenge), format)
+
+			credential, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestationObject, true)
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+			if !bytes.Equal(credential.ID, a.id) || !bytes.Equal(credential.PublicKey, a.publicKeyCOSE()) {
+				t.Errorf("credential %x with key %x, want %x with %x", credential.ID, credential.PublicKey, a.id, a.publicKeyCOSE())
+			}
+			if credential.SignCount != 1 || !credential.UserVerified || credential.BackupEligible {
+				t.Errorf("credential = %+v", credential)
+			}
+
+			// the stored key checks logins
+			assertion := a.assert(t, validCeremony(challenge))
+			if _, err := testRP.VerifyAssertion(challenge, credential.PublicKey, 0, assertion, true); err != nil {
+				t.Errorf("VerifyAssertion with the registered key: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistrationRejects(t *testing.T) {
+	challenge := newTestChallenge(t)
+	cases := map[string]func(c *ceremony){
+		"wrong rp id hash":       func(c *ceremony) { c.rpID = "evil.example.com" },
+		"wrong origin":           func(c *ceremony) { c.origin = "https://evil.example.com" },
+		"wrong challenge":        func(c *ceremony) { c.challenge = []byte("another challenge") },
+		"user not present":       func(c *ceremony) { c.flags &^= flagUserPresent },
+		"user not verified":      func(c *ceremony) { c.flags &^= flagUserVerified },
+		"trailing authenticator": func(c *ceremony) { c.trailing = []byte{0} },
+	}
+	for name, change := range cases {
+		for _, format := range []string{"none", "packed"} {
+			a := newAuthenticator(t)
+			c := validCeremony(challenge)
+			change(&c)
+			clientDataJSON, attestationObject := a.register(t, c, format)
+			if _, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestationObject, true); !errors.Is(err, ErrInvalidResponse) {
+				t.Errorf("%s, %s: got %v, want ErrInvalidResponse", name, format, err)
+			}
+		}
+	}
+}
+
+func TestRegistrationRejectsAttestation(t *testing.T) {
+	challenge := newTestChallenge(t)
+	a := newAuthenticator(t)
+	clientDataJSON, attestationObject := a.register(t, validCeremony(challenge), "packed")
+
+	// signed by another key than the credential's
+	c := validCeremony(challenge)
+	_, forged := newAuthenticator(t).register(t, c, "packed")
+	item, _, _ := decodeCBOR(forged)
+	forgedSig := item.(map[interface{}]interface{})["attStmt"].(map[interface{}]interface{})["sig"].([]byte)
+	item, _, _ = decodeCBOR(attestationObject)
+	authData := item.(map[interface{}]interface{})["authData"].([]byte)
+
+	cases := map[string][]byte{
+		"trailing object":       append(append([]byte(nil), attestationObject...), 0),
+		"other key's sig":       encodeCBOR(cborMap{{"fmt", "packed"}, {"attStmt", cborMap{{"alg", AlgES256}, {"sig", forgedSig}}}, {"authData", authData}}),
+		"wrong alg":             encodeCBOR(cborMap{{"fmt", "packed"}, {"attStmt", cborMap{{"alg", AlgRS256}, {"sig", forgedSig}}}, {"authData", authData}}),
+		"none with statement":   encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{{"sig", forgedSig}}}, {"authData", authData}}),
+		"unsupported format":    encodeCBOR(cborMap{{"fmt", "tpm"}, {"attStmt", cborMap{}}, {"authData", authData}}),
+		"missing authData":      encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}}),
+		"no attested cred data": encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", validCeremony(challenge).authData(nil)}}),
+	}
+	for name, object := range cases {
+		if _, err := testRP.VerifyRegistration(challenge, clientDataJSON, object, true); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("%s: got %v, want ErrInvalidResponse", name, err)
+		}
+	}
+
+	// a response to navigator.credentials.get() isn't a registration
+	getClientData := validCeremony(challenge).clientDataJSON("webauthn.get")
+	if _, err := testRP.VerifyRegistration(challenge, getClientData, attestationObject, true); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("webauthn.get client data: got %v, want ErrInvalidResponse", err)
+	}
+}
+
+func TestAssertionRejects(t *testing.T) {
+	a := newAuthenticator(t)
+	challenge := newTestChallenge(t)
+	cases := map[string]func(c *ceremony){
+		"wrong rp id hash":       func(c *ceremony) { c.rpID = "evil.example.com" },
+		"wrong origin":           func(c *ceremony) { c.origin = "https://evil.example.com" },
+		"wrong challenge":        func(c *ceremony) { c.challenge = []byte("another challenge") },
+		"user not present":       func(c *ceremony) { c.flags &^= flagUserPresent },
+		"user not verified":      func(c *ceremony) { c.flags &^= flagUserVerified },
+		"trailing authenticator": func(c *ceremony) { c.trailing = []byte{0} },
+	}
+	for name, change := range cases {
+		c := validCeremony(challenge)
+		c.signCount = 5
+		change(&c)
+		if _, err := testRP.VerifyAssertion(challenge, a.publicKeyCOSE(), 4, a.assert(t, c), true); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("%s: got %v, want ErrInvalidResponse", name, err)
+		}
+	}
+
+	// signed by another authenticator
+	other := newAuthenticator(t).assert(t, validCeremony(challenge))
+	if _, err := testRP.VerifyAssertion(challenge, a.publicKeyCOSE(), 0, other, true); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("other key: got %v, want ErrInvalidResponse", err)
+	}
+}
+
+func TestAssertionSignCount(t *testing.T) {
+	a := newAuthenticator(t)
+	challenge := newTestChallenge(t)
+	cases := []struct {
+		name   string
+		stored uint32
+		sent   uint32
+		err    error
+	}{
+		{"increasing", 4, 5, nil},
+		{"no counter", 0, 0, nil},
+		{"same", 5, 5, ErrClonedAuthenticator},
+		{"backwards", 5, 4, ErrClonedAuthenticator},
+		{"reset to zero", 5, 0, ErrClonedAuthenticator},
+	}
+	for _, c := range cases {
+		ceremony := validCeremony(challenge)
+		ceremony.signCount = c.sent
+		result, err := testRP.VerifyAssertion(challenge, a.publicKeyCOSE(), c.stored, a.assert(t, ceremony), true)
+		if err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err == nil && result.SignCount != c.sent {
+			t.Errorf("%s: counter %d, want %d", c.name, result.SignCount, c.sent)
+		}
+	}
+}
+
+func TestUserFlags(t *testing.T) {
+	a := newAuthenticator(t)
+	challenge := newTestChallenge(t)
+	cases := []struct {
+		name      string
+		flags     byte
+		requireUV bool
+		ok        bool
+	}{
+		{"present and verified", flagUserPresent | flagUserVerified, true, true},
+		{"present, verification required", flagUserPresent, true, false},
+		{"present, verification optional", flagUserPresent, false, true},
+		{"verified but not present", flagUserVerified, false, false},
+		{"neither", 0, false, false},
+	}
+	for _, c := range cases {
+		ceremony := validCeremony(challenge)
+		ceremony.flags = c.flags
+
+		clientDataJSON, attestationObject := a.register(t, ceremony, "packed")
+		credential, err := testRP.VerifyRegistration(challenge, clientDataJSON, attestationObject, c.requireUV)
+		if c.ok != (err == nil) {
+			t.Errorf("%s: registration got %v", c.name, err)
+		} else if err == nil && credential.UserVerified != (c.flags&flagUserVerified != 0) {
+			t.Errorf("%s: registration UserVerified %v", c.name, credential.UserVerified)
+		}
+
+		result, err := testRP.VerifyAssertion(challenge, a.publicKeyCOSE(), 0, a.assert(t, ceremony), c.requireUV)
+		if c.ok != (err == nil) {
+			t.Errorf("%s: assertion got %v", c.name, err)
+		} else if err == nil && result.UserVerified != (c.flags&flagUserVerified != 0) {
+			t.Errorf("%s: assertion UserVerified %v", c.name, result.UserVerified)
+		}
+	}
+}
+
+func TestParsePublicKeyRejects(t *testing.T) {
+	a := newAuthenticator(t)
+	x, y := a.key.X.FillBytes(make([]byte, 32)), a.key.Y.FillBytes(make([]byte, 32))
+	offCurve := append([]byte(nil), y...)
+	offCurve[31] ^= 1
+	cases := map[string]cborMap{
+		"EC2 key claiming RS256": {{coseKty, ktyEC2}, {coseAlg, AlgRS256}, {coseCrv, crvP256}, {coseX, x}, {coseY, y}},
+		"EC2 key claiming EdDSA": {{coseKty, ktyEC2}, {coseAlg, AlgEdDSA}, {coseCrv, crvP256}, {coseX, x}, {coseY, y}},
+		"OKP key claiming ES256": {{coseKty, ktyOKP}, {coseAlg, AlgES256}, {coseCrv, crvEd25519}, {coseX, x}},
+		"other curve":            {{coseKty, ktyEC2}, {coseAlg, AlgES256}, {coseCrv, crvP256 + 1}, {coseX, x}, {coseY, y}},
+		"point off the curve":    {{coseKty, ktyEC2}, {coseAlg, AlgES256}, {coseCrv, crvP256}, {coseX, x}, {coseY, offCurve}},
+		"short coordinate":       {{coseKty, ktyEC2}, {coseAlg, AlgES256}, {coseCrv, crvP256}, {coseX, x[1:]}, {coseY, y}},
+		"no algorithm":           {{coseKty, ktyEC2}, {coseCrv, crvP256}, {coseX, x}, {coseY, y}},
+		"small RSA key":          {{coseKty, ktyRSA}, {coseAlg, AlgRS256}, {coseCrv, x}, {coseX, []byte{1, 0, 1}}},
+	}
+	for name, key := range cases {
+		if _, err := parsePublicKey(encodeCBOR(key)); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+	if _, err := parsePublicKey(append(a.publicKeyCOSE(), 0)); err == nil {
+		t.Error("trailing data: parsed")
+	}
+	if _, err := parsePublicKey(a.publicKeyCOSE()); err != nil {
+		t.Errorf("valid key: %v", err)
+	}
+}
+
+func TestDecodeCBORRejects(t *testing.T) {
+	cases := map[string][]byte{
+		"truncated string":   {0x44, 1, 2},
+		"truncated argument": {0x19, 1},
+		"indefinite length":  {0x5f, 0x41, 0, 0xff},
+		"duplicate key":      {0xa2, 0x01, 0x00, 0x01, 0x00},
+		"array map key":      {0xa1, 0x80, 0x00},
+		"huge array":         {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"float":              {0xf9, 0x3c, 0x00},
+		"nested too deeply":  bytes.Repeat([]byte{0x81}, maxDepth+2),
+	}
+	for name, data := range cases {
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
+
+// FuzzDecodeCBOR feeds the decoder, and the parsers built on it, hostile
+// input. Run it with go test -fuzz=FuzzDecodeCBOR ./webauthn.
+func FuzzDecodeCBOR(f *testing.F) {
+	a := newAuthenticator(f)
+	_, attestationObject := a.register(f, validCeremony([]byte("challenge")), "none")
+	f.Add(attestationObject)
+	f.Add(a.publicKeyCOSE())
+	f.Add([]byte{0xa2, 0x01, 0x00, 0x01, 0x00})
+	f.Add(bytes.Repeat([]byte{0x81}, maxDepth+2))
+	f.Add([]byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		item, rest, err := decodeCBOR(data)
+		if err != nil {
+			return
+		}
+		if len(rest) >= len(data) || !bytes.Equal(rest, data[len(data)-len(rest):]) {
+			t.Fatalf("decoded %v leaving %x of %x", item, rest, data)
+		}
+		// the item alone decodes to nothing left over
+		if _, again, err := decodeCBOR(data[:len(data)-len(rest)]); err != nil || len(again) != 0 {
+			t.Fatalf("item %x decoded again: %v, %x left", data[:len(data)-len(rest)], err, again)
+		}
+		parsePublicKey(data)
+		parseAuthenticatorData(data)
+	})
+}